@@ -0,0 +1,331 @@
+// Apache Arrow and Parquet output of query and report results
+package main
+
+import "io"
+import "fmt"
+import "math/big"
+import "time"
+import "encoding/json"
+import "github.com/jackc/pgx/v5/pgconn"
+import "github.com/jackc/pgx/v5/pgtype"
+import "github.com/apache/arrow/go/v16/arrow"
+import "github.com/apache/arrow/go/v16/arrow/array"
+import "github.com/apache/arrow/go/v16/arrow/decimal128"
+import "github.com/apache/arrow/go/v16/arrow/ipc"
+import "github.com/apache/arrow/go/v16/arrow/memory"
+import "github.com/apache/arrow/go/v16/parquet"
+import "github.com/apache/arrow/go/v16/parquet/compress"
+import "github.com/apache/arrow/go/v16/parquet/pqarrow"
+
+
+// Rows are accumulated into record batches of this size, each of
+// which is written as an Arrow record batch or a Parquet row group
+const arrowBatchSize = 10000
+
+
+// Each column of the result has an Arrow type derived from its
+// PostgreSQL type, and a function to append pgx's values to a builder
+// of that type
+type arrowColumn struct {
+	dataType arrow.DataType
+	appendValue func(b array.Builder, val any) error
+}
+
+
+// Writes either an Arrow IPC stream or a Parquet file
+type arrowRowWriter struct {
+	parquet bool
+	columns []arrowColumn
+	builder *array.RecordBuilder
+	pending int
+	ipcWriter *ipc.Writer
+	pqWriter *pqarrow.FileWriter
+}
+
+func (rw *arrowRowWriter) contentType() string {
+	if rw.parquet {
+		return "application/vnd.apache.parquet"
+	}
+	return "application/vnd.apache.arrow.stream"
+}
+
+func (rw *arrowRowWriter) typed() bool {
+	return true
+}
+
+func (rw *arrowRowWriter) begin(w io.Writer, fields []pgconn.FieldDescription) error {
+	rw.columns = make([]arrowColumn, len(fields))
+	arrowFields := make([]arrow.Field, len(fields))
+	for i, field := range fields {
+		rw.columns[i] = makeArrowColumn(field.DataTypeOID, field.TypeModifier, rw.parquet)
+		arrowFields[i] = arrow.Field{Name: field.Name, Type: rw.columns[i].dataType, Nullable: true}
+	}
+	schema := arrow.NewSchema(arrowFields, nil)
+	rw.builder = array.NewRecordBuilder(memory.DefaultAllocator, schema)
+
+	if !rw.parquet {
+		rw.ipcWriter = ipc.NewWriter(w, ipc.WithSchema(schema))
+		return nil
+	}
+
+	props := parquet.NewWriterProperties(parquet.WithCompression(compress.Codecs.Snappy))
+	var err error
+	rw.pqWriter, err = pqarrow.NewFileWriter(schema, w, props, pqarrow.DefaultWriterProps())
+	return err
+}
+
+func (rw *arrowRowWriter) row(w io.Writer, fields []pgconn.FieldDescription, values []any) error {
+	for i, val := range values {
+		b := rw.builder.Field(i)
+		var err error
+		if val == nil {
+			b.AppendNull()
+		} else {
+			err = rw.columns[i].appendValue(b, val)
+		}
+		if err != nil {
+			return fmt.Errorf("column '%s': %w", fields[i].Name, err)
+		}
+	}
+
+	rw.pending++
+	if rw.pending == arrowBatchSize {
+		return rw.writeBatch()
+	}
+	return nil
+}
+
+func (rw *arrowRowWriter) end(w io.Writer, count int) error {
+	defer rw.builder.Release()
+	if rw.pending > 0 || count == 0 {
+		// An empty result still needs one (empty) batch so readers see the schema
+		err := rw.writeBatch()
+		if err != nil {
+			return err
+		}
+	}
+
+	if rw.parquet {
+		return rw.pqWriter.Close()
+	}
+	return rw.ipcWriter.Close()
+}
+
+// A truncated Arrow stream lacks its end-of-stream marker and a
+// truncated Parquet file lacks its footer, so neither can be mistaken
+// for a complete result. We have no way to put an error message in-band.
+func (rw *arrowRowWriter) fail(w io.Writer, err error) {
+	if rw.builder != nil {
+		rw.builder.Release()
+	}
+}
+
+func (rw *arrowRowWriter) writeBatch() error {
+	rec := rw.builder.NewRecord()
+	defer rec.Release()
+	rw.pending = 0
+
+	if rw.parquet {
+		return rw.pqWriter.Write(rec)
+	}
+	return rw.ipcWriter.Write(rec)
+}
+
+
+func makeArrowColumn(oid uint32, typeModifier int32, forParquet bool) arrowColumn {
+	switch oid {
+	case pgtype.BoolOID:
+		return arrowColumn{arrow.FixedWidthTypes.Boolean, appendArrowValue[bool, *array.BooleanBuilder]}
+	case pgtype.Int2OID:
+		return arrowColumn{arrow.PrimitiveTypes.Int16, appendArrowValue[int16, *array.Int16Builder]}
+	case pgtype.Int4OID:
+		return arrowColumn{arrow.PrimitiveTypes.Int32, appendArrowValue[int32, *array.Int32Builder]}
+	case pgtype.Int8OID:
+		return arrowColumn{arrow.PrimitiveTypes.Int64, appendArrowValue[int64, *array.Int64Builder]}
+	case pgtype.OIDOID:
+		return arrowColumn{arrow.PrimitiveTypes.Uint32, appendArrowValue[uint32, *array.Uint32Builder]}
+	case pgtype.Float4OID:
+		return arrowColumn{arrow.PrimitiveTypes.Float32, appendArrowValue[float32, *array.Float32Builder]}
+	case pgtype.Float8OID:
+		return arrowColumn{arrow.PrimitiveTypes.Float64, appendArrowValue[float64, *array.Float64Builder]}
+	case pgtype.ByteaOID:
+		return arrowColumn{arrow.BinaryTypes.Binary, appendArrowValue[[]byte, *array.BinaryBuilder]}
+	case pgtype.DateOID:
+		return arrowColumn{arrow.FixedWidthTypes.Date32, appendArrowDate}
+	case pgtype.TimestampOID:
+		return arrowColumn{&arrow.TimestampType{Unit: arrow.Microsecond}, appendArrowTimestamp}
+	case pgtype.TimestamptzOID:
+		return arrowColumn{&arrow.TimestampType{Unit: arrow.Microsecond, TimeZone: "UTC"}, appendArrowTimestamp}
+	case pgtype.TimeOID:
+		return arrowColumn{arrow.FixedWidthTypes.Time64us, appendArrowTime}
+	case pgtype.IntervalOID:
+		// Parquet has no equivalent of Arrow's month-day-nanosecond interval
+		if !forParquet {
+			return arrowColumn{arrow.FixedWidthTypes.MonthDayNanoInterval, appendArrowInterval}
+		}
+	case pgtype.NumericOID:
+		// A numeric(p,s) column has typmod ((p << 16) | s) + 4. Unconstrained
+		// numerics, and those too big for a decimal128, become strings
+		if typeModifier >= 4 {
+			precision, scale := (typeModifier - 4) >> 16, (typeModifier - 4) & 0xffff
+			if precision <= 38 && scale <= precision {
+				dt := &arrow.Decimal128Type{Precision: precision, Scale: scale}
+				return arrowColumn{dt, func(b array.Builder, val any) error {
+					return appendArrowDecimal(b, val, precision, scale)
+				}}
+			}
+		}
+	}
+
+	typ, ok := pgTypeMap.TypeForOID(oid)
+	if ok {
+		if codec, ok := typ.Codec.(*pgtype.ArrayCodec); ok {
+			elem := makeArrowColumn(codec.ElementType.OID, -1, forParquet)
+			return arrowColumn{arrow.ListOf(elem.dataType), func(b array.Builder, val any) error {
+				return appendArrowList(b, val, elem)
+			}}
+		}
+	}
+
+	// Everything else is represented as text, as in JSON output
+	return arrowColumn{arrow.BinaryTypes.String, func(b array.Builder, val any) error {
+		return appendArrowString(b, val, oid)
+	}}
+}
+
+
+// Works for all builders whose Append method takes a simple Go type
+func appendArrowValue[T any, B interface{ Append(T) }](b array.Builder, val any) error {
+	v, ok := val.(T)
+	if !ok {
+		return fmt.Errorf("unexpected value %v of type %T", val, val)
+	}
+	b.(B).Append(v)
+	return nil
+}
+
+
+func appendArrowDate(b array.Builder, val any) error {
+	t, ok := val.(time.Time)
+	if !ok {
+		// Arrow cannot represent infinite dates
+		b.AppendNull()
+		return nil
+	}
+	b.(*array.Date32Builder).Append(arrow.Date32FromTime(t))
+	return nil
+}
+
+
+func appendArrowTimestamp(b array.Builder, val any) error {
+	t, ok := val.(time.Time)
+	if !ok {
+		b.AppendNull()
+		return nil
+	}
+	b.(*array.TimestampBuilder).Append(arrow.Timestamp(t.UnixMicro()))
+	return nil
+}
+
+
+func appendArrowTime(b array.Builder, val any) error {
+	t, ok := val.(pgtype.Time)
+	if !ok {
+		return fmt.Errorf("unexpected value %v of type %T", val, val)
+	}
+	b.(*array.Time64Builder).Append(arrow.Time64(t.Microseconds))
+	return nil
+}
+
+
+func appendArrowInterval(b array.Builder, val any) error {
+	iv, ok := val.(pgtype.Interval)
+	if !ok {
+		return fmt.Errorf("unexpected value %v of type %T", val, val)
+	}
+	b.(*array.MonthDayNanoIntervalBuilder).Append(arrow.MonthDayNanoInterval{
+		Months: iv.Months,
+		Days: iv.Days,
+		Nanoseconds: iv.Microseconds * 1000,
+	})
+	return nil
+}
+
+
+// Values with more decimal places than the column are rounded half away
+// from zero, as PostgreSQL does; values too big for it are an error
+func appendArrowDecimal(b array.Builder, val any, precision int32, scale int32) error {
+	n, ok := val.(pgtype.Numeric)
+	if !ok {
+		return fmt.Errorf("unexpected value %v of type %T", val, val)
+	}
+	if n.NaN || n.InfinityModifier != pgtype.Finite || n.Int == nil {
+		b.AppendNull()
+		return nil
+	}
+
+	// The value is n.Int * 10^n.Exp, and we need it as an integer * 10^-scale
+	i := new(big.Int).Set(n.Int)
+	shift := int64(n.Exp + scale)
+	if shift > 0 {
+		i.Mul(i, pow10(shift))
+	} else if shift < 0 {
+		d := pow10(-shift)
+		r := new(big.Int)
+		i.QuoRem(i, d, r)
+		if r.Abs(r).Lsh(r, 1).Cmp(d) >= 0 {
+			i.Add(i, big.NewInt(int64(n.Int.Sign())))
+		}
+	}
+	if new(big.Int).Abs(i).Cmp(pow10(int64(precision))) >= 0 {
+		return fmt.Errorf("value %se%d does not fit in numeric(%d,%d)", n.Int, n.Exp, precision, scale)
+	}
+	b.(*array.Decimal128Builder).Append(decimal128.FromBigInt(i))
+	return nil
+}
+
+
+func pow10(n int64) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(n), nil)
+}
+
+
+func appendArrowList(b array.Builder, val any, elem arrowColumn) error {
+	v, ok := val.([]any)
+	if !ok {
+		return fmt.Errorf("unexpected value %v of type %T", val, val)
+	}
+
+	lb := b.(*array.ListBuilder)
+	lb.Append(true)
+	vb := lb.ValueBuilder()
+	for _, e := range v {
+		if e == nil {
+			vb.AppendNull()
+		} else if _, nested := e.([]any); nested {
+			return fmt.Errorf("multi-dimensional arrays are not supported")
+		} else {
+			err := elem.appendValue(vb, e)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+
+func appendArrowString(b array.Builder, val any, oid uint32) error {
+	// Arrow output is new, so has no older rendering to remain compatible with
+	v := fixValue(val, oid, outputOptions{PostgresFormats: true})
+	s, ok := v.(string)
+	if !ok {
+		bytes, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		s = string(bytes)
+	}
+	b.(*array.StringBuilder).Append(s)
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import "io"
+import "bytes"
+import "context"
+import "time"
+import "testing"
+import "math/big"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/jackc/pgx/v5/pgconn"
+import "github.com/jackc/pgx/v5/pgtype"
+import "github.com/pashagolub/pgxmock/v3"
+import "github.com/apache/arrow/go/v16/arrow"
+import "github.com/apache/arrow/go/v16/arrow/array"
+import "github.com/apache/arrow/go/v16/arrow/ipc"
+import "github.com/apache/arrow/go/v16/arrow/memory"
+import "github.com/apache/arrow/go/v16/parquet/file"
+import "github.com/apache/arrow/go/v16/parquet/pqarrow"
+
+
+func makeTypedRows() *pgxmock.Rows {
+	due := time.Date(2023, 3, 18, 0, 0, 0, 0, time.UTC)
+	return pgxmock.NewRowsWithColumnDefinition(
+		pgconn.FieldDescription{Name: "id", DataTypeOID: pgtype.Int4OID},
+		pgconn.FieldDescription{Name: "name", DataTypeOID: pgtype.TextOID},
+		pgconn.FieldDescription{Name: "price", DataTypeOID: pgtype.NumericOID, TypeModifier: (10 << 16 | 2) + 4},
+		pgconn.FieldDescription{Name: "due", DataTypeOID: pgtype.DateOID},
+		pgconn.FieldDescription{Name: "tags", DataTypeOID: pgtype.TextArrayOID},
+		pgconn.FieldDescription{Name: "wait", DataTypeOID: pgtype.IntervalOID},
+		pgconn.FieldDescription{Name: "misc"},
+	).
+		AddRow(int32(1), "mike", pgtype.Numeric{Int: big.NewInt(1234), Exp: -2, Valid: true}, due,
+			[]any{"a", nil}, pgtype.Interval{Days: 3, Valid: true}, 29).
+		AddRow(nil, nil, nil, nil, nil, nil, nil)
+}
+
+
+func streamTypedRows(t *testing.T, format string) (*httptest.ResponseRecorder, error) {
+	mock, err := pgxmock.NewPool()
+	assert.Nil(t, err)
+	defer mock.Close()
+	mock.ExpectQuery("SELECT").WillReturnRows(makeTypedRows())
+	rows, err := mock.Query(context.Background(), "SELECT")
+	assert.Nil(t, err)
+
+	w := httptest.NewRecorder()
+	err = streamRows(w, rows, outputOptions{Format: format}, false, nil)
+	return w, err
+}
+
+
+func Test_arrowOutput(t *testing.T) {
+	t.Run("Arrow IPC stream", func(t *testing.T) {
+		w, err := streamTypedRows(t, "arrow")
+		assert.Nil(t, err)
+		resp := w.Result()
+		assert.Equal(t, "application/vnd.apache.arrow.stream", resp.Header.Get("Content-Type"))
+
+		body, _ := io.ReadAll(resp.Body)
+		reader, err := ipc.NewReader(bytes.NewReader(body))
+		assert.Nil(t, err)
+		defer reader.Release()
+
+		schema := reader.Schema()
+		assert.Equal(t, arrow.PrimitiveTypes.Int32, schema.Field(0).Type)
+		assert.Equal(t, arrow.BinaryTypes.String, schema.Field(1).Type)
+		assert.Equal(t, &arrow.Decimal128Type{Precision: 10, Scale: 2}, schema.Field(2).Type)
+		assert.Equal(t, arrow.FixedWidthTypes.Date32, schema.Field(3).Type)
+		assert.Equal(t, arrow.ListOf(arrow.BinaryTypes.String), schema.Field(4).Type)
+		assert.Equal(t, arrow.FixedWidthTypes.MonthDayNanoInterval, schema.Field(5).Type)
+		assert.Equal(t, arrow.BinaryTypes.String, schema.Field(6).Type)
+
+		assert.True(t, reader.Next())
+		rec := reader.Record()
+		assert.EqualValues(t, 2, rec.NumRows())
+		assert.Equal(t, int32(1), rec.Column(0).(*array.Int32).Value(0))
+		assert.Equal(t, "mike", rec.Column(1).(*array.String).Value(0))
+		assert.Equal(t, "12.34", rec.Column(2).(*array.Decimal128).ValueStr(0))
+		assert.Equal(t, "2023-03-18", rec.Column(3).(*array.Date32).Value(0).FormattedString())
+		assert.Equal(t, `["a",null]`, rec.Column(4).(*array.List).ValueStr(0))
+		assert.Equal(t, int32(3), rec.Column(5).(*array.MonthDayNanoInterval).Value(0).Days)
+		assert.Equal(t, "29", rec.Column(6).(*array.String).Value(0))
+		for i := 0; i < 7; i++ {
+			assert.True(t, rec.Column(i).IsNull(1), "column %d of second row should be null", i)
+		}
+		assert.False(t, reader.Next())
+		assert.Nil(t, reader.Err())
+	})
+
+	t.Run("Parquet file", func(t *testing.T) {
+		w, err := streamTypedRows(t, "parquet")
+		assert.Nil(t, err)
+		resp := w.Result()
+		assert.Equal(t, "application/vnd.apache.parquet", resp.Header.Get("Content-Type"))
+		assert.Contains(t, resp.Header.Get("Content-Disposition"), "attachment")
+
+		body, _ := io.ReadAll(resp.Body)
+		pf, err := file.NewParquetReader(bytes.NewReader(body))
+		assert.Nil(t, err)
+		defer pf.Close()
+		fr, err := pqarrow.NewFileReader(pf, pqarrow.ArrowReadProperties{}, memory.DefaultAllocator)
+		assert.Nil(t, err)
+		table, err := fr.ReadTable(context.Background())
+		assert.Nil(t, err)
+		defer table.Release()
+
+		assert.EqualValues(t, 2, table.NumRows())
+		schema := table.Schema()
+		assert.Equal(t, &arrow.Decimal128Type{Precision: 10, Scale: 2}, schema.Field(2).Type)
+		// Intervals are strings in Parquet
+		assert.Equal(t, arrow.BinaryTypes.String, schema.Field(5).Type)
+		assert.Equal(t, "P3D", table.Column(5).Data().Chunk(0).(*array.String).Value(0))
+	})
+}
+
+
+func Test_appendArrowDecimal(t *testing.T) {
+	tests := []struct {
+		name string
+		value pgtype.Numeric
+		expected string
+		errorstr string
+	}{
+		{ name: "exact", value: pgtype.Numeric{Int: big.NewInt(1234), Exp: -2, Valid: true}, expected: "12.34" },
+		{ name: "padded", value: pgtype.Numeric{Int: big.NewInt(12), Exp: 0, Valid: true}, expected: "12" },
+		{ name: "rounded down", value: pgtype.Numeric{Int: big.NewInt(123449), Exp: -4, Valid: true}, expected: "12.34" },
+		{ name: "rounded up", value: pgtype.Numeric{Int: big.NewInt(12345), Exp: -3, Valid: true}, expected: "12.35" },
+		{ name: "negative rounded away from zero", value: pgtype.Numeric{Int: big.NewInt(-12345), Exp: -3, Valid: true}, expected: "-12.35" },
+		{ name: "rounded up to the precision", value: pgtype.Numeric{Int: big.NewInt(99999), Exp: -3, Valid: true}, errorstr: "value 99999e-3 does not fit in numeric(4,2)" },
+		{ name: "too big", value: pgtype.Numeric{Int: big.NewInt(123), Exp: 0, Valid: true}, errorstr: "value 123e0 does not fit in numeric(4,2)" },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := array.NewDecimal128Builder(memory.DefaultAllocator, &arrow.Decimal128Type{Precision: 4, Scale: 2})
+			defer b.Release()
+			err := appendArrowDecimal(b, test.value, 4, 2)
+			if test.errorstr != "" {
+				assert.EqualError(t, err, test.errorstr)
+				return
+			}
+			assert.Nil(t, err)
+			arr := b.NewDecimal128Array()
+			defer arr.Release()
+			assert.Equal(t, test.expected, arr.ValueStr(0))
+		})
+	}
+}
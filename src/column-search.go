@@ -0,0 +1,169 @@
+// Search for columns by name across all tables
+package main
+
+import "context"
+import "errors"
+import "fmt"
+import "strconv"
+import "strings"
+import "net/http"
+import "github.com/jackc/pgx/v5"
+import "github.com/jackc/pgx/v5/pgconn"
+
+
+const defaultColumnSearchLimit = 100
+
+
+type columnMatch struct {
+	TableSchema string `db:"table_schema" json:"tableSchema"`
+	TableName string `db:"table_name" json:"tableName"`
+	ColumnName string `db:"column_name" json:"columnName"`
+	DataType string `db:"data_type" json:"data_type"` // named as in dbColumn
+	Comment *string `db:"comment" json:"comment,omitempty"`
+}
+
+
+type columnSearch struct {
+	term string
+	regex bool
+	comments bool
+	types []string
+	limit int
+}
+
+
+func parseColumnSearch(req *http.Request) (columnSearch, error) {
+	v := req.URL.Query()
+	search := columnSearch{
+		term: v.Get("q"),
+		limit: defaultColumnSearchLimit,
+	}
+	if search.term == "" {
+		return search, fmt.Errorf("must specify search term q")
+	}
+
+	switch v.Get("match") {
+	case "", "substring":
+		// The default
+	case "regex":
+		search.regex = true
+	default:
+		return search, fmt.Errorf("unsupported match type '%s'", v.Get("match"))
+	}
+
+	var err error
+	search.comments, err = parseBoolParam(v, "comments")
+	if err != nil {
+		return search, err
+	}
+
+	if s := v.Get("type"); s != "" {
+		for _, t := range strings.Split(s, ",") {
+			search.types = append(search.types, strings.TrimSpace(t))
+		}
+	}
+
+	if s := v.Get("limit"); s != "" {
+		search.limit, err = strconv.Atoi(s)
+		if err != nil || search.limit < 1 {
+			return search, fmt.Errorf("bad value '%s' for limit", s)
+		}
+	}
+
+	return search, nil
+}
+
+
+func handleColumnSearch(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	search, err := parseColumnSearch(req)
+	if err != nil {
+		return err
+	}
+
+	db, dbConn, err := session.findDbConn(req)
+	if err != nil {
+		return fmt.Errorf("could not find reporting DB: %w", err)
+	}
+
+	rules, err := fetchVisibilityRules(req, session)
+	if err != nil {
+		return err
+	}
+
+	// Only tables that would be listed by /ldp/db/tables are searched
+	tables, err := db.schemaCache.fetchTables(dbConn, db.isMDB, rules)
+	if err != nil {
+		return fmt.Errorf("could not fetch tables from reporting DB: %w", err)
+	}
+
+	matches, err := searchColumns(dbConn, tables, search)
+	var he *httpError
+	if errors.As(err, &he) {
+		return he
+	} else if err != nil {
+		return fmt.Errorf("could not search columns in reporting DB: %w", err)
+	}
+
+	return sendJSON(w, matches, "column matches")
+}
+
+
+// Matches are ranked: first columns whose names are exactly the
+// search term, then those whose names match it, then those whose
+// comments match it. Within each rank, shorter names come first.
+// All matching is case-insensitive.
+func searchColumns(dbConn PgxIface, tables []dbTable, search columnSearch) ([]columnMatch, error) {
+	schemas, names := splitTables(tables)
+	match := func(expr string) string {
+		if search.regex {
+			return expr + " ~* $3"
+		}
+		return "strpos(lower(" + expr + "), lower($3)) > 0"
+	}
+	nameMatch := match("c.column_name")
+	commentMatch := "false"
+	if search.comments {
+		commentMatch = match("col_description(a.attrelid, a.attnum)")
+	}
+	if search.types == nil {
+		search.types = []string{}
+	}
+
+	query := `SELECT c.table_schema, c.table_name, c.column_name, c.data_type,
+		    col_description(a.attrelid, a.attnum) AS comment
+		FROM unnest($1::text[], $2::text[]) AS t(schema_name, table_name)
+		    JOIN information_schema.columns c ON c.table_schema = t.schema_name AND c.table_name = t.table_name
+		    JOIN pg_namespace n ON n.nspname = c.table_schema
+		    JOIN pg_class r ON r.relnamespace = n.oid AND r.relname = c.table_name
+		    JOIN pg_attribute a ON a.attrelid = r.oid AND a.attname = c.column_name
+		WHERE (` + nameMatch + ` OR ` + commentMatch + `)
+		    AND has_column_privilege(r.oid, a.attnum, 'SELECT')
+		    AND (cardinality($4::text[]) = 0 OR c.data_type = ANY($4) OR format_type(a.atttypid, NULL) = ANY($4))
+		ORDER BY CASE WHEN lower(c.column_name) = lower($3) THEN 0 WHEN ` + nameMatch + ` THEN 1 ELSE 2 END,
+		    length(c.column_name), c.table_schema, c.table_name, c.ordinal_position
+		LIMIT $5`
+	rows, err := dbConn.Query(context.Background(), query, schemas, names, search.term, search.types, search.limit)
+	if err != nil {
+		return nil, badRegexError(search, err, fmt.Errorf("could not run query '%s': %w", query, err))
+	}
+	defer rows.Close()
+
+	matches, err := pgx.CollectRows(rows, pgx.RowToStructByName[columnMatch])
+	if err != nil {
+		return nil, badRegexError(search, err, err)
+	}
+	return matches, nil
+}
+
+
+// A regular expression is only compiled when PostgreSQL first uses it,
+// so this can happen either when the query is run or when its rows are
+// read. Go's regular expressions differ from PostgreSQL's, so cannot
+// be used to check it beforehand.
+func badRegexError(search columnSearch, err error, otherwise error) error {
+	var pgErr *pgconn.PgError
+	if search.regex && errors.As(err, &pgErr) && pgErr.Code == "2201B" { // invalid_regular_expression
+		return MakeHttpError(http.StatusBadRequest, fmt.Sprintf("bad regular expression '%s': %s", search.term, pgErr.Message))
+	}
+	return otherwise
+}
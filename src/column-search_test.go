@@ -0,0 +1,108 @@
+package main
+
+import "errors"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/jackc/pgx/v5/pgconn"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func Test_parseColumnSearch(t *testing.T) {
+	tests := []struct {
+		name string
+		query string
+		expected columnSearch
+		errorstr string
+	}{
+		{ name: "no term", query: "", errorstr: "must specify search term q" },
+		{ name: "simple", query: "q=barcode", expected: columnSearch{term: "barcode", limit: 100} },
+		{
+			name: "everything",
+			query: "q=^patron&match=regex&comments=true&type=uuid,%20text&limit=5",
+			expected: columnSearch{term: "^patron", regex: true, comments: true, types: []string{"uuid", "text"}, limit: 5},
+		},
+		{ name: "explicit substring", query: "q=x&match=substring", expected: columnSearch{term: "x", limit: 100} },
+		{ name: "bad match", query: "q=x&match=fuzzy", errorstr: "unsupported match type 'fuzzy'" },
+		{ name: "bad comments", query: "q=x&comments=perhaps", errorstr: "bad value 'perhaps' for comments" },
+		{ name: "bad limit", query: "q=x&limit=0", errorstr: "bad value '0' for limit" },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ldp/db/columns/search?" + test.query, nil)
+			search, err := parseColumnSearch(req)
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, search)
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+			}
+		})
+	}
+}
+
+
+func Test_searchColumns(t *testing.T) {
+	tables := []dbTable{{ SchemaName: "folio_users", TableName: "users" }}
+	tests := []struct {
+		name string
+		search columnSearch
+		expectedSql string
+	}{
+		{
+			name: "substring in names",
+			search: columnSearch{term: "group", limit: 10},
+			expectedSql: `WHERE \(strpos\(lower\(c.column_name\), lower\(\$3\)\) > 0 OR false\)`,
+		},
+		{
+			name: "regex in names and comments",
+			search: columnSearch{term: "^pat", regex: true, comments: true, limit: 10},
+			expectedSql: `WHERE \(c.column_name ~\* \$3 OR col_description\(a.attrelid, a.attnum\) ~\* \$3\)`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			assert.Nil(t, err)
+			defer mock.Close()
+			mock.ExpectQuery(test.expectedSql).
+				WithArgs([]string{"folio_users"}, []string{"users"}, test.search.term, []string{}, 10).
+				WillReturnRows(pgxmock.NewRows([]string{"table_schema", "table_name", "column_name", "data_type", "comment"}).
+					AddRow("folio_users", "users", "patron_group_id", "uuid", nil))
+
+			matches, err := searchColumns(mock, tables, test.search)
+			assert.Nil(t, err)
+			assert.Equal(t, []columnMatch{
+				{ TableSchema: "folio_users", TableName: "users", ColumnName: "patron_group_id", DataType: "uuid" },
+			}, matches)
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+
+	t.Run("bad regex", func(t *testing.T) {
+		regexErr := &pgconn.PgError{Code: "2201B", Message: "invalid regular expression: parentheses () not balanced"}
+		for _, whenRead := range []bool{false, true} {
+			mock, err := pgxmock.NewPool()
+			assert.Nil(t, err)
+			defer mock.Close()
+			eq := mock.ExpectQuery(`c.column_name ~\* \$3`).
+				WithArgs([]string{"folio_users"}, []string{"users"}, "(pat", []string{}, 10)
+			if whenRead {
+				eq.WillReturnRows(pgxmock.NewRows([]string{"table_schema", "table_name", "column_name", "data_type", "comment"}).
+					AddRow("folio_users", "users", "patron_group_id", "uuid", nil).RowError(0, regexErr))
+			} else {
+				eq.WillReturnError(regexErr)
+			}
+
+			_, err = searchColumns(mock, tables, columnSearch{term: "(pat", regex: true, limit: 10})
+			assert.EqualError(t, err, "bad regular expression '(pat': invalid regular expression: parentheses () not balanced")
+			var he *httpError
+			if assert.True(t, errors.As(err, &he)) {
+				assert.Equal(t, http.StatusBadRequest, he.status)
+			}
+		}
+	})
+}
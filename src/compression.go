@@ -0,0 +1,224 @@
+// Compression of responses, negotiated by Accept-Encoding
+package main
+
+import "io"
+import "sort"
+import "strconv"
+import "strings"
+import "net/http"
+import "compress/gzip"
+import "github.com/klauspost/compress/zstd"
+import "github.com/andybalholm/brotli"
+
+
+// Responses smaller than this are not worth compressing, unless the
+// configuration file specifies otherwise
+const defaultCompressionMinSize = 1024
+
+
+// Supported encodings, in order of preference when the client
+// expresses no preference of its own
+var compressionEncodings = []string{"zstd", "br", "gzip"}
+
+
+// Content types that are already compressed
+var precompressedTypes = map[string]bool{
+	"application/vnd.apache.parquet": true,
+}
+
+
+// Works out which encoding to use from the client's Accept-Encoding
+// header, honouring q-values. Returns "" if none is acceptable.
+func chooseEncoding(acceptEncoding string) string {
+	qvalues := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		params = strings.TrimSpace(params)
+		if strings.HasPrefix(params, "q=") {
+			val, err := strconv.ParseFloat(params[2:], 64)
+			if err == nil {
+				q = val
+			}
+		}
+		qvalues[name] = q
+	}
+
+	candidates := []string{}
+	for _, encoding := range compressionEncodings {
+		q, ok := qvalues[encoding]
+		if !ok {
+			q, ok = qvalues["*"]
+		}
+		if ok && q > 0 {
+			candidates = append(candidates, encoding)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	// Stable, so that ties are broken by our own preference order
+	sort.SliceStable(candidates, func(i, j int) bool {
+		qi, ok := qvalues[candidates[i]]
+		if !ok {
+			qi = qvalues["*"]
+		}
+		qj, ok := qvalues[candidates[j]]
+		if !ok {
+			qj = qvalues["*"]
+		}
+		return qi > qj
+	})
+	return candidates[0]
+}
+
+
+// A compressingWriter buffers the start of a response until either
+// minSize bytes have been written, in which case the response is
+// compressed, or the handler finishes, in which case it is sent as
+// it is. A flush before the threshold is reached also starts
+// compression, since only streamed responses are flushed and their
+// eventual size is unknown.
+type compressingWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize int
+	status int
+	buf []byte
+	decided bool
+	encoder io.WriteCloser
+}
+
+
+// Returns nil if the client does not accept any supported encoding
+func newCompressingWriter(w http.ResponseWriter, req *http.Request, cfg compressionConfig) *compressingWriter {
+	if cfg.Disabled {
+		return nil
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := chooseEncoding(req.Header.Get("Accept-Encoding"))
+	if encoding == "" || req.Method == "HEAD" {
+		return nil
+	}
+
+	minSize := cfg.MinSize
+	if minSize == 0 {
+		minSize = defaultCompressionMinSize
+	}
+	return &compressingWriter{
+		ResponseWriter: w,
+		encoding: encoding,
+		minSize: minSize,
+	}
+}
+
+
+func (cw *compressingWriter) WriteHeader(status int) {
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+
+func (cw *compressingWriter) Write(p []byte) (int, error) {
+	if cw.decided {
+		if cw.encoder != nil {
+			return cw.encoder.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.minSize {
+		err := cw.decide(true)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+
+func (cw *compressingWriter) Flush() {
+	if !cw.decided {
+		_ = cw.decide(true)
+	}
+
+	if f, ok := cw.encoder.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+
+// Allows http.ResponseController to reach the underlying writer
+func (cw *compressingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+
+// Must be called when the handler has finished writing the response
+func (cw *compressingWriter) Close() error {
+	if !cw.decided {
+		return cw.decide(false)
+	}
+	if cw.encoder != nil {
+		return cw.encoder.Close()
+	}
+	return nil
+}
+
+
+// Sends the headers and whatever has been buffered so far
+func (cw *compressingWriter) decide(compress bool) error {
+	cw.decided = true
+	header := cw.Header()
+	status := cw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	if compress && header.Get("Content-Encoding") == "" &&
+		!precompressedTypes[header.Get("Content-Type")] &&
+		status != http.StatusNoContent && status != http.StatusNotModified {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		cw.encoder = makeEncoder(cw.encoding, cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+
+func makeEncoder(encoding string, w io.Writer) io.WriteCloser {
+	switch encoding {
+	case "zstd":
+		// Options are known to be valid, so this cannot fail
+		enc, _ := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		return enc
+	case "br":
+		return brotli.NewWriterLevel(w, 4)
+	default:
+		return gzip.NewWriter(w)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import "io"
+import "bytes"
+import "strings"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "compress/gzip"
+import "github.com/stretchr/testify/assert"
+import "github.com/klauspost/compress/zstd"
+import "github.com/andybalholm/brotli"
+
+
+func Test_chooseEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		expected string
+	}{
+		{ header: "", expected: "" },
+		{ header: "identity", expected: "" },
+		{ header: "gzip", expected: "gzip" },
+		{ header: "gzip, deflate, br", expected: "br" },
+		{ header: "gzip, deflate, br, zstd", expected: "zstd" },
+		{ header: "GZIP", expected: "gzip" },
+		{ header: "zstd;q=0.5, gzip", expected: "gzip" },
+		{ header: "br;q=0, gzip;q=0.1", expected: "gzip" },
+		{ header: "*", expected: "zstd" },
+		{ header: "*;q=0.5, br;q=0.8", expected: "br" },
+		{ header: "gzip;q=0, *", expected: "zstd" },
+		{ header: "zstd;q=0, br;q=0, *;q=0", expected: "" },
+	}
+
+	for _, test := range tests {
+		t.Run(test.header, func(t *testing.T) {
+			assert.Equal(t, test.expected, chooseEncoding(test.header))
+		})
+	}
+}
+
+
+func decompress(t *testing.T, encoding string, body []byte) string {
+	var r io.Reader
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "zstd":
+		r, err = zstd.NewReader(bytes.NewReader(body))
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	default:
+		r = bytes.NewReader(body)
+	}
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	return string(data)
+}
+
+
+func Test_compressingWriter(t *testing.T) {
+	large := strings.Repeat(`{"name":"mike","email":"mike@example.com"},`, 100)
+
+	tests := []struct {
+		name string
+		acceptEncoding string
+		cfg compressionConfig
+		contentType string
+		status int
+		chunks []string
+		flushAfter int // flush after this many chunks, if non-zero
+		expectedEncoding string
+	}{
+		{
+			name: "no Accept-Encoding",
+			chunks: []string{large},
+		},
+		{
+			name: "small response",
+			acceptEncoding: "gzip",
+			chunks: []string{"[]"},
+		},
+		{
+			name: "large response, gzip",
+			acceptEncoding: "gzip",
+			chunks: []string{large},
+			expectedEncoding: "gzip",
+		},
+		{
+			name: "large response, zstd",
+			acceptEncoding: "gzip, zstd",
+			chunks: []string{large},
+			expectedEncoding: "zstd",
+		},
+		{
+			name: "large response, brotli",
+			acceptEncoding: "gzip, br",
+			chunks: []string{large},
+			expectedEncoding: "br",
+		},
+		{
+			name: "threshold reached over several writes",
+			acceptEncoding: "gzip",
+			cfg: compressionConfig{MinSize: 10},
+			chunks: []string{"[1,2,", "3,4,5,", "6,7,8]"},
+			expectedEncoding: "gzip",
+		},
+		{
+			name: "threshold from configuration",
+			acceptEncoding: "gzip",
+			cfg: compressionConfig{MinSize: 100000},
+			chunks: []string{large},
+		},
+		{
+			name: "streamed response flushed before threshold",
+			acceptEncoding: "zstd",
+			chunks: []string{"[1,", "2]"},
+			flushAfter: 1,
+			expectedEncoding: "zstd",
+		},
+		{
+			name: "error status",
+			acceptEncoding: "gzip",
+			status: 500,
+			chunks: []string{large},
+			expectedEncoding: "gzip",
+		},
+		{
+			name: "already compressed",
+			acceptEncoding: "gzip",
+			contentType: "application/vnd.apache.parquet",
+			chunks: []string{large},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ldp/db/tables", nil)
+			if test.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", test.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			var w http.ResponseWriter = rec
+			cw := newCompressingWriter(rec, req, test.cfg)
+			if cw != nil {
+				w = cw
+			}
+			if test.contentType != "" {
+				w.Header().Set("Content-Type", test.contentType)
+			}
+			if test.status != 0 {
+				w.WriteHeader(test.status)
+			}
+			for i, chunk := range test.chunks {
+				_, err := w.Write([]byte(chunk))
+				assert.Nil(t, err)
+				if i + 1 == test.flushAfter {
+					err = http.NewResponseController(w).Flush()
+					assert.Nil(t, err)
+					assert.True(t, rec.Flushed)
+				}
+			}
+			if cw != nil {
+				assert.Nil(t, cw.Close())
+			}
+
+			resp := rec.Result()
+			expectedStatus := test.status
+			if expectedStatus == 0 {
+				expectedStatus = 200
+			}
+			assert.Equal(t, expectedStatus, resp.StatusCode)
+			assert.Equal(t, test.expectedEncoding, resp.Header.Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", resp.Header.Get("Vary"))
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, strings.Join(test.chunks, ""), decompress(t, test.expectedEncoding, body))
+		})
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/ldp/db/tables", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		cw := newCompressingWriter(httptest.NewRecorder(), req, compressionConfig{Disabled: true})
+		assert.Nil(t, cw)
+	})
+}
@@ -0,0 +1,247 @@
+// Limits on the number of queries and reports running at once
+package main
+
+import "fmt"
+import "sync"
+import "time"
+import "context"
+import "net/http"
+import "container/list"
+
+
+const defaultMaxQueue = 100
+const defaultMaxWait = 60 // seconds
+
+
+// Zero limits mean that there is no limit
+type concurrencyConfig struct {
+	MaxPerTenant   int `json:"maxPerTenant"`
+	MaxPerDatabase int `json:"maxPerDatabase"`
+	MaxQueue       int `json:"maxQueue"`
+	MaxWait        int `json:"maxWait"` // seconds
+}
+
+
+// Lets up to limit requests run at once. Others wait in a queue, and
+// are let in strictly in the order they arrived: a request is never
+// let in while others are waiting, even if a place is free.
+type limiter struct {
+	description string // for messages
+	limit int
+	maxQueue int
+	maxWait time.Duration
+	mutex sync.Mutex
+	active int
+	waiting *list.List // of chan struct{}, closed when let in
+	averageRun time.Duration // of recent requests, to estimate waits
+}
+
+
+func newLimiter(description string, limit int, cfg concurrencyConfig) *limiter {
+	maxQueue := cfg.MaxQueue
+	if maxQueue == 0 {
+		maxQueue = defaultMaxQueue
+	}
+	maxWait := cfg.MaxWait
+	if maxWait == 0 {
+		maxWait = defaultMaxWait
+	}
+	return &limiter{
+		description: description,
+		limit: limit,
+		maxQueue: maxQueue,
+		maxWait: time.Duration(maxWait) * time.Second,
+		waiting: list.New(),
+	}
+}
+
+
+// Returns a function that must be called when the request has finished
+func (l *limiter) acquire(ctx context.Context) (func(), error) {
+	l.mutex.Lock()
+	if l.active < l.limit && l.waiting.Len() == 0 {
+		l.active++
+		l.mutex.Unlock()
+		return l.releaser(), nil
+	} else if l.waiting.Len() >= l.maxQueue {
+		err := l.tooMany(fmt.Sprintf("%d running and %d waiting", l.active, l.waiting.Len()), l.waiting.Len() + 1)
+		l.mutex.Unlock()
+		return nil, err
+	}
+	ready := make(chan struct{})
+	elem := l.waiting.PushBack(ready)
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(l.maxWait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-ready:
+		return l.releaser(), nil
+	case <-timer.C:
+		err = l.tooMany(fmt.Sprintf("waited %d seconds", int(l.maxWait.Seconds())), 1)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	select {
+	case <-ready:
+		// Let in just as we gave up, so pass the place on
+		l.passOn()
+	default:
+		l.waiting.Remove(elem)
+	}
+	return nil, err
+}
+
+
+// Called with the mutex held
+func (l *limiter) tooMany(detail string, position int) error {
+	// Estimate how long it will be before there is room in the queue
+	wait := l.averageRun
+	if wait < time.Second {
+		wait = time.Second
+	}
+	wait *= time.Duration((position + l.limit - 1) / l.limit)
+	retryAfter := int((wait + time.Second - 1) / time.Second)
+	return &httpError{
+		status: http.StatusTooManyRequests,
+		message: fmt.Sprintf("too many queries and reports for %s (%s): try again in %d seconds", l.description, detail, retryAfter),
+		retryAfter: retryAfter,
+	}
+}
+
+
+func (l *limiter) releaser() func() {
+	start := time.Now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mutex.Lock()
+			defer l.mutex.Unlock()
+			// An exponential moving average, weighting recent requests
+			run := time.Since(start)
+			if l.averageRun == 0 {
+				l.averageRun = run
+			} else {
+				l.averageRun = (l.averageRun * 7 + run) / 8
+			}
+			l.passOn()
+		})
+	}
+}
+
+
+// Gives a finished request's place to the first waiting one, if any.
+// Called with the mutex held.
+func (l *limiter) passOn() {
+	front := l.waiting.Front()
+	if front == nil {
+		l.active--
+		return
+	}
+	l.waiting.Remove(front)
+	close(front.Value.(chan struct{}))
+}
+
+
+// Limiters for each tenant and each reporting database, made as needed
+type concurrencyLimits struct {
+	cfg concurrencyConfig
+	mutex sync.Mutex
+	limiters map[string]*limiter
+}
+
+
+func newConcurrencyLimits(cfg concurrencyConfig) *concurrencyLimits {
+	return &concurrencyLimits{
+		cfg: cfg,
+		limiters: map[string]*limiter{},
+	}
+}
+
+
+// The longest a request may wait for each limit in turn
+func (cl *concurrencyLimits) maxWait() time.Duration {
+	maxWait := cl.cfg.MaxWait
+	if maxWait == 0 {
+		maxWait = defaultMaxWait
+	}
+	return 2 * time.Duration(maxWait) * time.Second
+}
+
+
+func (cl *concurrencyLimits) find(key string, description string, limit int) *limiter {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	l := cl.limiters[key]
+	if l == nil {
+		l = newLimiter(description, limit, cl.cfg)
+		cl.limiters[key] = l
+	}
+	return l
+}
+
+
+// A database may be shared by several tenants, so it is identified by
+// its URL rather than by name. The tenant's place is taken first, so
+// that a tenant that has reached its own limit does not hold places
+// in the database's queue that other tenants could use.
+func (cl *concurrencyLimits) acquire(ctx context.Context, tenant string, db *reportingDb) (func(), error) {
+	releases := []func(){}
+	releaseAll := func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+
+	if cl.cfg.MaxPerTenant != 0 {
+		release, err := cl.find("tenant:" + tenant, fmt.Sprintf("tenant '%s'", tenant), cl.cfg.MaxPerTenant).acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+
+	if cl.cfg.MaxPerDatabase != 0 {
+		name := db.name
+		if name == "" {
+			name = defaultDbName
+		}
+		release, err := cl.find("db:" + db.dbInfo.Url, fmt.Sprintf("reporting database '%s'", name), cl.cfg.MaxPerDatabase).acquire(ctx)
+		if err != nil {
+			releaseAll()
+			return nil, err
+		}
+		releases = append(releases, release)
+	}
+
+	return releaseAll, nil
+}
+
+
+// Waits, if necessary, until the query or report may be run. Time
+// spent waiting does not count against the server's WriteTimeout, so
+// that a request that waits long is not cut off before it can respond.
+func (session *ModReportingSession) waitToRun(ctx context.Context, w http.ResponseWriter, db *reportingDb) (func(), error) {
+	if session.server == nil {
+		// Some tests make sessions without a server
+		return func() {}, nil
+	}
+	limits := session.server.limits
+	if limits.cfg.MaxPerTenant == 0 && limits.cfg.MaxPerDatabase == 0 {
+		return func() {}, nil
+	}
+
+	// Not all ResponseWriters support this: if they don't, we just carry on
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Now().Add(limits.maxWait() + serverWriteTimeout))
+	release, err := limits.acquire(ctx, session.tenant, db)
+	if err != nil {
+		return nil, err
+	}
+	_ = rc.SetWriteDeadline(time.Now().Add(serverWriteTimeout))
+	return release, nil
+}
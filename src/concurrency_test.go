@@ -0,0 +1,171 @@
+package main
+
+import "time"
+import "errors"
+import "context"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+
+
+// Waits until n requests are queued
+func waitForQueue(t *testing.T, l *limiter, n int) {
+	for i := 0; i < 1000; i++ {
+		l.mutex.Lock()
+		queued := l.waiting.Len()
+		l.mutex.Unlock()
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("queue did not reach %d", n)
+}
+
+
+func Test_limiter(t *testing.T) {
+	t.Run("first in, first out", func(t *testing.T) {
+		l := newLimiter("test", 1, concurrencyConfig{})
+		release, err := l.acquire(context.Background())
+		assert.Nil(t, err)
+
+		order := make(chan int, 3)
+		for i := 0; i < 3; i++ {
+			go func(i int) {
+				release, err := l.acquire(context.Background())
+				assert.Nil(t, err)
+				order <- i
+				release()
+			}(i)
+			waitForQueue(t, l, i + 1)
+		}
+
+		release()
+		release() // Releasing twice has no effect
+		assert.Equal(t, 0, <-order)
+		assert.Equal(t, 1, <-order)
+		assert.Equal(t, 2, <-order)
+		waitForQueue(t, l, 0)
+		assert.Equal(t, 0, l.active)
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		l := newLimiter("reporting database 'default'", 1, concurrencyConfig{MaxQueue: 1})
+		release, err := l.acquire(context.Background())
+		assert.Nil(t, err)
+		defer release()
+		go l.acquire(context.Background())
+		waitForQueue(t, l, 1)
+
+		_, err = l.acquire(context.Background())
+		var he *httpError
+		assert.True(t, errors.As(err, &he))
+		assert.Equal(t, http.StatusTooManyRequests, he.status)
+		assert.Equal(t, 2, he.retryAfter)
+		assert.Equal(t, "too many queries and reports for reporting database 'default' (1 running and 1 waiting): try again in 2 seconds", err.Error())
+	})
+
+	t.Run("waited too long", func(t *testing.T) {
+		l := newLimiter("test", 1, concurrencyConfig{})
+		l.maxWait = 10 * time.Millisecond
+		release, err := l.acquire(context.Background())
+		assert.Nil(t, err)
+		_, err = l.acquire(context.Background())
+		assert.ErrorContains(t, err, "waited 0 seconds")
+		waitForQueue(t, l, 0)
+
+		// The place is still available once released
+		release()
+		release, err = l.acquire(context.Background())
+		assert.Nil(t, err)
+		release()
+		assert.Equal(t, 0, l.active)
+	})
+
+	t.Run("client gave up", func(t *testing.T) {
+		l := newLimiter("test", 1, concurrencyConfig{})
+		release, err := l.acquire(context.Background())
+		assert.Nil(t, err)
+		defer release()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err = l.acquire(ctx)
+		assert.ErrorIs(t, err, context.Canceled)
+		waitForQueue(t, l, 0)
+	})
+}
+
+
+func Test_concurrencyLimits(t *testing.T) {
+	db := &reportingDb{dbInfo: settingsValue{Url: "postgres://db.example.com/metadb"}}
+
+	t.Run("no limits", func(t *testing.T) {
+		cl := newConcurrencyLimits(concurrencyConfig{})
+		for i := 0; i < 3; i++ {
+			_, err := cl.acquire(context.Background(), "t1", db)
+			assert.Nil(t, err)
+		}
+		assert.Equal(t, 0, len(cl.limiters))
+	})
+
+	t.Run("database shared between tenants", func(t *testing.T) {
+		cl := newConcurrencyLimits(concurrencyConfig{MaxPerTenant: 2, MaxPerDatabase: 2, MaxWait: 1})
+		cl.find("db:" + db.dbInfo.Url, "reporting database 'default'", 2).maxWait = 10 * time.Millisecond
+
+		release1, err := cl.acquire(context.Background(), "t1", db)
+		assert.Nil(t, err)
+		release2, err := cl.acquire(context.Background(), "t2", db)
+		assert.Nil(t, err)
+
+		// The tenant has room, but the database does not, and the
+		// tenant's place is given back
+		_, err = cl.acquire(context.Background(), "t1", db)
+		assert.ErrorContains(t, err, "too many queries and reports for reporting database 'default'")
+		assert.Equal(t, 1, cl.limiters["tenant:t1"].active)
+
+		release1()
+		release2()
+		assert.Equal(t, 0, cl.limiters["tenant:t1"].active)
+		assert.Equal(t, 0, cl.limiters["db:" + db.dbInfo.Url].active)
+	})
+}
+
+
+// Records the write deadlines set through http.ResponseController
+type deadlineRecorder struct {
+	*httptest.ResponseRecorder
+	deadlines []time.Time
+}
+
+func (dr *deadlineRecorder) SetWriteDeadline(t time.Time) error {
+	dr.deadlines = append(dr.deadlines, t)
+	return nil
+}
+
+
+func Test_waitToRun(t *testing.T) {
+	server, err := MakeConfiguredServer("../etc/silent.json", ".")
+	assert.Nil(t, err)
+	server.limits = newConcurrencyLimits(concurrencyConfig{MaxPerTenant: 1, MaxWait: 45})
+	session := &ModReportingSession{server: server, tenant: "t1"}
+	db := &reportingDb{}
+
+	// The first request runs at once; the second waits for it
+	release1, err := session.waitToRun(context.Background(), httptest.NewRecorder(), db)
+	assert.Nil(t, err)
+	w := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	start := time.Now()
+	go func() {
+		waitForQueue(t, server.limits.limiters["tenant:t1"], 1)
+		release1()
+	}()
+	release2, err := session.waitToRun(context.Background(), w, db)
+	assert.Nil(t, err)
+	release2()
+
+	// While waiting, the deadline allows for the wait as well as the response
+	assert.Equal(t, 2, len(w.deadlines))
+	assert.True(t, w.deadlines[0].After(start.Add(90 * time.Second + serverWriteTimeout - time.Second)))
+	assert.True(t, w.deadlines[1].Before(start.Add(serverWriteTimeout + time.Second)))
+}
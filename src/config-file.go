@@ -16,9 +16,32 @@ type listenConfig struct {
 	Port int    `json:"port"`
 }
 
+type compressionConfig struct {
+	Disabled bool `json:"disabled"`
+	MinSize  int  `json:"minSize"`
+}
+
+type schemaCacheConfig struct {
+	Disabled      bool `json:"disabled"`
+	TTL           int  `json:"ttl"`
+	CheckInterval int  `json:"checkInterval"`
+}
+
+type sessionsConfig struct {
+	IdleTimeout         int `json:"idleTimeout"`
+	ReapInterval        int `json:"reapInterval"`
+	DbInfoCheckInterval int `json:"dbinfoCheckInterval"`
+	VisibilityCheckInterval int `json:"visibilityCheckInterval"`
+}
+
 type config struct {
 	Logging         loggingConfig                   `json:"logging"`
 	Listen          listenConfig                    `json:"listen"`
+	Compression     compressionConfig               `json:"compression"`
+	SchemaCache     schemaCacheConfig               `json:"schemaCache"`
+	Sessions        sessionsConfig                  `json:"sessions"`
+	Database        databaseConfig                  `json:"database"`
+	Concurrency     concurrencyConfig               `json:"concurrency"`
 }
 
 
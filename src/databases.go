@@ -0,0 +1,137 @@
+// Multiple named reporting databases for each tenant
+package main
+
+import "fmt"
+import "time"
+import "errors"
+import "encoding/json"
+import "github.com/indexdata/foliogo"
+
+
+// Requests name the database to use with the "db" parameter. Both
+// the empty string and this name mean the default database.
+const defaultDbName = "default"
+
+
+// One entry in the "databases" setting
+type namedSettingsValue struct {
+	Name string `json:"name"`
+	settingsValue
+}
+
+type namedSettingsItem struct {
+	Value json.RawMessage `json:"value"`
+}
+
+type namedSettingsResponse struct {
+	Items []namedSettingsItem `json:"items"`
+	ResultInfo settingsResultInfo `json:"resultInfo"`
+}
+
+
+// A connection to one of the tenant's reporting databases. This is
+// not changed once made, except for dbInfoChecked: when the database
+// settings change, it is replaced by a new one, so that requests
+// already using it see a consistent connection, flavour and cache.
+type reportingDb struct {
+	name string // "" for the default
+	role string // if connections act as a role mapped from the FOLIO user
+	dbConn PgxIface
+	isMDB bool
+	dbInfo settingsValue // what dbConn was made from
+	config databaseConfig // dbinfo's settings merged with the defaults
+	dbInfoChecked time.Time // guarded by the session's dbMutex
+	schemaCache *schemaCache
+}
+
+
+func newReportingDb(session *ModReportingSession, name string, dbConn PgxIface, isMDB bool) *reportingDb {
+	db := reportingDb{
+		name: name,
+		dbConn: dbConn,
+		isMDB: isMDB,
+	}
+	if session.server != nil {
+		// Some tests make sessions without a server
+		db.schemaCache = newSchemaCache(session.server.config.SchemaCache)
+	}
+	return &db
+}
+
+
+// Databases for roles, which share the login user's pool but each have
+// their own schema cache, are kept alongside that for the login user
+func roleDbKey(name string, role string) string {
+	return name + "\x00" + role
+}
+
+
+func normalizeDbName(name string) string {
+	if name == defaultDbName {
+		return ""
+	}
+	return name
+}
+
+
+// The default database is the one described by the "dbinfo" setting
+// or, if there is none, the first in the "databases" setting. Other
+// databases are looked up by name in "databases".
+func getNamedDbInfo(session foliogo.Session, token string, name string) (settingsValue, error) {
+	if name == "" {
+		dbinfo, err := getDbInfo(session, token)
+		if !errors.Is(err, errNoDbInfo) {
+			return dbinfo, err
+		}
+	}
+
+	databases, err := getDatabases(session, token)
+	if err != nil {
+		return settingsValue{}, err
+	}
+
+	if name == "" {
+		if len(databases) == 0 {
+			return settingsValue{}, errNoDbInfo
+		}
+		return databases[0].settingsValue, nil
+	}
+	for _, db := range databases {
+		if db.Name == name {
+			return db.settingsValue, nil
+		}
+	}
+	return settingsValue{}, fmt.Errorf("no reporting database named '%s'", name)
+}
+
+
+func getDatabases(session foliogo.Session, token string) ([]namedSettingsValue, error) {
+	params := foliogo.RequestParams{ Token: token }
+	bytes, err := session.Fetch(`settings/entries?query=scope=="ui-ldp.admin"+and+key=="databases"`, params)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch 'databases' from config: %w", err)
+	}
+
+	var r namedSettingsResponse
+	err = json.Unmarshal(bytes, &r)
+	if err != nil {
+		return nil, fmt.Errorf("decode 'databases' JSON failed: %w", err)
+	}
+
+	if r.ResultInfo.TotalRecords < 1 {
+		return []namedSettingsValue{}, nil
+	}
+
+	value := r.Items[0].Value
+	var s string
+	if json.Unmarshal(value, &s) == nil {
+		// Encoded as a string, as when written through /ldp/config: see issue #60
+		value = []byte(s)
+	}
+	var databases []namedSettingsValue
+	err = json.Unmarshal(value, &databases)
+	if err != nil {
+		return nil, fmt.Errorf("decode 'databases' value failed: %w", err)
+	}
+	return databases, nil
+}
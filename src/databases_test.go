@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+import "github.com/stretchr/testify/assert"
+
+
+func Test_getNamedDbInfo(t *testing.T) {
+	ts := MakeDummyModSettingsServer()
+	defer ts.Close()
+	session, err := NewModReportingSession(nil, ts.URL, "dummyTenant")
+	assert.Nil(t, err)
+
+	t.Run("default database", func(t *testing.T) {
+		dbinfo, err := getNamedDbInfo(session.folioSession, "", "")
+		assert.Nil(t, err)
+		assert.Equal(t, "dummyUrl", dbinfo.Url)
+	})
+
+	t.Run("named database", func(t *testing.T) {
+		dbinfo, err := getNamedDbInfo(session.folioSession, "", "archive")
+		assert.Nil(t, err)
+		assert.Equal(t, "archiveUrl", dbinfo.Url)
+		assert.Equal(t, "alice", dbinfo.User)
+		assert.Equal(t, "pw2", dbinfo.Pass)
+		assert.Equal(t, int32(2), dbinfo.MaxConns)
+	})
+
+	t.Run("no such database", func(t *testing.T) {
+		_, err := getNamedDbInfo(session.folioSession, "", "other")
+		assert.ErrorContains(t, err, "no reporting database named 'other'")
+	})
+
+	t.Run("names", func(t *testing.T) {
+		assert.Equal(t, "", normalizeDbName(""))
+		assert.Equal(t, "", normalizeDbName("default"))
+		assert.Equal(t, "archive", normalizeDbName("archive"))
+	})
+}
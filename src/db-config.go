@@ -0,0 +1,219 @@
+// Connection-pool and TLS settings for the reporting database
+package main
+
+import "fmt"
+import "time"
+import "strings"
+import "net/url"
+import "path/filepath"
+import "github.com/jackc/pgx/v5/pgxpool"
+
+
+const defaultApplicationName = "mod-reporting"
+
+
+// Used both for the "database" stanza of the configuration file, which
+// provides defaults, and in the tenant's dbinfo setting, whose values
+// override them. Zero values mean "not specified".
+type databaseConfig struct {
+	MaxConns            int32  `json:"maxConns,omitempty"`
+	MinConns            int32  `json:"minConns,omitempty"`
+	MaxConnLifetime     int    `json:"maxConnLifetime,omitempty"` // seconds
+	MaxConnIdleTime     int    `json:"maxConnIdleTime,omitempty"` // seconds
+	ConnectTimeout      int    `json:"connectTimeout,omitempty"`  // seconds
+	ApplicationName     string `json:"applicationName,omitempty"`
+	SslMode             string `json:"sslMode,omitempty"`
+	SslRootCert         string `json:"sslRootCert,omitempty"` // filenames
+	SslCert             string `json:"sslCert,omitempty"`
+	SslKey              string `json:"sslKey,omitempty"`
+	SslCertDir          string `json:"sslCertDir,omitempty"` // only in the configuration file
+	RequireReadOnlyRole bool   `json:"requireReadOnlyRole,omitempty"`
+	UserRoleTemplate    string `json:"userRoleTemplate,omitempty"`
+	HealthCheckInterval int    `json:"healthCheckInterval,omitempty"` // seconds
+	MaxRetries          int    `json:"maxRetries,omitempty"`
+	RetryDelay          int    `json:"retryDelay,omitempty"` // milliseconds
+	FailureThreshold    int    `json:"failureThreshold,omitempty"`
+}
+
+
+// Settings specified in overrides replace those in defaults, except for
+// sslCertDir, which restricts the tenant's own settings and so cannot be
+// changed by them
+func mergeDatabaseConfig(defaults databaseConfig, overrides databaseConfig) databaseConfig {
+	res := defaults
+	if overrides.MaxConns != 0 {
+		res.MaxConns = overrides.MaxConns
+	}
+	if overrides.MinConns != 0 {
+		res.MinConns = overrides.MinConns
+	}
+	if overrides.MaxConnLifetime != 0 {
+		res.MaxConnLifetime = overrides.MaxConnLifetime
+	}
+	if overrides.MaxConnIdleTime != 0 {
+		res.MaxConnIdleTime = overrides.MaxConnIdleTime
+	}
+	if overrides.ConnectTimeout != 0 {
+		res.ConnectTimeout = overrides.ConnectTimeout
+	}
+	if overrides.ApplicationName != "" {
+		res.ApplicationName = overrides.ApplicationName
+	}
+	if overrides.SslMode != "" {
+		res.SslMode = overrides.SslMode
+	}
+	if overrides.SslRootCert != "" {
+		res.SslRootCert = overrides.SslRootCert
+	}
+	if overrides.SslCert != "" {
+		res.SslCert = overrides.SslCert
+	}
+	if overrides.SslKey != "" {
+		res.SslKey = overrides.SslKey
+	}
+	if overrides.UserRoleTemplate != "" {
+		res.UserRoleTemplate = overrides.UserRoleTemplate
+	}
+	if overrides.HealthCheckInterval != 0 {
+		res.HealthCheckInterval = overrides.HealthCheckInterval
+	}
+	if overrides.MaxRetries != 0 {
+		res.MaxRetries = overrides.MaxRetries
+	}
+	if overrides.RetryDelay != 0 {
+		res.RetryDelay = overrides.RetryDelay
+	}
+	if overrides.FailureThreshold != 0 {
+		res.FailureThreshold = overrides.FailureThreshold
+	}
+	if overrides.RequireReadOnlyRole {
+		// A tenant may strengthen, but not weaken, this requirement
+		res.RequireReadOnlyRole = true
+	}
+	return res
+}
+
+
+// Builds a connection URL from the dbinfo URL, which for historical
+// reasons is often JDBCish, with the credentials properly escaped and
+// the TLS and connection settings added as parameters. Parameters
+// already in the dbinfo URL are kept unless overridden.
+func makeDbUrl(dbinfo settingsValue, cfg databaseConfig) (*url.URL, error) {
+	dbUrl := dbinfo.Url
+	for _, prefix := range []string{"jdbc:postgresql://", "postgresql://", "postgres://"} {
+		dbUrl = strings.TrimPrefix(dbUrl, prefix)
+	}
+
+	u, err := url.Parse("postgres://" + dbUrl)
+	if err != nil {
+		return nil, fmt.Errorf("bad database URL '%s': %w", dbinfo.Url, err)
+	}
+	if dbinfo.User != "" || dbinfo.Pass != "" {
+		u.User = url.UserPassword(dbinfo.User, dbinfo.Pass)
+	}
+
+	q := u.Query()
+	// Files named in the URL are as much the tenant's choice as those
+	// in the rest of its settings
+	for _, name := range []string{"sslrootcert", "sslcert", "sslkey"} {
+		if value := q.Get(name); value != "" {
+			path, err := tenantCertFile(cfg.SslCertDir, name, value)
+			if err != nil {
+				return nil, err
+			}
+			q.Set(name, path)
+		}
+	}
+	setParam := func(name string, value string) {
+		if value != "" {
+			q.Set(name, value)
+		}
+	}
+	setParam("sslmode", cfg.SslMode)
+	setParam("sslrootcert", cfg.SslRootCert)
+	setParam("sslcert", cfg.SslCert)
+	setParam("sslkey", cfg.SslKey)
+	setParam("application_name", cfg.ApplicationName)
+	if cfg.ConnectTimeout != 0 {
+		q.Set("connect_timeout", fmt.Sprint(cfg.ConnectTimeout))
+	}
+	u.RawQuery = q.Encode()
+	return u, nil
+}
+
+
+// Since a tenant's settings can be changed by its administrators, any
+// certificate and key files they name must be in the sslCertDir given
+// in the configuration file: otherwise they could have mod-reporting
+// read any file it has access to. Relative names are taken to be in
+// that directory.
+func tenantCertFile(dir string, setting string, name string) (string, error) {
+	if dir == "" {
+		return "", fmt.Errorf("%s cannot be set for a tenant unless sslCertDir is configured", setting)
+	}
+
+	dir = filepath.Clean(dir)
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path = filepath.Clean(path)
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".." + string(filepath.Separator)) {
+		return "", fmt.Errorf("%s '%s' is not in sslCertDir", setting, name)
+	}
+	return path, nil
+}
+
+
+func makePoolConfig(dbinfo settingsValue, defaults databaseConfig) (*pgxpool.Config, error) {
+	cfg := mergeDatabaseConfig(defaults, dbinfo.databaseConfig)
+	// Files named in the configuration file itself are trusted
+	for _, file := range []struct{ setting string; value *string; override string }{
+		{ "sslRootCert", &cfg.SslRootCert, dbinfo.SslRootCert },
+		{ "sslCert", &cfg.SslCert, dbinfo.SslCert },
+		{ "sslKey", &cfg.SslKey, dbinfo.SslKey },
+	} {
+		if file.override != "" {
+			path, err := tenantCertFile(cfg.SslCertDir, file.setting, file.override)
+			if err != nil {
+				return nil, err
+			}
+			*file.value = path
+		}
+	}
+	if cfg.ApplicationName == "" {
+		cfg.ApplicationName = defaultApplicationName
+	}
+	if cfg.MaxConns < 0 || cfg.MinConns < 0 || cfg.MaxConnLifetime < 0 || cfg.MaxConnIdleTime < 0 || cfg.ConnectTimeout < 0 ||
+		cfg.HealthCheckInterval < 0 || cfg.MaxRetries < 0 || cfg.RetryDelay < 0 || cfg.FailureThreshold < 0 {
+		return nil, fmt.Errorf("database pool settings must not be negative")
+	} else if cfg.MaxConns != 0 && cfg.MinConns > cfg.MaxConns {
+		return nil, fmt.Errorf("minConns (%d) is greater than maxConns (%d)", cfg.MinConns, cfg.MaxConns)
+	}
+
+	u, err := makeDbUrl(dbinfo, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(u.String())
+	if err != nil {
+		// pgconn redacts the password in its error messages
+		return nil, fmt.Errorf("bad database configuration: %w", err)
+	}
+
+	if cfg.MaxConns != 0 {
+		poolConfig.MaxConns = cfg.MaxConns
+	}
+	if cfg.MinConns != 0 {
+		poolConfig.MinConns = cfg.MinConns
+	}
+	if cfg.MaxConnLifetime != 0 {
+		poolConfig.MaxConnLifetime = time.Duration(cfg.MaxConnLifetime) * time.Second
+	}
+	if cfg.MaxConnIdleTime != 0 {
+		poolConfig.MaxConnIdleTime = time.Duration(cfg.MaxConnIdleTime) * time.Second
+	}
+	return poolConfig, nil
+}
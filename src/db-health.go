@@ -0,0 +1,362 @@
+// Health probes, retries and circuit breakers for reporting databases
+package main
+
+import "io"
+import "fmt"
+import "net"
+import "sync"
+import "time"
+import "strings"
+import "errors"
+import "context"
+import "net/http"
+import "github.com/jackc/pgx/v5"
+import "github.com/jackc/pgx/v5/pgconn"
+import "github.com/jackc/pgx/v5/pgxpool"
+
+
+const defaultHealthCheckInterval = 10 // seconds
+const defaultMaxRetries = 2
+const defaultRetryDelay = 100 // milliseconds, doubled for each retry
+const defaultFailureThreshold = 5
+
+
+// Connection-level failures, which may succeed if tried again once the
+// database is back. Errors in the SQL itself are not transient.
+func isTransientDbError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// The request gave up, which says nothing about the database
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		// Connection exceptions, and the server shutting down or starting up
+		return strings.HasPrefix(pgErr.Code, "08") || pgErr.Code == "57P01" || pgErr.Code == "57P02" || pgErr.Code == "57P03"
+	}
+
+	// Failures to connect wrap either a PgError or a network error
+	var netErr net.Error
+	return pgconn.SafeToRetry(err) ||
+		errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+
+// Opens after failureThreshold consecutive transient failures, after
+// which requests fail at once rather than waiting on a dead server.
+// Once the cooldown has passed, a single request is let through to try
+// the database: if it succeeds, or if a health probe does, the breaker
+// closes again.
+type circuitBreaker struct {
+	name string // of the database, for messages
+	threshold int
+	cooldown time.Duration
+	logger func(string)
+	mutex sync.Mutex
+	failures int
+	lastError error
+	openedAt time.Time // zero when closed
+}
+
+
+func newCircuitBreaker(name string, cfg databaseConfig, logger func(string)) *circuitBreaker {
+	if name == "" {
+		name = defaultDbName
+	}
+	threshold := cfg.FailureThreshold
+	if threshold == 0 {
+		threshold = defaultFailureThreshold
+	}
+	interval := cfg.HealthCheckInterval
+	if interval == 0 {
+		interval = defaultHealthCheckInterval
+	}
+	return &circuitBreaker{
+		name: name,
+		threshold: threshold,
+		cooldown: time.Duration(interval) * time.Second,
+		logger: logger,
+	}
+}
+
+
+func (cb *circuitBreaker) log(message string) {
+	if cb.logger != nil {
+		cb.logger(message)
+	}
+}
+
+
+func (cb *circuitBreaker) allow() error {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.openedAt.IsZero() {
+		return nil
+	}
+
+	wait := cb.cooldown - time.Since(cb.openedAt)
+	if wait <= 0 {
+		// Half-open: this request tries the database, and others
+		// continue to fail until it has done so
+		cb.openedAt = time.Now()
+		return nil
+	}
+
+	// The error itself could reveal the database's host, port and user
+	retryAfter := int((wait + time.Second - 1) / time.Second)
+	return &httpError{
+		status: http.StatusServiceUnavailable,
+		message: fmt.Sprintf("reporting database '%s' is unavailable (%s): try again in %d seconds", cb.name, describeError(cb.lastError), retryAfter),
+		retryAfter: retryAfter,
+	}
+}
+
+
+func (cb *circuitBreaker) recordSuccess() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if !cb.openedAt.IsZero() {
+		cb.log(fmt.Sprintf("reporting database '%s' has recovered: circuit breaker closed", cb.name))
+	}
+	cb.failures = 0
+	cb.lastError = nil
+	cb.openedAt = time.Time{}
+}
+
+
+func (cb *circuitBreaker) recordFailure(err error) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	cb.failures++
+	cb.lastError = err
+	if !cb.openedAt.IsZero() {
+		// The trial request failed, so wait for another cooldown
+		cb.openedAt = time.Now()
+	} else if cb.failures >= cb.threshold {
+		cb.log(fmt.Sprintf("reporting database '%s' failed %d times: circuit breaker opened: %s", cb.name, cb.failures, err))
+		cb.openedAt = time.Now()
+	}
+}
+
+
+func (cb *circuitBreaker) isOpen() bool {
+	open, _ := cb.status()
+	return open
+}
+
+
+// Whether the breaker is open, and the most recent failure if the
+// database has not succeeded since
+func (cb *circuitBreaker) status() (bool, error) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	return !cb.openedAt.IsZero(), cb.lastError
+}
+
+
+// Wraps a connection pool so that each operation is checked against the
+// database's circuit breaker, and retried with backoff if it fails for
+// a transient reason. Only the operations that begin a request are
+// retried: by the time one of these succeeds, the connection has been
+// made, and any later failure is reported as usual. Since everything
+// mod-reporting runs is read-only, retrying is always safe.
+//
+// A background probe pings the database every healthCheckInterval
+// seconds, so that a failed database is noticed, and its recovery
+// closes the breaker, even when there are no requests.
+type resilientPool struct {
+	pool PgxIface
+	breaker *circuitBreaker
+	maxRetries int
+	retryDelay time.Duration
+	interval time.Duration
+	stop chan struct{}
+	stopOnce sync.Once
+}
+
+
+func newResilientPool(pool PgxIface, cfg databaseConfig, breaker *circuitBreaker) *resilientPool {
+	maxRetries := cfg.MaxRetries
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
+	}
+	retryDelay := cfg.RetryDelay
+	if retryDelay == 0 {
+		retryDelay = defaultRetryDelay
+	}
+	interval := cfg.HealthCheckInterval
+	if interval == 0 {
+		interval = defaultHealthCheckInterval
+	}
+
+	rp := resilientPool{
+		pool: pool,
+		breaker: breaker,
+		maxRetries: maxRetries,
+		retryDelay: time.Duration(retryDelay) * time.Millisecond,
+		interval: time.Duration(interval) * time.Second,
+		stop: make(chan struct{}),
+	}
+	go rp.probe()
+	return &rp
+}
+
+
+func (rp *resilientPool) probe() {
+	ticker := time.NewTicker(rp.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rp.stop:
+			return
+		case <-ticker.C:
+			rp.checkHealth()
+		}
+	}
+}
+
+
+func (rp *resilientPool) checkHealth() {
+	ctx, cancel := context.WithTimeout(context.Background(), rp.interval)
+	defer cancel()
+	// Pinging also discards a broken connection from the pool
+	err := rp.pool.Ping(ctx)
+	if err != nil {
+		rp.breaker.recordFailure(err)
+	} else {
+		rp.breaker.recordSuccess()
+	}
+}
+
+
+// Runs f, retrying transient failures, and records the outcome
+func (rp *resilientPool) run(ctx context.Context, f func() error) error {
+	err := rp.breaker.allow()
+	if err != nil {
+		return err
+	}
+
+	delay := rp.retryDelay
+	for attempt := 0; ; attempt++ {
+		err = f()
+		if !isTransientDbError(err) {
+			// Even an error in the SQL shows that the database is up
+			rp.breaker.recordSuccess()
+			return err
+		} else if attempt == rp.maxRetries {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+
+	rp.breaker.recordFailure(err)
+	return err
+}
+
+
+func (rp *resilientPool) Begin(ctx context.Context) (pgx.Tx, error) {
+	var tx pgx.Tx
+	err := rp.run(ctx, func() error {
+		var err error
+		tx, err = rp.pool.Begin(ctx)
+		return err
+	})
+	return tx, err
+}
+
+
+func (rp *resilientPool) BeginTx(ctx context.Context, options pgx.TxOptions) (pgx.Tx, error) {
+	var tx pgx.Tx
+	err := rp.run(ctx, func() error {
+		var err error
+		tx, err = rp.pool.BeginTx(ctx, options)
+		return err
+	})
+	return tx, err
+}
+
+
+func (rp *resilientPool) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	var rows pgx.Rows
+	err := rp.run(ctx, func() error {
+		var err error
+		rows, err = rp.pool.Query(ctx, sql, args...)
+		return err
+	})
+	return rows, err
+}
+
+
+// The query is not run until the row is scanned, so that is when it is
+// retried
+func (rp *resilientPool) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return &resilientRow{rp: rp, ctx: ctx, sql: sql, args: args}
+}
+
+
+func (rp *resilientPool) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	var tag pgconn.CommandTag
+	err := rp.run(ctx, func() error {
+		var err error
+		tag, err = rp.pool.Exec(ctx, sql, args...)
+		return err
+	})
+	return tag, err
+}
+
+
+func (rp *resilientPool) Ping(ctx context.Context) error {
+	return rp.run(ctx, func() error {
+		return rp.pool.Ping(ctx)
+	})
+}
+
+
+// Returns nil if the pool is not a real one, as in tests
+func (rp *resilientPool) poolStatus() *poolStatus {
+	pool, ok := rp.pool.(*pgxpool.Pool)
+	if !ok {
+		return nil
+	}
+	stat := pool.Stat()
+	return &poolStatus{
+		TotalConns: stat.TotalConns(),
+		IdleConns: stat.IdleConns(),
+		AcquiredConns: stat.AcquiredConns(),
+		MaxConns: stat.MaxConns(),
+		AcquireCount: stat.AcquireCount(),
+		EmptyAcquireCount: stat.EmptyAcquireCount(),
+		CanceledAcquireCount: stat.CanceledAcquireCount(),
+	}
+}
+
+
+func (rp *resilientPool) Close() {
+	rp.stopOnce.Do(func() {
+		close(rp.stop)
+	})
+	rp.pool.Close()
+}
+
+
+type resilientRow struct {
+	rp *resilientPool
+	ctx context.Context
+	sql string
+	args []any
+}
+
+
+func (row *resilientRow) Scan(dest ...any) error {
+	return row.rp.run(row.ctx, func() error {
+		return row.rp.pool.QueryRow(row.ctx, row.sql, row.args...).Scan(dest...)
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import "io"
+import "net"
+import "fmt"
+import "time"
+import "errors"
+import "context"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/jackc/pgx/v5/pgconn"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func Test_isTransientDbError(t *testing.T) {
+	tests := []struct {
+		name string
+		err error
+		expected bool
+	}{
+		{ name: "no error", err: nil, expected: false },
+		{ name: "EOF", err: fmt.Errorf("could not read: %w", io.ErrUnexpectedEOF), expected: true },
+		{ name: "connection refused", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, expected: true },
+		{ name: "connection exception", err: &pgconn.PgError{Code: "08006"}, expected: true },
+		{ name: "shutting down", err: &pgconn.PgError{Code: "57P01"}, expected: true },
+		{ name: "starting up", err: &pgconn.PgError{Code: "57P03"}, expected: true },
+		{ name: "syntax error", err: &pgconn.PgError{Code: "42601"}, expected: false },
+		{ name: "bad password", err: &pgconn.PgError{Code: "28P01"}, expected: false },
+		{ name: "request cancelled", err: context.Canceled, expected: false },
+		{ name: "request timed out", err: context.DeadlineExceeded, expected: false },
+		{ name: "other", err: errors.New("something else"), expected: false },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, isTransientDbError(test.err))
+		})
+	}
+}
+
+
+func Test_circuitBreaker(t *testing.T) {
+	messages := []string{}
+	cb := newCircuitBreaker("", databaseConfig{FailureThreshold: 2}, func(message string) {
+		messages = append(messages, message)
+	})
+	assert.Equal(t, 10 * time.Second, cb.cooldown)
+
+	failure := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("dial tcp 10.0.0.1:5432: connection refused")}
+	cb.recordFailure(failure)
+	assert.Nil(t, cb.allow())
+	cb.recordFailure(failure)
+	assert.True(t, cb.isOpen())
+
+	err := cb.allow()
+	var he *httpError
+	assert.True(t, errors.As(err, &he))
+	assert.Equal(t, http.StatusServiceUnavailable, he.status)
+	assert.Equal(t, 10, he.retryAfter)
+	assert.Equal(t, "reporting database 'default' is unavailable (could not connect): try again in 10 seconds", err.Error())
+
+	// After the cooldown, only one request is let through
+	cb.openedAt = time.Now().Add(-cb.cooldown)
+	assert.Nil(t, cb.allow())
+	assert.NotNil(t, cb.allow())
+
+	cb.recordSuccess()
+	assert.False(t, cb.isOpen())
+	assert.Nil(t, cb.allow())
+	assert.Equal(t, 2, len(messages))
+	assert.Contains(t, messages[0], "circuit breaker opened")
+	assert.Contains(t, messages[1], "circuit breaker closed")
+}
+
+
+func Test_resilientPool(t *testing.T) {
+	cfg := databaseConfig{MaxRetries: 2, RetryDelay: 1, FailureThreshold: 2}
+	transient := &pgconn.PgError{Code: "57P03", Message: "the database system is starting up"}
+
+	t.Run("transient errors are retried", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		rp := newResilientPool(mock, cfg, newCircuitBreaker("", cfg, nil))
+		defer rp.Close()
+
+		mock.ExpectQuery("SELECT 1").WillReturnError(transient)
+		mock.ExpectQuery("SELECT 1").WillReturnError(transient)
+		mock.ExpectQuery("SELECT 1").WillReturnRows(pgxmock.NewRows([]string{"n"}).AddRow(1))
+		var n int
+		err = rp.QueryRow(context.Background(), "SELECT 1").Scan(&n)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, n)
+		assert.False(t, rp.breaker.isOpen())
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		rp := newResilientPool(mock, cfg, newCircuitBreaker("", cfg, nil))
+		defer rp.Close()
+
+		mock.ExpectExec("DROP TABLE users").WillReturnError(&pgconn.PgError{Code: "25006"})
+		_, err = rp.Exec(context.Background(), "DROP TABLE users")
+		assert.ErrorContains(t, err, "25006")
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("breaker opens and fails fast", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		rp := newResilientPool(mock, cfg, newCircuitBreaker("archive", cfg, nil))
+		defer rp.Close()
+
+		for i := 0; i < 6; i++ {
+			mock.ExpectBegin().WillReturnError(transient)
+		}
+		for i := 0; i < 2; i++ {
+			_, err = rp.Begin(context.Background())
+			assert.ErrorContains(t, err, "starting up")
+		}
+		assert.True(t, rp.breaker.isOpen())
+		assert.Nil(t, mock.ExpectationsWereMet())
+
+		// The database is not tried while the breaker is open
+		_, err = rp.Query(context.Background(), "SELECT 1")
+		assert.ErrorContains(t, err, "reporting database 'archive' is unavailable")
+
+		// A successful health check closes it
+		mock.ExpectPing()
+		rp.checkHealth()
+		assert.False(t, rp.breaker.isOpen())
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+}
+
+
+func Test_unavailableStatus(t *testing.T) {
+	server, err := MakeConfiguredServer("../etc/silent.json", ".")
+	assert.Nil(t, err)
+	session, err := NewModReportingSession(server, "http://localhost:9130", "t1")
+	assert.Nil(t, err)
+	server.sessions.add("t1:http://localhost:9130", session)
+
+	cb := newCircuitBreaker("", databaseConfig{FailureThreshold: 1}, nil)
+	cb.recordFailure(errors.New("connection refused"))
+
+	req := httptest.NewRequest("GET", "/ldp/db/tables", nil)
+	req.Header.Set("X-Okapi-Url", "http://localhost:9130")
+	req.Header.Set("X-Okapi-Tenant", "t1")
+	w := httptest.NewRecorder()
+	runWithErrorHandling(w, req, server, func(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+		return fmt.Errorf("could not fetch tables: %w", cb.allow())
+	})
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "10", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "reporting database 'default' is unavailable")
+}
@@ -8,10 +8,14 @@ import "encoding/json"
 import "github.com/indexdata/foliogo"
 
 
+var errNoDbInfo = errors.New("no 'dbinfo' setting in FOLIO database")
+
+
 type settingsValue struct {
 	Url string `json:"url"`
 	Pass string `json:"pass"`
 	User string `json:"user"`
+	databaseConfig // optional overrides of the configuration file's settings
 }
 
 type settingsItem struct {
@@ -39,45 +43,44 @@ type oldSettingsResponse struct {
 }
 
 
-func getDbInfo(session foliogo.Session, token string) (string, string, string, error) {
+func getDbInfo(session foliogo.Session, token string) (settingsValue, error) {
 	// If defined, environment variables override the setting from the database
 	dburl := os.Getenv("REPORTING_DB_URL")
 	dbuser := os.Getenv("REPORTING_DB_USER")
 	dbpass := os.Getenv("REPORTING_DB_PASS")
 	if dburl != "" && dbuser != "" && dbpass != "" {
-		return dburl, dbuser, dbpass, nil
+		return settingsValue{Url: dburl, User: dbuser, Pass: dbpass}, nil
 	}
 
 	params := foliogo.RequestParams{ Token: token }
 	bytes, err := session.Fetch(`settings/entries?query=scope=="ui-ldp.admin"+and+key=="dbinfo"`, params)
 	if err != nil {
-		return "", "", "", fmt.Errorf("cannot fetch 'dbinfo' from config: : %w", err)
+		return settingsValue{}, fmt.Errorf("cannot fetch 'dbinfo' from config: : %w", err)
 	}
 
 	var r settingsResponse
 	err = json.Unmarshal(bytes, &r)
 	if err != nil {
 		if !strings.Contains(err.Error(), "Go struct field settingsItem.items.value") {
-			return "", "", "", fmt.Errorf("decode 'dbinfo' JSON failed: %w", err)
+			return settingsValue{}, fmt.Errorf("decode 'dbinfo' JSON failed: %w", err)
 		}
 
 		var oldR oldSettingsResponse
 		err = json.Unmarshal(bytes, &oldR)
 		if err != nil {
-			return "", "", "", fmt.Errorf("decode 'dbinfo' old-style JSON failed: %w", err)
+			return settingsValue{}, fmt.Errorf("decode 'dbinfo' old-style JSON failed: %w", err)
 		}
 
 		err = convertResultInfo(oldR, &r)
 		if err != nil {
-			return "", "", "", err
+			return settingsValue{}, err
 		}
 	}
 
 	if r.ResultInfo.TotalRecords < 1 {
-		return "", "", "", errors.New("no 'dbinfo' setting in FOLIO database")
+		return settingsValue{}, errNoDbInfo
 	}
-	value := r.Items[0].Value
-	return value.Url, value.User, value.Pass, nil
+	return r.Items[0].Value, nil
 }
 
 
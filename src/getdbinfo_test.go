@@ -18,21 +18,21 @@ func Test_getDbInfo(t *testing.T) {
 		os.Setenv("REPORTING_DB_URL", url)
 		os.Setenv("REPORTING_DB_USER", "mike")
 		os.Setenv("REPORTING_DB_PASS", "swordfish")
-		dburl, dbuser, dbpass, err := getDbInfo(session.folioSession, "")
+		dbinfo, err := getDbInfo(session.folioSession, "")
 		assert.Nil(t, err)
-		assert.Equal(t, url, dburl)
-		assert.Equal(t, "mike", dbuser)
-		assert.Equal(t, "swordfish", dbpass)
+		assert.Equal(t, url, dbinfo.Url)
+		assert.Equal(t, "mike", dbinfo.User)
+		assert.Equal(t, "swordfish", dbinfo.Pass)
 	})
 
 	t.Run("info from FOLIO", func(t *testing.T) {
 		os.Setenv("REPORTING_DB_URL", "")
 		os.Setenv("REPORTING_DB_USER", "")
 		os.Setenv("REPORTING_DB_PASS", "")
-		dburl, dbuser, dbpass, err := getDbInfo(session.folioSession, "")
+		dbinfo, err := getDbInfo(session.folioSession, "")
 		assert.Nil(t, err)
-		assert.Equal(t, "dummyUrl", dburl)
-		assert.Equal(t, "fiona", dbuser)
-		assert.Equal(t, "pw", dbpass)
+		assert.Equal(t, "dummyUrl", dbinfo.Url)
+		assert.Equal(t, "fiona", dbinfo.User)
+		assert.Equal(t, "pw", dbinfo.Pass)
 	})
 }
@@ -0,0 +1,248 @@
+// Liveness, readiness and status of the module and its databases
+package main
+
+import "io"
+import "fmt"
+import "net"
+import "sort"
+import "sync"
+import "time"
+import "errors"
+import "context"
+import "net/http"
+import "github.com/jackc/pgx/v5/pgconn"
+
+
+const healthPingTimeout = 5 * time.Second
+
+
+type poolStatus struct {
+	TotalConns int32 `json:"totalConns"`
+	IdleConns int32 `json:"idleConns"`
+	AcquiredConns int32 `json:"acquiredConns"`
+	MaxConns int32 `json:"maxConns"`
+	AcquireCount int64 `json:"acquireCount"`
+	EmptyAcquireCount int64 `json:"emptyAcquireCount"`
+	CanceledAcquireCount int64 `json:"canceledAcquireCount"`
+}
+
+type databaseStatus struct {
+	Name string `json:"name"`
+	Flavour string `json:"flavour"`
+	Reachable bool `json:"reachable"`
+	LatencyMs float64 `json:"latencyMs"`
+	CircuitOpen bool `json:"circuitOpen"`
+	Pool *poolStatus `json:"pool,omitempty"` // omitted for test mocks
+	LastError string `json:"lastError,omitempty"`
+}
+
+type settingsStatus struct {
+	Reachable bool `json:"reachable"`
+	LastChecked string `json:"lastChecked,omitempty"`
+	LastError string `json:"lastError,omitempty"`
+}
+
+type tenantStatus struct {
+	Tenant string `json:"tenant"`
+	Url string `json:"url"`
+	Settings settingsStatus `json:"settings"`
+	Databases []databaseStatus `json:"databases"`
+}
+
+type moduleStatus struct {
+	Problems []string `json:"problems"`
+	Sessions []tenantStatus `json:"sessions"`
+}
+
+
+// Reachability is judged by the most recent fetch from mod-settings:
+// a fetch that was refused, for example for lack of permission, shows
+// that it can be reached. This does not take dbMutex, which is held
+// while connecting to a database.
+func (session *ModReportingSession) settingsStatus() settingsStatus {
+	session.settingsMutex.Lock()
+	defer session.settingsMutex.Unlock()
+
+	var netErr net.Error
+	status := settingsStatus{Reachable: !errors.As(session.settingsError, &netErr)}
+	if !session.settingsChecked.IsZero() {
+		status.LastChecked = session.settingsChecked.UTC().Format(time.RFC3339)
+	}
+	if session.settingsError != nil {
+		status.LastError = describeError(session.settingsError)
+	}
+	return status
+}
+
+
+// Only the kind of failure: the status is not authenticated, and error
+// messages may include host names, database users and the like
+func describeError(err error) string {
+	var pgErr *pgconn.PgError
+	var netErr net.Error
+	if errors.As(err, &pgErr) {
+		return "database error " + pgErr.Code
+	} else if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return "timed out"
+	} else if errors.As(err, &netErr) {
+		return "could not connect"
+	} else if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return "connection closed"
+	}
+	return "request failed"
+}
+
+
+// Those for FOLIO users' roles share the login user's pool, so are not
+// included
+func (session *ModReportingSession) reportingDbs() []*reportingDb {
+	session.dbMutex.Lock()
+	defer session.dbMutex.Unlock()
+
+	dbs := []*reportingDb{}
+	for _, db := range session.dbs {
+		if db.role == "" {
+			dbs = append(dbs, db)
+		}
+	}
+	sort.Slice(dbs, func(i, j int) bool {
+		return dbs[i].name < dbs[j].name
+	})
+	return dbs
+}
+
+
+// Pings the database itself, neither retrying nor being stopped by the
+// circuit breaker, so that the result reflects its current state
+func checkDatabase(db *reportingDb) databaseStatus {
+	name := db.name
+	if name == "" {
+		name = defaultDbName
+	}
+	status := databaseStatus{Name: name, Flavour: "LDP Classic"}
+	if db.isMDB {
+		status.Flavour = "MetaDB"
+	}
+
+	dbConn := db.dbConn
+	rp, ok := dbConn.(*resilientPool)
+	if ok {
+		dbConn = rp.pool
+		status.Pool = rp.poolStatus()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthPingTimeout)
+	defer cancel()
+	start := time.Now()
+	err := dbConn.Ping(ctx)
+	status.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	status.Reachable = err == nil
+
+	if ok {
+		var lastError error
+		status.CircuitOpen, lastError = rp.breaker.status()
+		if lastError != nil {
+			status.LastError = describeError(lastError)
+		}
+	}
+	if err != nil {
+		status.LastError = describeError(err)
+	}
+	return status
+}
+
+
+// Checks all the live sessions' databases at once, so that one that
+// is slow to respond does not delay the others
+func checkModule(server *ModReportingServer) moduleStatus {
+	sessions := server.sessions.liveSessions()
+	m := moduleStatus{Problems: []string{}, Sessions: make([]tenantStatus, len(sessions))}
+
+	var wg sync.WaitGroup
+	for i, session := range sessions {
+		dbs := session.reportingDbs()
+		m.Sessions[i] = tenantStatus{
+			Tenant: session.tenant,
+			Url: session.url,
+			Settings: session.settingsStatus(),
+			Databases: make([]databaseStatus, len(dbs)),
+		}
+		for j, db := range dbs {
+			wg.Add(1)
+			go func(status *databaseStatus, db *reportingDb) {
+				defer wg.Done()
+				*status = checkDatabase(db)
+			}(&m.Sessions[i].Databases[j], db)
+		}
+	}
+	wg.Wait()
+
+	for _, ts := range m.Sessions {
+		if !ts.Settings.Reachable {
+			m.Problems = append(m.Problems, fmt.Sprintf("tenant '%s': cannot reach mod-settings: %s", ts.Tenant, ts.Settings.LastError))
+		}
+		for _, ds := range ts.Databases {
+			if !ds.Reachable {
+				m.Problems = append(m.Problems, fmt.Sprintf("tenant '%s': cannot reach reporting database '%s': %s", ts.Tenant, ds.Name, ds.LastError))
+			}
+		}
+	}
+	return m
+}
+
+
+// The server is running: this never depends on anything else, so that
+// a failed database does not cause the module to be restarted
+func handleLiveness(w http.ResponseWriter) {
+	fmt.Fprintln(w, "OK")
+}
+
+
+// The module cannot serve requests if no live session can reach
+// mod-settings, or none can reach its default reporting database: a
+// breaker that is open counts as a failure, even if the ping succeeds.
+// One tenant's failure alone must not take the module out of service
+// for all the others, so it is only reported by the status. With no
+// live sessions, there is nothing to check.
+func readinessProblem(m moduleStatus) string {
+	settingsOk, dbsOk, dbsChecked := false, false, false
+	for _, ts := range m.Sessions {
+		if ts.Settings.Reachable {
+			settingsOk = true
+		}
+		for _, ds := range ts.Databases {
+			if ds.Name == defaultDbName {
+				dbsChecked = true
+				if ds.Reachable && !ds.CircuitOpen {
+					dbsOk = true
+				}
+			}
+		}
+	}
+
+	if len(m.Sessions) > 0 && !settingsOk {
+		return "no tenant can reach mod-settings"
+	} else if dbsChecked && !dbsOk {
+		return "no tenant can reach its reporting database"
+	}
+	return ""
+}
+
+
+func handleReadiness(w http.ResponseWriter, server *ModReportingServer) {
+	problem := readinessProblem(checkModule(server))
+	if problem != "" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, problem)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+
+// Always succeeds, so that the details can be seen whatever the
+// problem. An error can only come from writing the response, by which
+// time it is too late to change the status.
+func handleStatus(w http.ResponseWriter, server *ModReportingServer) {
+	_ = sendJSON(w, checkModule(server), "status")
+}
@@ -0,0 +1,170 @@
+package main
+
+import "net"
+import "time"
+import "errors"
+import "testing"
+import "net/url"
+import "net/http"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/indexdata/foliogo"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func Test_settingsStatus(t *testing.T) {
+	tests := []struct {
+		name string
+		err error
+		reachable bool
+		lastError string
+	}{
+		{ name: "never fetched", err: nil, reachable: true },
+		{ name: "refused", err: *foliogo.MakeHTTPError(403, "GET", "http://okapi:9130/settings/entries", ""), reachable: true, lastError: "request failed" },
+		{
+			name: "unreachable",
+			err: &url.Error{Op: "Get", URL: "http://okapi:9130/settings/entries", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}},
+			reachable: false,
+			lastError: "could not connect",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			session := &ModReportingSession{settingsError: test.err}
+			status := session.settingsStatus()
+			assert.Equal(t, test.reachable, status.Reachable)
+			assert.Equal(t, test.lastError, status.LastError)
+		})
+	}
+
+	t.Run("not blocked while connecting", func(t *testing.T) {
+		session := &ModReportingSession{}
+		session.dbMutex.Lock()
+		defer session.dbMutex.Unlock()
+		assert.True(t, session.settingsStatus().Reachable)
+	})
+}
+
+
+func Test_checkModule(t *testing.T) {
+	server, err := MakeConfiguredServer("../etc/silent.json", ".")
+	assert.Nil(t, err)
+
+	t.Run("no sessions", func(t *testing.T) {
+		m := checkModule(server)
+		assert.Equal(t, 0, len(m.Problems))
+		assert.Equal(t, 0, len(m.Sessions))
+
+		w := httptest.NewRecorder()
+		handleReadiness(w, server)
+		assert.Equal(t, http.StatusOK, w.Code)
+	})
+
+	session, err := NewModReportingSession(server, "http://localhost:9130", "t1")
+	assert.Nil(t, err)
+	server.sessions.add("t1:http://localhost:9130", session)
+	mock, err := pgxmock.NewPool()
+	assert.Nil(t, err)
+	useMockDb(session, mock)
+
+	t.Run("database reachable", func(t *testing.T) {
+		mock.ExpectPing()
+		m := checkModule(server)
+		assert.Equal(t, 0, len(m.Problems))
+		assert.Equal(t, 1, len(m.Sessions))
+		assert.Equal(t, "t1", m.Sessions[0].Tenant)
+		assert.Equal(t, []databaseStatus{{Name: "default", Flavour: "MetaDB", Reachable: true, LatencyMs: m.Sessions[0].Databases[0].LatencyMs}}, m.Sessions[0].Databases)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("database unreachable", func(t *testing.T) {
+		// The address is not revealed
+		mock.ExpectPing().WillReturnError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("dial tcp 10.0.0.1:5432: connection refused")})
+		m := checkModule(server)
+		assert.Equal(t, []string{"tenant 't1': cannot reach reporting database 'default': could not connect"}, m.Problems)
+		assert.Nil(t, mock.ExpectationsWereMet())
+
+		// With no other tenant, the module cannot serve anyone
+		mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+		w := httptest.NewRecorder()
+		handleReadiness(w, server)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+		assert.Equal(t, "no tenant can reach its reporting database\n", w.Body.String())
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("circuit open", func(t *testing.T) {
+		// The database is pinged even though the breaker is open
+		cb := newCircuitBreaker("", databaseConfig{FailureThreshold: 1}, nil)
+		cb.recordFailure(errors.New("connection refused"))
+		rp := newResilientPool(mock, databaseConfig{}, cb)
+		defer rp.Close()
+		db := newReportingDb(session, "", rp, false)
+
+		mock.ExpectPing()
+		status := checkDatabase(db)
+		assert.True(t, status.Reachable)
+		assert.True(t, status.CircuitOpen)
+		assert.Equal(t, "LDP Classic", status.Flavour)
+		assert.Equal(t, "request failed", status.LastError)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("status", func(t *testing.T) {
+		session.settingsMutex.Lock()
+		session.settingsChecked = time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+		session.settingsMutex.Unlock()
+		mock.ExpectPing()
+		w := httptest.NewRecorder()
+		handleStatus(w, server)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Regexp(t, `{"problems":\[\],"sessions":\[{"tenant":"t1","url":"http://localhost:9130","settings":{"reachable":true,"lastChecked":"2024-07-01T12:00:00Z"},"databases":\[{"name":"default","flavour":"MetaDB","reachable":true,"latencyMs":[0-9.]+,"circuitOpen":false}\]}\]}`, w.Body.String())
+	})
+}
+
+
+func Test_readinessProblem(t *testing.T) {
+	reachable := settingsStatus{Reachable: true}
+	up := databaseStatus{Name: "default", Reachable: true}
+	down := databaseStatus{Name: "default"}
+	tripped := databaseStatus{Name: "default", Reachable: true, CircuitOpen: true}
+	other := databaseStatus{Name: "other"}
+
+	tests := []struct {
+		name string
+		sessions []tenantStatus
+		expected string
+	}{
+		{ name: "no sessions" },
+		{ name: "no databases yet", sessions: []tenantStatus{{Settings: reachable}} },
+		{ name: "all well", sessions: []tenantStatus{{Settings: reachable, Databases: []databaseStatus{up, other}}} },
+		{
+			name: "one tenant failing",
+			sessions: []tenantStatus{
+				{Settings: settingsStatus{}, Databases: []databaseStatus{down}},
+				{Settings: reachable, Databases: []databaseStatus{up}},
+			},
+		},
+		{
+			name: "mod-settings unreachable",
+			sessions: []tenantStatus{{Settings: settingsStatus{}, Databases: []databaseStatus{up}}},
+			expected: "no tenant can reach mod-settings",
+		},
+		{
+			name: "all databases failing",
+			sessions: []tenantStatus{
+				{Settings: reachable, Databases: []databaseStatus{down}},
+				{Settings: reachable, Databases: []databaseStatus{tripped}},
+				{Settings: reachable},
+			},
+			expected: "no tenant can reach its reporting database",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, readinessProblem(moduleStatus{Sessions: test.sessions}))
+		})
+	}
+}
@@ -0,0 +1,59 @@
+// Time-travel queries over MetaDB's history tables
+package main
+
+import "fmt"
+import "strings"
+import "time"
+
+
+// Accepted formats for asOf. A date means midnight UTC at its start,
+// as does a time without a zone.
+var asOfLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+
+// Each row of a MetaDB history table, whose name ends with "__",
+// records a version of a record that was valid from __start until
+// __end; __current is true for the latest version of each record that
+// still exists. Returns a condition selecting the versions that were
+// valid at asOf, or only the current versions, with any parameter
+// added to those passed in.
+func makeHistoryCond(qt queryTable, isMetaDB bool, params []any) (string, []any, error) {
+	if qt.AsOf == "" && !qt.CurrentOnly {
+		return "", params, nil
+	}
+
+	if !isMetaDB {
+		return "", nil, fmt.Errorf("asOf and currentOnly can only be used with MetaDB, not LDP Classic")
+	} else if !strings.HasSuffix(qt.Table, "__") {
+		return "", nil, fmt.Errorf("asOf and currentOnly can only be used with history tables, whose names end with '__', not '%s'", qt.Table)
+	} else if qt.AsOf != "" && qt.CurrentOnly {
+		return "", nil, fmt.Errorf("asOf and currentOnly cannot be used together")
+	}
+
+	if qt.CurrentOnly {
+		return "__current", params, nil
+	}
+
+	asOf, err := parseAsOf(qt.AsOf)
+	if err != nil {
+		return "", nil, err
+	}
+	params = append(params, asOf)
+	n := len(params)
+	return fmt.Sprintf("__start <= $%d AND (__end IS NULL OR __end > $%d)", n, n), params, nil
+}
+
+
+func parseAsOf(s string) (time.Time, error) {
+	for _, layout := range asOfLayouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad value '%s' for asOf: must be a date or an RFC 3339 timestamp", s)
+}
@@ -0,0 +1,89 @@
+package main
+
+import "testing"
+import "time"
+import "encoding/json"
+import "github.com/stretchr/testify/assert"
+
+
+func Test_historyQueries(t *testing.T) {
+	tests := []struct {
+		name string
+		sendData string
+		isClassic bool
+		expected string
+		expectedArgs []any
+		errorstr string
+	}{
+		{
+			name: "as of a date",
+			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users__", "asOf": "2024-07-01" }] }`,
+			expected: `SELECT * FROM "folio_users"."users__" WHERE __start <= $1 AND (__end IS NULL OR __end > $1)`,
+			expectedArgs: []any{time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "as of a time, with filters",
+			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users__", "asOf": "2024-07-01T12:30:00+01:00",
+				"columnFilters": [{ "key": "username", "value": "mike" }] }] }`,
+			expected: `SELECT * FROM "folio_users"."users__" WHERE username = $1 AND __start <= $2 AND (__end IS NULL OR __end > $2)`,
+			expectedArgs: []any{"mike", time.Date(2024, 7, 1, 11, 30, 0, 0, time.UTC)},
+		},
+		{
+			name: "as of a date, with an empty filter",
+			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users__", "asOf": "2024-07-01",
+				"columnFilters": [{}, { "key": "username", "op": "LIKE", "value": "mi%" }] }] }`,
+			expected: `SELECT * FROM "folio_users"."users__" WHERE username LIKE $1 AND __start <= $2 AND (__end IS NULL OR __end > $2)`,
+			expectedArgs: []any{"mi%", time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			name: "current only",
+			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users__", "currentOnly": true, "limit": 5 }] }`,
+			expected: `SELECT * FROM "folio_users"."users__" WHERE __current LIMIT 5`,
+			expectedArgs: []any{},
+		},
+		{
+			name: "LDP Classic",
+			sendData: `{ "tables": [{ "schema": "public", "tableName": "users__", "currentOnly": true }] }`,
+			isClassic: true,
+			errorstr: "asOf and currentOnly can only be used with MetaDB, not LDP Classic",
+		},
+		{
+			name: "not a history table",
+			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users", "asOf": "2024-07-01" }] }`,
+			errorstr: "can only be used with history tables, whose names end with '__', not 'users'",
+		},
+		{
+			name: "both",
+			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users__", "asOf": "2024-07-01", "currentOnly": true }] }`,
+			errorstr: "asOf and currentOnly cannot be used together",
+		},
+		{
+			name: "bad timestamp",
+			sendData: `{ "tables": [{ "schema": "folio_users", "tableName": "users__", "asOf": "1 July" }] }`,
+			errorstr: "bad value '1 July' for asOf",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var jq jsonQuery
+			err := json.Unmarshal([]byte(test.sendData), &jq)
+			assert.Nil(t, err)
+			sql, params, err := makeSql(jq, !test.isClassic)
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, sql)
+				assert.Equal(t, len(test.expectedArgs), len(params))
+				for i, val := range params {
+					if expectedTime, ok := test.expectedArgs[i].(time.Time); ok {
+						assert.True(t, expectedTime.Equal(val.(time.Time)))
+					} else {
+						assert.EqualValues(t, test.expectedArgs[i], val)
+					}
+				}
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+			}
+		})
+	}
+}
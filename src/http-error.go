@@ -1,11 +1,13 @@
 package main
 
-/*
 import "fmt"
 
+// An error that should be reported with a particular HTTP status,
+// rather than as an internal server error
 type httpError struct {
 	status int
 	message string
+	retryAfter int // seconds, sent as Retry-After if non-zero
 }
 
 func MakeHttpError(status int, message string) *httpError {
@@ -15,4 +17,7 @@ func MakeHttpError(status int, message string) *httpError {
 func (err httpError) String() string {
 	return fmt.Sprintf("HTTP error %d: %s", err.status, err.message)
 }
-*/
+
+func (err *httpError) Error() string {
+	return err.message
+}
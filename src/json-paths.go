@@ -0,0 +1,247 @@
+// Discover the structure of JSON columns, and validate paths into them
+package main
+
+import "context"
+import "fmt"
+import "regexp"
+import "slices"
+import "strconv"
+import "strings"
+import "net/http"
+import "github.com/jackc/pgx/v5"
+
+
+const defaultJsonSampleSize = 100
+const maxJsonSampleSize = 1000
+
+
+// Array elements are represented in paths by "[]". Count is the number
+// of sampled rows in which the path occurs at least once, whereas Types
+// counts every occurrence, so may add up to more than Count.
+type jsonPathInfo struct {
+	Path []string `json:"path"`
+	Expression string `json:"expression,omitempty"` // for use in queries
+	Types map[string]int `json:"types"`
+	Count int `json:"count"`
+	Frequency float64 `json:"frequency"`
+}
+
+
+func handleJsonPaths(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	v := req.URL.Query()
+	schema := v.Get("schema")
+	table := v.Get("table")
+	if schema == "" || table == "" {
+		return fmt.Errorf("must specify both schema and table")
+	}
+	column := v.Get("column")
+	if column == "" {
+		// MetaDB's copy of the original FOLIO record
+		column = "data"
+	}
+
+	sample := defaultJsonSampleSize
+	if s := v.Get("sample"); s != "" {
+		var err error
+		sample, err = strconv.Atoi(s)
+		if err != nil || sample < 1 || sample > maxJsonSampleSize {
+			return fmt.Errorf("bad value '%s' for sample", s)
+		}
+	}
+
+	db, dbConn, err := session.findDbConn(req)
+	if err != nil {
+		return fmt.Errorf("could not find reporting DB: %w", err)
+	}
+	rules, err := fetchVisibilityRules(req, session)
+	if err != nil {
+		return err
+	}
+	err = checkTableVisible(db.schemaCache, dbConn, db.isMDB, rules, schema, table)
+	if err != nil {
+		return err
+	}
+
+	columns, err := db.schemaCache.fetchColumns(dbConn, db.isMDB, schema, table)
+	if err != nil {
+		return fmt.Errorf("could not fetch columns from reporting DB: %w", err)
+	}
+	index := slices.IndexFunc(columns, func(c dbColumn) bool { return c.ColumnName == column })
+	if index < 0 {
+		return fmt.Errorf("table %s.%s has no column '%s'", schema, table, column)
+	} else if !columns[index].IsJSON {
+		return fmt.Errorf("column '%s' of table %s.%s is not JSON", column, schema, table)
+	}
+
+	var docs []any
+	err = session.runTagged(w, req, db, dbConn, func(tx pgx.Tx, tag requestTag) error {
+		docs, err = fetchJsonSample(tx, tag, schema, table, column, sample)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not sample JSON from reporting DB: %w", err)
+	}
+
+	return sendJSON(w, discoverJsonPaths(column, docs), "JSON paths")
+}
+
+
+func fetchJsonSample(dbConn queryer, tag requestTag, schema string, table string, column string, limit int) ([]any, error) {
+	col := pgx.Identifier{column}.Sanitize()
+	query := "SELECT " + col + " FROM " + pgx.Identifier{schema, table}.Sanitize() + " WHERE " + col + " IS NOT NULL LIMIT $1"
+	rows, err := dbConn.Query(context.Background(), tag.comment() + query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("could not run query '%s': %w", query, err)
+	}
+	defer rows.Close()
+
+	docs := []any{}
+	for rows.Next() {
+		var doc any
+		err = rows.Scan(&doc)
+		if err != nil {
+			return nil, fmt.Errorf("could not read JSON value: %w", err)
+		}
+		docs = append(docs, doc)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read JSON values: %w", err)
+	}
+	return docs, nil
+}
+
+
+// Returns the paths found in the documents, sorted by path
+func discoverJsonPaths(column string, docs []any) []jsonPathInfo {
+	infos := map[string]*jsonPathInfo{}
+	for _, doc := range docs {
+		seen := map[string]bool{}
+		walkJson(doc, []string{}, infos, seen)
+		for key := range seen {
+			infos[key].Count++
+		}
+	}
+
+	result := make([]jsonPathInfo, 0, len(infos))
+	for _, info := range infos {
+		info.Frequency = float64(info.Count) / float64(len(docs))
+		info.Expression = jsonPathExpression(column, info)
+		result = append(result, *info)
+	}
+	slices.SortFunc(result, func(a, b jsonPathInfo) int {
+		return slices.Compare(a.Path, b.Path)
+	})
+	return result
+}
+
+
+func walkJson(value any, path []string, infos map[string]*jsonPathInfo, seen map[string]bool) {
+	if len(path) > 0 {
+		key := strings.Join(path, "\x00")
+		info := infos[key]
+		if info == nil {
+			info = &jsonPathInfo{Path: slices.Clone(path), Types: map[string]int{}}
+			infos[key] = info
+		}
+		info.Types[jsonType(value)]++
+		seen[key] = true
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		for k, child := range v {
+			walkJson(child, append(path, k), infos, seen)
+		}
+	case []any:
+		for _, child := range v {
+			walkJson(child, append(path, "[]"), infos, seen)
+		}
+	}
+}
+
+
+func jsonType(value any) string {
+	switch value.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	default:
+		return "number"
+	}
+}
+
+
+// Paths through arrays cannot be expressed as simple JSON paths. The
+// last step uses ->>, yielding text, unless the path leads to objects
+// or arrays.
+func jsonPathExpression(column string, info *jsonPathInfo) string {
+	if slices.Contains(info.Path, "[]") {
+		return ""
+	}
+
+	s := pgx.Identifier{column}.Sanitize()
+	if isPlainIdentifier(column) {
+		s = column
+	}
+	for i, key := range info.Path {
+		arrow := "->"
+		if i == len(info.Path)-1 && info.Types["object"] == 0 && info.Types["array"] == 0 {
+			arrow = "->>"
+		}
+		s += arrow + "'" + strings.ReplaceAll(key, "'", "''") + "'"
+	}
+	return s
+}
+
+
+var plainIdentifierRegexp = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+func isPlainIdentifier(s string) bool {
+	return plainIdentifierRegexp.MatchString(s)
+}
+
+
+var jsonPathColumnRegexp = regexp.MustCompile(`^\s*("(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)`)
+var jsonPathStepRegexp = regexp.MustCompile(`^\s*(->>?)\s*('(?:[^']|'')*'|-?[0-9]+)`)
+
+
+// Keys in JSON queries are usually column names, but may also be paths
+// into JSON columns such as data->'status'->>'name': a column name
+// followed by steps, each consisting of -> or ->> and then a quoted
+// object key or an array index. Only the last step may use ->>. Keys
+// that contain "->" are validated as paths and returned in canonical
+// form, without spaces; others are returned unchanged.
+func parseQueryKey(key string) (string, bool, error) {
+	if !strings.Contains(key, "->") {
+		return key, false, nil
+	}
+
+	m := jsonPathColumnRegexp.FindStringSubmatch(key)
+	if m == nil {
+		return "", false, fmt.Errorf("bad JSON path '%s': must start with a column name", key)
+	}
+	s := m[1]
+	rest := key[len(m[0]):]
+	text := false
+	for strings.TrimSpace(rest) != "" {
+		m = jsonPathStepRegexp.FindStringSubmatch(rest)
+		if m == nil {
+			return "", false, fmt.Errorf("bad JSON path '%s': expected -> or ->> followed by a quoted key or an index at '%s'", key, strings.TrimSpace(rest))
+		} else if text {
+			return "", false, fmt.Errorf("bad JSON path '%s': only the last step may use ->>", key)
+		}
+		text = m[1] == "->>"
+		s += m[1] + m[2]
+		rest = rest[len(m[0]):]
+	}
+	return s, true, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import "testing"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func Test_parseQueryKey(t *testing.T) {
+	tests := []struct {
+		key string
+		expected string
+		isPath bool
+		errorstr string
+	}{
+		{ key: "id", expected: "id" },
+		{ key: "count(*)", expected: "count(*)" },
+		{ key: "data->'status'->>'name'", expected: "data->'status'->>'name'", isPath: true },
+		{ key: " data -> 'status' ->> 'name' ", expected: "data->'status'->>'name'", isPath: true },
+		{ key: `"Data"->'tags'->0`, expected: `"Data"->'tags'->0`, isPath: true },
+		{ key: "data->>'it''s'", expected: "data->>'it''s'", isPath: true },
+		{ key: "->'status'", errorstr: "must start with a column name" },
+		{ key: "data->>'status'->'name'", errorstr: "only the last step may use ->>" },
+		{ key: "data->status", errorstr: "expected -> or ->> followed by a quoted key or an index at '->status'" },
+		{ key: "data->'status'; DROP TABLE users", errorstr: "at '; DROP TABLE users'" },
+		{ key: "data->'unterminated", errorstr: "bad JSON path" },
+	}
+
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			key, isPath, err := parseQueryKey(test.key)
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, key)
+				assert.Equal(t, test.isPath, isPath)
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+			}
+		})
+	}
+}
+
+
+func Test_discoverJsonPaths(t *testing.T) {
+	docs := []any{
+		map[string]any{
+			"id": "123",
+			"status": map[string]any{ "name": "Available" },
+			"tags": []any{ "a", "b" },
+		},
+		map[string]any{
+			"id": "456",
+			"status": map[string]any{ "name": nil },
+			"it's": float64(3),
+		},
+	}
+
+	assert.Equal(t, []jsonPathInfo{
+		{ Path: []string{"id"}, Expression: "data->>'id'", Types: map[string]int{"string": 2}, Count: 2, Frequency: 1 },
+		{ Path: []string{"it's"}, Expression: "data->>'it''s'", Types: map[string]int{"number": 1}, Count: 1, Frequency: 0.5 },
+		{ Path: []string{"status"}, Expression: "data->'status'", Types: map[string]int{"object": 2}, Count: 2, Frequency: 1 },
+		{ Path: []string{"status", "name"}, Expression: "data->'status'->>'name'", Types: map[string]int{"string": 1, "null": 1}, Count: 2, Frequency: 1 },
+		{ Path: []string{"tags"}, Expression: "data->'tags'", Types: map[string]int{"array": 1}, Count: 1, Frequency: 0.5 },
+		{ Path: []string{"tags", "[]"}, Types: map[string]int{"string": 2}, Count: 1, Frequency: 0.5 },
+	}, discoverJsonPaths("data", docs))
+
+	paths := discoverJsonPaths("Data", []any{ map[string]any{ "id": "1" } })
+	assert.Equal(t, `"Data"->>'id'`, paths[0].Expression)
+}
+
+
+func Test_jsonPaths(t *testing.T) {
+	t.Run("sample", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectQuery(`^/\* mod-reporting tenant=diku .*SELECT "data" FROM "folio_users"."users" WHERE "data" IS NOT NULL LIMIT \$1`).
+			WithArgs(50).
+			WillReturnRows(pgxmock.NewRows([]string{"data"}).
+				AddRow(map[string]any{"id": "123"}))
+
+		docs, err := fetchJsonSample(mock, requestTag{tenant: "diku"}, "folio_users", "users", "data", 50)
+		assert.Nil(t, err)
+		assert.Equal(t, []any{map[string]any{"id": "123"}}, docs)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	errorTests := []struct {
+		name string
+		query string
+		errorstr string
+	}{
+		{ name: "missing table", query: "schema=folio_users", errorstr: "must specify both schema and table" },
+		{ name: "bad sample", query: "schema=folio_users&table=users&sample=1001", errorstr: "bad value '1001' for sample" },
+	}
+
+	for _, test := range errorTests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ldp/db/jsonpaths?" + test.query, nil)
+			err := handleJsonPaths(httptest.NewRecorder(), req, &ModReportingSession{})
+			assert.ErrorContains(t, err, test.errorstr)
+		})
+	}
+}
@@ -218,6 +218,13 @@ func writeConfigKey(w http.ResponseWriter, req *http.Request, session *ModReport
 		return fmt.Errorf("could not write to mod-settings: %w", err)
 	}
 
+	if key == "dbinfo" || key == "databases" {
+		// Existing connections use the old settings
+		session.resetDbConns()
+	} else if key == "visibility" {
+		session.resetVisibilityRules()
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	bytes, err = json.Marshal(simpleSettingsItem)
 	if err != nil {
@@ -5,6 +5,7 @@ import "strings"
 import "testing"
 import "github.com/stretchr/testify/assert"
 import "net/http/httptest"
+import "github.com/pashagolub/pgxmock/v3"
 
 
 func Test_handleConfig(t *testing.T) {
@@ -71,6 +72,11 @@ func Test_handleConfig(t *testing.T) {
 	assert.Nil(t, err)
 	badSession, err := NewModReportingSession(nil, "x" + baseUrl, "dummyTenant")
 	assert.Nil(t, err)
+	// Writing dbinfo should close the connection made with the old value
+	mock, err := pgxmock.NewPool()
+	assert.Nil(t, err)
+	mock.ExpectClose()
+	useMockDb(session, mock)
 
 	for i, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -105,4 +111,7 @@ func Test_handleConfig(t *testing.T) {
 			}
 		})
 	}
+
+	assert.False(t, session.hasDbConn())
+	assert.Nil(t, mock.ExpectationsWereMet())
 }
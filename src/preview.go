@@ -0,0 +1,185 @@
+// Preview a table: a few sample rows, and statistics for each column
+package main
+
+import "context"
+import "fmt"
+import "strconv"
+import "strings"
+import "net/http"
+import "github.com/jackc/pgx/v5"
+
+
+const defaultPreviewLimit = 10
+const maxPreviewLimit = 100
+
+
+// Taken from pg_stats, so available only for tables that have been
+// analyzed. Values are represented as strings, whatever their type.
+type columnStats struct {
+	NullFraction float64 `json:"nullFraction"`
+	DistinctEstimate float64 `json:"distinctEstimate"`
+	MostCommonValues []string `json:"mostCommonValues,omitempty"`
+	MostCommonFrequencies []float64 `json:"mostCommonFrequencies,omitempty"`
+	HistogramBounds []string `json:"histogramBounds,omitempty"`
+}
+
+type previewColumn struct {
+	dbColumn
+	Stats *columnStats `json:"stats,omitempty"`
+}
+
+type tablePreview struct {
+	Columns []previewColumn `json:"columns"`
+	Rows []map[string]any `json:"rows"`
+}
+
+
+func handlePreview(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	v := req.URL.Query()
+	schema := v.Get("schema")
+	table := v.Get("table")
+	if schema == "" || table == "" {
+		return fmt.Errorf("must specify both schema and table")
+	}
+
+	limit := defaultPreviewLimit
+	if s := v.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 || limit > maxPreviewLimit {
+			return fmt.Errorf("bad value '%s' for limit", s)
+		}
+	}
+
+	var sample float64
+	if s := v.Get("sample"); s != "" {
+		var err error
+		sample, err = strconv.ParseFloat(s, 64)
+		if err != nil || sample <= 0 || sample > 100 {
+			return fmt.Errorf("bad value '%s' for sample", s)
+		}
+	}
+
+	bigNumbersAsStrings, err := parseBoolParam(v, "bigNumbersAsStrings")
+	if err != nil {
+		return err
+	}
+	postgresFormats, err := parseBoolParam(v, "postgresFormats")
+	if err != nil {
+		return err
+	}
+
+	db, dbConn, err := session.findDbConn(req)
+	if err != nil {
+		return fmt.Errorf("could not find reporting DB: %w", err)
+	}
+	rules, err := fetchVisibilityRules(req, session)
+	if err != nil {
+		return err
+	}
+	err = checkTableVisible(db.schemaCache, dbConn, db.isMDB, rules, schema, table)
+	if err != nil {
+		return err
+	}
+
+	columns, err := db.schemaCache.fetchColumns(dbConn, db.isMDB, schema, table)
+	if err != nil {
+		return fmt.Errorf("could not fetch columns from reporting DB: %w", err)
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("table %s.%s has no readable columns", schema, table)
+	}
+
+	var preview *tablePreview
+	err = session.runTagged(w, req, db, dbConn, func(tx pgx.Tx, tag requestTag) error {
+		opts := outputOptions{BigNumbersAsStrings: bigNumbersAsStrings, PostgresFormats: postgresFormats}
+		preview, err = fetchPreview(tx, tag, schema, table, columns, limit, sample, opts)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("could not fetch preview from reporting DB: %w", err)
+	}
+
+	return sendJSON(w, preview, "table preview")
+}
+
+
+// Only the specified columns are selected, so that tables with
+// column-level grants can be previewed. If sample is non-zero, rows
+// are taken from approximately that percentage of the table's pages,
+// which is quicker than a scan for large tables but does not work for
+// views.
+func fetchPreview(dbConn queryer, tag requestTag, schema string, table string, columns []dbColumn, limit int, sample float64, opts outputOptions) (*tablePreview, error) {
+	stats, err := fetchColumnStats(dbConn, tag, schema, table)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := tablePreview{Columns: make([]previewColumn, len(columns))}
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		preview.Columns[i] = previewColumn{dbColumn: col, Stats: stats[col.ColumnName]}
+		names[i] = pgx.Identifier{col.ColumnName}.Sanitize()
+	}
+
+	sql := "SELECT " + strings.Join(names, ", ") + " FROM " + pgx.Identifier{schema, table}.Sanitize()
+	params := []any{}
+	if sample != 0 {
+		params = append(params, sample)
+		sql += " TABLESAMPLE SYSTEM ($1)"
+	}
+	params = append(params, limit)
+	sql += " LIMIT $" + strconv.Itoa(len(params))
+
+	rows, err := dbConn.Query(context.Background(), tag.comment() + sql, params...)
+	if err != nil {
+		return nil, fmt.Errorf("could not run query '%s': %w", sql, err)
+	}
+	preview.Rows, err = collectAndFixRows(rows, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &preview, nil
+}
+
+
+// Returns statistics indexed by column name. When n_distinct is
+// negative, it is minus the number of distinct values divided by the
+// number of rows, so we convert it to an estimated number of values.
+// Partitioned tables have only inherited statistics, so these are
+// used if there are no others.
+func fetchColumnStats(dbConn queryer, tag requestTag, schema string, table string) (map[string]*columnStats, error) {
+	query := `SELECT DISTINCT ON (s.attname) s.attname, s.null_frac,
+		    CASE WHEN s.n_distinct >= 0 THEN s.n_distinct ELSE -s.n_distinct * greatest(c.reltuples, 0) END AS distinct_estimate,
+		    s.most_common_vals::text::text[] AS most_common_vals,
+		    s.most_common_freqs,
+		    s.histogram_bounds::text::text[] AS histogram_bounds
+		FROM pg_stats s
+		    JOIN pg_namespace n ON n.nspname = s.schemaname
+		    JOIN pg_class c ON c.relnamespace = n.oid AND c.relname = s.tablename
+		WHERE s.schemaname = $1 AND s.tablename = $2
+		ORDER BY s.attname, s.inherited`
+	rows, err := dbConn.Query(context.Background(), tag.comment() + query, schema, table)
+	if err != nil {
+		return nil, fmt.Errorf("could not run query '%s': %w", query, err)
+	}
+	defer rows.Close()
+
+	stats := map[string]*columnStats{}
+	for rows.Next() {
+		var name string
+		var s columnStats
+		err = rows.Scan(&name, &s.NullFraction, &s.DistinctEstimate, &s.MostCommonValues, &s.MostCommonFrequencies, &s.HistogramBounds)
+		if err != nil {
+			return nil, fmt.Errorf("could not read column statistics: %w", err)
+		}
+		stats[name] = &s
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read column statistics: %w", err)
+	}
+	return stats, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import "testing"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func establishMockForColumnStats(mock pgxmock.PgxPoolIface) {
+	mock.ExpectQuery(`FROM pg_stats s`).
+		WithArgs("folio_users", "users").
+		WillReturnRows(pgxmock.NewRows([]string{"attname", "null_frac", "distinct_estimate", "most_common_vals", "most_common_freqs", "histogram_bounds"}).
+			AddRow("id", float64(0), float64(1234), nil, nil, []string{"0001", "8000", "ffff"}).
+			AddRow("active", float64(0.25), float64(2), []string{"true", "false"}, []float64{0.5, 0.25}, nil))
+}
+
+
+func Test_preview(t *testing.T) {
+	columns := []dbColumn{
+		{ ColumnName: "id", DataType: "uuid", TableSchema: "folio_users", TableName: "users", OrdinalPosition: "1" },
+		{ ColumnName: "active", DataType: "boolean", TableSchema: "folio_users", TableName: "users", OrdinalPosition: "2" },
+		{ ColumnName: "barcode", DataType: "text", TableSchema: "folio_users", TableName: "users", OrdinalPosition: "3" },
+	}
+
+	tests := []struct {
+		name string
+		sample float64
+		expectedSql string
+		expectedArgs []any
+	}{
+		{
+			name: "first rows",
+			expectedSql: `SELECT "id", "active", "barcode" FROM "folio_users"."users" LIMIT \$1`,
+			expectedArgs: []any{5},
+		},
+		{
+			name: "sampled rows",
+			sample: 0.5,
+			expectedSql: `SELECT "id", "active", "barcode" FROM "folio_users"."users" TABLESAMPLE SYSTEM \(\$1\) LIMIT \$2`,
+			expectedArgs: []any{0.5, 5},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			assert.Nil(t, err)
+			defer mock.Close()
+			establishMockForColumnStats(mock)
+			mock.ExpectQuery(test.expectedSql).
+				WithArgs(test.expectedArgs...).
+				WillReturnRows(pgxmock.NewRows([]string{"id", "active", "barcode"}).
+					AddRow("0001", true, "123").
+					AddRow("0002", false, nil))
+
+			preview, err := fetchPreview(mock, requestTag{}, "folio_users", "users", columns, 5, test.sample, outputOptions{})
+			assert.Nil(t, err)
+			assert.Equal(t, 3, len(preview.Columns))
+			assert.Equal(t, &columnStats{DistinctEstimate: 1234, HistogramBounds: []string{"0001", "8000", "ffff"}}, preview.Columns[0].Stats)
+			assert.Equal(t, &columnStats{NullFraction: 0.25, DistinctEstimate: 2,
+				MostCommonValues: []string{"true", "false"}, MostCommonFrequencies: []float64{0.5, 0.25}}, preview.Columns[1].Stats)
+			assert.Nil(t, preview.Columns[2].Stats)
+			assert.Equal(t, []map[string]any{
+				{ "id": "0001", "active": true, "barcode": "123" },
+				{ "id": "0002", "active": false, "barcode": nil },
+			}, preview.Rows)
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+
+	errorTests := []struct {
+		name string
+		query string
+		errorstr string
+	}{
+		{ name: "missing table", query: "schema=folio_users", errorstr: "must specify both schema and table" },
+		{ name: "bad limit", query: "schema=folio_users&table=users&limit=101", errorstr: "bad value '101' for limit" },
+		{ name: "bad sample", query: "schema=folio_users&table=users&sample=0", errorstr: "bad value '0' for sample" },
+	}
+
+	for _, test := range errorTests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/ldp/db/preview?" + test.query, nil)
+			err := handlePreview(httptest.NewRecorder(), req, &ModReportingSession{})
+			assert.ErrorContains(t, err, test.errorstr)
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Restrict the catalogue to what the reporting database user can read
+package main
+
+import "context"
+import "fmt"
+
+
+// Returns, for each table, whether the connected database user may
+// select from it: that is, whether it has USAGE on the table's schema
+// and SELECT on either the table itself or at least one of its
+// columns. Tables that do not exist in pg_class are not readable.
+func findReadableTables(dbConn PgxIface, tables []dbTable) ([]bool, error) {
+	readable := make([]bool, len(tables))
+	if len(tables) == 0 {
+		return readable, nil
+	}
+
+	schemas, names := splitTables(tables)
+	query := `SELECT t.n
+		FROM unnest($1::text[], $2::text[]) WITH ORDINALITY AS t(schema_name, table_name, n)
+		    JOIN pg_namespace ns ON ns.nspname = t.schema_name
+		    JOIN pg_class c ON c.relnamespace = ns.oid AND c.relname = t.table_name
+		WHERE has_schema_privilege(ns.oid, 'USAGE')
+		    AND (has_table_privilege(c.oid, 'SELECT') OR has_any_column_privilege(c.oid, 'SELECT'))`
+	rows, err := dbConn.Query(context.Background(), query, schemas, names)
+	if err != nil {
+		return nil, fmt.Errorf("could not run query '%s': %w", query, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n int64
+		err = rows.Scan(&n)
+		if err != nil {
+			return nil, fmt.Errorf("could not read table privileges: %w", err)
+		}
+		if n < 1 || n > int64(len(tables)) {
+			return nil, fmt.Errorf("table privileges for unexpected table number %d", n)
+		}
+		readable[n-1] = true
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read table privileges: %w", err)
+	}
+	return readable, nil
+}
+
+
+// Removes the tables that the database user cannot read, preserving order
+func readableTables(dbConn PgxIface, tables []dbTable) ([]dbTable, error) {
+	readable, err := findReadableTables(dbConn, tables)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]dbTable, 0, len(tables))
+	for i, t := range tables {
+		if readable[i] {
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
+
+
+// Sets the Accessible field of each table in place, for diagnosing grants
+func markReadableTables(dbConn PgxIface, tables []dbTable) error {
+	readable, err := findReadableTables(dbConn, tables)
+	if err != nil {
+		return err
+	}
+
+	for i := range tables {
+		tables[i].Accessible = &readable[i]
+	}
+	return nil
+}
+
+
+// Returns a description of the first way found in which the connected
+// database user could change the database, or "" if it cannot. Only
+// the temporary schema, which is needed to run reports, is allowed.
+func findWritePrivilege(dbConn PgxIface) (string, error) {
+	query := `SELECT reason FROM (
+		    SELECT 1 AS n, 'it is a superuser or can create roles or databases, or bypass row security' AS reason
+		    FROM pg_roles
+		    WHERE rolname = current_user AND (rolsuper OR rolcreaterole OR rolcreatedb OR rolbypassrls)
+		UNION ALL
+		    SELECT 2, 'it can write server files or execute server programs'
+		    WHERE pg_has_role('pg_write_server_files', 'MEMBER') OR pg_has_role('pg_execute_server_program', 'MEMBER')
+		UNION ALL
+		    (SELECT 3, 'it can create objects in schema ' || quote_ident(nspname)
+		    FROM pg_namespace
+		    WHERE has_schema_privilege(oid, 'CREATE') AND nspname NOT LIKE 'pg\_%' AND nspname <> 'information_schema'
+		    ORDER BY nspname LIMIT 1)
+		UNION ALL
+		    (SELECT 4, 'it can write to table ' || quote_ident(ns.nspname) || '.' || quote_ident(c.relname)
+		    FROM pg_class c JOIN pg_namespace ns ON ns.oid = c.relnamespace
+		    WHERE c.relkind IN ('r', 'p', 'v', 'f')
+		        AND ns.nspname NOT LIKE 'pg\_%' AND ns.nspname <> 'information_schema'
+		        AND has_schema_privilege(ns.oid, 'USAGE')
+		        AND (has_table_privilege(c.oid, 'INSERT, UPDATE, DELETE, TRUNCATE')
+		            OR has_any_column_privilege(c.oid, 'INSERT, UPDATE'))
+		    ORDER BY ns.nspname, c.relname LIMIT 1)
+		) AS t ORDER BY n LIMIT 1`
+	rows, err := dbConn.Query(context.Background(), query)
+	if err != nil {
+		return "", fmt.Errorf("could not run query '%s': %w", query, err)
+	}
+	defer rows.Close()
+
+	reason := ""
+	if rows.Next() {
+		err = rows.Scan(&reason)
+		if err != nil {
+			return "", fmt.Errorf("could not read write privileges: %w", err)
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return "", fmt.Errorf("could not read write privileges: %w", err)
+	}
+	return reason, nil
+}
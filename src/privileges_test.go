@@ -0,0 +1,91 @@
+package main
+
+import "testing"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func Test_privileges(t *testing.T) {
+	tables := []dbTable{
+		{ SchemaName: "folio_users", TableName: "users" },
+		{ SchemaName: "folio_audit", TableName: "events" },
+		{ SchemaName: "folio_inventory", TableName: "item" },
+	}
+
+	t.Run("readable tables", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectQuery(`has_table_privilege\(c.oid, 'SELECT'\) OR has_any_column_privilege\(c.oid, 'SELECT'\)`).
+			WithArgs([]string{"folio_users", "folio_audit", "folio_inventory"}, []string{"users", "events", "item"}).
+			WillReturnRows(pgxmock.NewRows([]string{"n"}).AddRow(int64(3)).AddRow(int64(1)))
+
+		readable, err := readableTables(mock, tables)
+		assert.Nil(t, err)
+		assert.Equal(t, []dbTable{tables[0], tables[2]}, readable)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("mark readable tables", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		establishMockForReadableTables(mock, 2)
+
+		marked := append([]dbTable{}, tables...)
+		err = markReadableTables(mock, marked)
+		assert.Nil(t, err)
+		yes, no := true, false
+		assert.Equal(t, []*bool{&no, &yes, &no}, []*bool{marked[0].Accessible, marked[1].Accessible, marked[2].Accessible})
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("no tables", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+
+		readable, err := readableTables(mock, []dbTable{})
+		assert.Nil(t, err)
+		assert.Equal(t, []dbTable{}, readable)
+	})
+
+	t.Run("unexpected table number", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		establishMockForReadableTables(mock, 4)
+
+		_, err = readableTables(mock, tables)
+		assert.ErrorContains(t, err, "table privileges for unexpected table number 4")
+	})
+}
+
+
+func Test_findWritePrivilege(t *testing.T) {
+	t.Run("read-only user", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectQuery(`has_table_privilege\(c.oid, 'INSERT, UPDATE, DELETE, TRUNCATE'\)`).
+			WillReturnRows(pgxmock.NewRows([]string{"reason"}))
+
+		reason, err := findWritePrivilege(mock)
+		assert.Nil(t, err)
+		assert.Equal(t, "", reason)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("user that can write", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectQuery(`rolsuper`).
+			WillReturnRows(pgxmock.NewRows([]string{"reason"}).AddRow("it can create objects in schema public"))
+
+		reason, err := findWritePrivilege(mock)
+		assert.Nil(t, err)
+		assert.Equal(t, "it can create objects in schema public", reason)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+}
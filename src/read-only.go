@@ -0,0 +1,184 @@
+// Running user-supplied SQL in read-only transactions
+package main
+
+import "fmt"
+import "regexp"
+import "strings"
+import "github.com/jackc/pgx/v5"
+
+
+var readOnlyTx = pgx.TxOptions{AccessMode: pgx.ReadOnly}
+
+var sqlNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+
+// Splits SQL into statements at top-level semicolons, removing
+// comments outside of quoted strings, identifiers and dollar-quoted
+// bodies. Empty statements are omitted.
+func splitStatements(sql string) ([]string, error) {
+	statements := []string{}
+	var current strings.Builder
+	flush := func() {
+		s := strings.TrimSpace(current.String())
+		if s != "" {
+			statements = append(statements, s)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(sql); {
+		c := sql[i]
+		switch {
+		case c == ';':
+			flush()
+			i++
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			current.WriteByte(' ')
+			i += end
+		case strings.HasPrefix(sql[i:], "/*"):
+			// PostgreSQL's block comments nest
+			depth := 0
+			j := i
+			for ; j < len(sql); j++ {
+				if strings.HasPrefix(sql[j:], "/*") {
+					depth++
+					j++
+				} else if strings.HasPrefix(sql[j:], "*/") {
+					depth--
+					j++
+					if depth == 0 {
+						break
+					}
+				}
+			}
+			if depth != 0 {
+				return nil, fmt.Errorf("unterminated comment")
+			}
+			current.WriteByte(' ')
+			i = j + 1
+		case c == '\'' && i > 0 && (sql[i-1] == 'E' || sql[i-1] == 'e') && (i == 1 || !isIdentifierChar(sql[i-2])):
+			// In an escape string, a backslash escapes the next
+			// character, which may be a quote
+			j := i + 1
+			for ; j < len(sql); j++ {
+				if sql[j] == '\\' {
+					j++
+				} else if sql[j] == '\'' {
+					if j+1 < len(sql) && sql[j+1] == '\'' {
+						j++
+					} else {
+						break
+					}
+				}
+			}
+			if j >= len(sql) {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			current.WriteString(sql[i:j+1])
+			i = j + 1
+		case c == '\'' || c == '"':
+			// A doubled quote is part of the string, and is handled
+			// by treating it as the end of one string and the start
+			// of the next
+			end := strings.IndexByte(sql[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quoted string")
+			}
+			current.WriteString(sql[i:i+end+2])
+			i += end + 2
+		case c == '$':
+			tag := ""
+			if i == 0 || !isIdentifierChar(sql[i-1]) {
+				tag = dollarQuoteTag(sql[i:])
+			}
+			if tag == "" {
+				current.WriteByte(c)
+				i++
+				break
+			}
+			end := strings.Index(sql[i+len(tag):], tag)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated dollar-quoted string")
+			}
+			n := len(tag) + end + len(tag)
+			current.WriteString(sql[i:i+n])
+			i += n
+		default:
+			current.WriteByte(c)
+			i++
+		}
+	}
+	flush()
+	return statements, nil
+}
+
+
+// Returns the tag, such as "$$" or "$body$", that starts s, if any
+func dollarQuoteTag(s string) string {
+	for j := 1; j < len(s); j++ {
+		c := s[j]
+		if c == '$' {
+			return s[:j+1]
+		} else if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || j > 1 && c >= '0' && c <= '9') {
+			return ""
+		}
+	}
+	return ""
+}
+
+
+func isIdentifierChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+
+// A report consists of a definition of the function named in its
+// header, optionally preceded by a statement dropping any existing
+// version. Returns SQL that instead defines the function in the
+// session's temporary schema, so that it is discarded with the
+// transaction and nothing outside pg_temp is changed. Any other
+// statement is rejected, since registration is the only part of
+// running a report that cannot be done in a read-only transaction.
+func scopeReportFunction(sql string, name string) (string, error) {
+	if !sqlNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("bad function name '%s'", name)
+	}
+
+	statements, err := splitStatements(sql)
+	if err != nil {
+		return "", fmt.Errorf("could not parse report: %w", err)
+	}
+
+	quoted := regexp.QuoteMeta(name)
+	dropRegexp := regexp.MustCompile(`(?is)^DROP\s+FUNCTION\s+(IF\s+EXISTS\s+)?("?)` + quoted + `("?)\s*(\(.*\))?$`)
+	createRegexp := regexp.MustCompile(`(?is)^CREATE\s+(OR\s+REPLACE\s+)?FUNCTION\s+("?)` + quoted + `("?)\s*\(`)
+
+	var definition string
+	for _, statement := range statements {
+		if dropRegexp.MatchString(statement) {
+			// There is nothing to drop in a new transaction's pg_temp
+			continue
+		}
+		loc := createRegexp.FindStringSubmatchIndex(statement)
+		if loc != nil && definition == "" {
+			// The name is kept exactly as written, including any quotes
+			definition = "CREATE FUNCTION pg_temp." + statement[loc[4]:loc[7]] + "(" + statement[loc[1]:]
+			continue
+		}
+
+		summary := strings.Join(strings.Fields(statement), " ")
+		if len(summary) > 40 {
+			summary = summary[:40] + "..."
+		}
+		return "", fmt.Errorf("report may only define its function '%s', but contains: %s", name, summary)
+	}
+
+	if definition == "" {
+		return "", fmt.Errorf("report does not define its function '%s'", name)
+	}
+	return definition, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import "testing"
+import "github.com/stretchr/testify/assert"
+
+
+func Test_splitStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		sql string
+		expected []string
+		errorstr string
+	}{
+		{ name: "simple", sql: "SELECT 1; SELECT 2;", expected: []string{"SELECT 1", "SELECT 2"} },
+		{ name: "comments", sql: "-- x; y\nSELECT /* a; /* b; */ c; */ 1", expected: []string{"SELECT   1"} },
+		{ name: "quotes", sql: `SELECT 'a;''b', "c;d"; SELECT 2`, expected: []string{`SELECT 'a;''b', "c;d"`, "SELECT 2"} },
+		{ name: "dollar quotes", sql: "CREATE FUNCTION f() AS $body$ SELECT 1; -- $$ \n$body$; SELECT $1, a$b", expected: []string{"CREATE FUNCTION f() AS $body$ SELECT 1; -- $$ \n$body$", "SELECT $1, a$b"} },
+		{ name: "escape strings", sql: `SELECT E'a\'; b', e'c\\'; SELECT 'd\'; SELECT ''`, expected: []string{`SELECT E'a\'; b', e'c\\'`, `SELECT 'd\'`, `SELECT ''`} },
+		{ name: "escape string with doubled quote", sql: `SELECT E'a''\'; b'; SELECT 2`, expected: []string{`SELECT E'a''\'; b'`, "SELECT 2"} },
+		{ name: "not an escape string", sql: `SELECT type'a\'; SELECT 2`, expected: []string{`SELECT type'a\'`, "SELECT 2"} },
+		{ name: "unterminated string", sql: "SELECT 'a", errorstr: "unterminated quoted string" },
+		{ name: "unterminated escape string", sql: `SELECT E'a\'`, errorstr: "unterminated quoted string" },
+		{ name: "unterminated dollar quote", sql: "SELECT $$ a", errorstr: "unterminated dollar-quoted string" },
+		{ name: "unterminated comment", sql: "SELECT /* a", errorstr: "unterminated comment" },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			statements, err := splitStatements(test.sql)
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, statements)
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+			}
+		})
+	}
+}
+
+
+func Test_scopeReportFunction(t *testing.T) {
+	tests := []struct {
+		name string
+		sql string
+		expected string
+		errorstr string
+	}{
+		{
+			name: "typical report",
+			sql: "--metadb:function count_loans\n\nDROP FUNCTION IF EXISTS count_loans;\n\nCREATE FUNCTION count_loans(\n    start_date date)\nRETURNS bigint\nAS $$\nSELECT count(*) FROM folio_circulation.loan__t; -- really\n$$\nLANGUAGE SQL\nSTABLE;\n",
+			expected: "CREATE FUNCTION pg_temp.count_loans(\n    start_date date)\nRETURNS bigint\nAS $$\nSELECT count(*) FROM folio_circulation.loan__t; -- really\n$$\nLANGUAGE SQL\nSTABLE",
+		},
+		{
+			name: "replacement of quoted name",
+			sql: `CREATE OR REPLACE FUNCTION "count_loans" () RETURNS int AS 'SELECT 1' LANGUAGE SQL`,
+			expected: `CREATE FUNCTION pg_temp."count_loans"() RETURNS int AS 'SELECT 1' LANGUAGE SQL`,
+		},
+		{
+			name: "another function",
+			sql: "CREATE FUNCTION count_loans() RETURNS int AS 'SELECT 1' LANGUAGE SQL; CREATE FUNCTION other() RETURNS int AS 'SELECT 1' LANGUAGE SQL",
+			errorstr: "report may only define its function 'count_loans', but contains: CREATE FUNCTION other() RETURNS int AS '...",
+		},
+		{
+			name: "second definition",
+			sql: "CREATE FUNCTION count_loans() RETURNS int AS 'SELECT 1' LANGUAGE SQL; CREATE FUNCTION count_loans() RETURNS int AS 'SELECT 2' LANGUAGE SQL",
+			errorstr: "but contains: CREATE FUNCTION count_loans()",
+		},
+		{
+			name: "data change",
+			sql: "CREATE TABLE t (x int); CREATE FUNCTION count_loans() RETURNS int AS 'SELECT 1' LANGUAGE SQL",
+			errorstr: "but contains: CREATE TABLE t (x int)",
+		},
+		{
+			name: "statement hidden in escape string",
+			sql: `CREATE FUNCTION count_loans() RETURNS int AS E'select 1 --\'' LANGUAGE sql; INSERT INTO t VALUES (1); --'`,
+			errorstr: "but contains: INSERT INTO t VALUES (1)",
+		},
+		{
+			name: "no definition",
+			sql: "DROP FUNCTION count_loans(date)",
+			errorstr: "report does not define its function 'count_loans'",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			definition, err := scopeReportFunction(test.sql, "count_loans")
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, definition)
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+			}
+		})
+	}
+
+	_, err := scopeReportFunction("", "public.count_loans")
+	assert.ErrorContains(t, err, "bad function name 'public.count_loans'")
+}
@@ -0,0 +1,401 @@
+// Discover relationships between tables, for suggesting joins
+package main
+
+import "context"
+import "fmt"
+import "sort"
+import "strings"
+import "net/http"
+import "github.com/jackc/pgx/v5"
+
+
+// When verifying a relationship, this many non-null values are sampled
+const relationshipSampleSize = 100
+
+
+// A relationship joins a column of the requested table to a column of
+// another table. It is "outgoing" if the requested table refers to the
+// other one, and "incoming" if the other table refers to it.
+type relationship struct {
+	Source string `json:"source"` // "foreignKey" or "convention"
+	Direction string `json:"direction"`
+	Column string `json:"column"`
+	OtherSchema string `json:"otherSchema"`
+	OtherTable string `json:"otherTable"`
+	OtherColumn string `json:"otherColumn"`
+	// The fraction of sampled values that were found in the other
+	// table: only present if verification was requested and possible
+	MatchRatio *float64 `json:"matchRatio,omitempty"`
+	dataType string // of the referring column
+	otherDataType string
+}
+
+
+func handleRelationships(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	v := req.URL.Query()
+	schema := v.Get("schema")
+	table := v.Get("table")
+	if schema == "" || table == "" {
+		return fmt.Errorf("must specify both schema and table")
+	}
+	verify, err := parseBoolParam(v, "verify")
+	if err != nil {
+		return err
+	}
+
+	db, dbConn, err := session.findDbConn(req)
+	if err != nil {
+		return fmt.Errorf("could not find reporting DB: %w", err)
+	}
+
+	rules, err := fetchVisibilityRules(req, session)
+	if err != nil {
+		return err
+	}
+
+	rels, err := findRelationships(db.schemaCache, dbConn, db.isMDB, rules, schema, table)
+	if err != nil {
+		return fmt.Errorf("could not find relationships in reporting DB: %w", err)
+	}
+
+	if verify {
+		err = session.runTagged(w, req, db, dbConn, func(tx pgx.Tx, tag requestTag) error {
+			return verifyRelationships(tx, tag, schema, table, rels)
+		})
+		if err != nil {
+			return fmt.Errorf("could not verify relationships in reporting DB: %w", err)
+		}
+	}
+
+	return sendJSON(w, rels, "relationships")
+}
+
+
+// Only relationships with tables that would be listed by /ldp/db/tables are returned
+func findRelationships(cache *schemaCache, dbConn PgxIface, isMetaDB bool, rules *visibilityRules, schema string, table string) ([]relationship, error) {
+	fks, err := fetchForeignKeys(dbConn, schema, table)
+	if err != nil {
+		return nil, err
+	}
+
+	tables, err := cache.fetchTables(dbConn, isMetaDB, rules)
+	if err != nil {
+		return nil, err
+	}
+	if rules != nil && !containsTable(tables, schema, table) {
+		return nil, fmt.Errorf("table %s.%s is not available", schema, table)
+	}
+
+	inferred, err := inferRelationships(cache, dbConn, isMetaDB, tables, schema, table)
+	if err != nil {
+		return nil, err
+	}
+
+	// Declared foreign keys take precedence over inferred relationships
+	rels := []relationship{}
+	seen := map[string]bool{}
+	for _, rel := range fks {
+		if rules == nil || containsTable(tables, rel.OtherSchema, rel.OtherTable) {
+			rels = append(rels, rel)
+			seen[rel.key()] = true
+		}
+	}
+	for _, rel := range inferred {
+		if !seen[rel.key()] {
+			rels = append(rels, rel)
+			seen[rel.key()] = true
+		}
+	}
+
+	return rels, nil
+}
+
+
+func (rel relationship) key() string {
+	return strings.Join([]string{rel.Direction, rel.Column, rel.OtherSchema, rel.OtherTable, rel.OtherColumn}, "\x00")
+}
+
+
+// Multi-column foreign keys yield one relationship for each column
+func fetchForeignKeys(dbConn PgxIface, schema string, table string) ([]relationship, error) {
+	query := `SELECT 'outgoing' AS direction, a.attname AS column_name,
+		    fn.nspname AS other_schema, fc.relname AS other_table, fa.attname AS other_column
+		FROM pg_constraint con
+		    JOIN pg_class c ON c.oid = con.conrelid
+		    JOIN pg_namespace n ON n.oid = c.relnamespace
+		    JOIN pg_class fc ON fc.oid = con.confrelid
+		    JOIN pg_namespace fn ON fn.oid = fc.relnamespace
+		    CROSS JOIN LATERAL unnest(con.conkey, con.confkey) AS k(attnum, fattnum)
+		    JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+		    JOIN pg_attribute fa ON fa.attrelid = con.confrelid AND fa.attnum = k.fattnum
+		WHERE con.contype = 'f' AND n.nspname = $1 AND c.relname = $2
+		UNION ALL
+		SELECT 'incoming', fa.attname, n.nspname, c.relname, a.attname
+		FROM pg_constraint con
+		    JOIN pg_class c ON c.oid = con.conrelid
+		    JOIN pg_namespace n ON n.oid = c.relnamespace
+		    JOIN pg_class fc ON fc.oid = con.confrelid
+		    JOIN pg_namespace fn ON fn.oid = fc.relnamespace
+		    CROSS JOIN LATERAL unnest(con.conkey, con.confkey) AS k(attnum, fattnum)
+		    JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+		    JOIN pg_attribute fa ON fa.attrelid = con.confrelid AND fa.attnum = k.fattnum
+		WHERE con.contype = 'f' AND fn.nspname = $1 AND fc.relname = $2
+		ORDER BY 1 DESC, 2, 3, 4`
+	rows, err := dbConn.Query(context.Background(), query, schema, table)
+	if err != nil {
+		return nil, fmt.Errorf("could not run query '%s': %w", query, err)
+	}
+	defer rows.Close()
+
+	rels := []relationship{}
+	for rows.Next() {
+		rel := relationship{Source: "foreignKey"}
+		err = rows.Scan(&rel.Direction, &rel.Column, &rel.OtherSchema, &rel.OtherTable, &rel.OtherColumn)
+		if err != nil {
+			return nil, fmt.Errorf("could not read foreign key: %w", err)
+		}
+		rels = append(rels, rel)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read foreign keys: %w", err)
+	}
+	return rels, nil
+}
+
+
+// Strips MetaDB's suffixes for transformed ("__t") and history ("__")
+// tables, so that "item__t" and "item" are both recognised as "item"
+func baseTableName(name string) string {
+	name = strings.TrimSuffix(name, "__")
+	return strings.TrimSuffix(name, "__t")
+}
+
+
+// The column names that, by FOLIO convention, would refer to a table
+// with the specified base name: "users" is referred to by "user_id"
+// and "users_id", and "item" by "item_id"
+func referringColumnNames(base string) []string {
+	names := []string{base + "_id"}
+	if strings.HasSuffix(base, "es") {
+		names = append(names, strings.TrimSuffix(base, "es") + "_id")
+	}
+	if strings.HasSuffix(base, "s") {
+		names = append(names, strings.TrimSuffix(base, "s") + "_id")
+	}
+	return names
+}
+
+
+type catalogueColumn struct {
+	schema string
+	table string
+	column string
+	dataType string
+}
+
+
+// By FOLIO convention, a column called "X_id" refers to the "id"
+// column of a table called "X", or a plural of that. We only consider
+// tables in the specified list, and never MetaDB's history tables,
+// which contain many rows for each id.
+func inferRelationships(cache *schemaCache, dbConn PgxIface, isMetaDB bool, tables []dbTable, schema string, table string) ([]relationship, error) {
+	columns, err := cache.fetchColumns(dbConn, isMetaDB, schema, table)
+	if err != nil {
+		return nil, err
+	}
+
+	others := []dbTable{}
+	for _, t := range tables {
+		if !strings.HasSuffix(t.TableName, "__") && !(t.SchemaName == schema && t.TableName == table) {
+			others = append(others, t)
+		}
+	}
+
+	// Which other tables might be referred to by each of our columns?
+	targets := map[string][]dbTable{}
+	for _, t := range others {
+		for _, name := range referringColumnNames(baseTableName(t.TableName)) {
+			targets[name] = append(targets[name], t)
+		}
+	}
+
+	candidates := []dbTable{}
+	ourIdType := ""
+	for _, col := range columns {
+		candidates = append(candidates, targets[col.ColumnName]...)
+		if col.ColumnName == "id" {
+			ourIdType = col.DataType
+		}
+	}
+
+	// In a single query, find the "id" columns of all candidate
+	// tables, and the columns in any table that might refer to ours
+	referringNames := []string{}
+	if ourIdType != "" {
+		referringNames = referringColumnNames(baseTableName(table))
+	}
+	found, err := fetchCatalogueColumns(dbConn, candidates, others, referringNames)
+	if err != nil {
+		return nil, err
+	}
+
+	idTypes := map[string]string{}
+	for _, c := range found {
+		if c.column == "id" {
+			idTypes[c.schema + "." + c.table] = c.dataType
+		}
+	}
+
+	rels := []relationship{}
+	for _, col := range columns {
+		for _, t := range targets[col.ColumnName] {
+			idType, ok := idTypes[t.SchemaName + "." + t.TableName]
+			if ok {
+				rels = append(rels, relationship{
+					Source: "convention",
+					Direction: "outgoing",
+					Column: col.ColumnName,
+					OtherSchema: t.SchemaName,
+					OtherTable: t.TableName,
+					OtherColumn: "id",
+					dataType: col.DataType,
+					otherDataType: idType,
+				})
+			}
+		}
+	}
+	for _, c := range found {
+		if c.column != "id" {
+			rels = append(rels, relationship{
+				Source: "convention",
+				Direction: "incoming",
+				Column: "id",
+				OtherSchema: c.schema,
+				OtherTable: c.table,
+				OtherColumn: c.column,
+				dataType: c.dataType,
+				otherDataType: ourIdType,
+			})
+		}
+	}
+
+	return rels, nil
+}
+
+
+func fetchCatalogueColumns(dbConn PgxIface, idTables []dbTable, tables []dbTable, names []string) ([]catalogueColumn, error) {
+	idSchemas, idNames := splitTables(idTables)
+	schemas, tableNames := splitTables(tables)
+	query := `SELECT c.table_schema, c.table_name, c.column_name, c.data_type
+		FROM information_schema.columns c
+		WHERE (c.column_name = 'id' AND (c.table_schema, c.table_name) IN
+		        (SELECT * FROM unnest($1::text[], $2::text[])))
+		    OR (c.column_name = ANY($5) AND (c.table_schema, c.table_name) IN
+		        (SELECT * FROM unnest($3::text[], $4::text[])))
+		ORDER BY c.table_schema, c.table_name, c.column_name`
+	rows, err := dbConn.Query(context.Background(), query, idSchemas, idNames, schemas, tableNames, names)
+	if err != nil {
+		return nil, fmt.Errorf("could not run query '%s': %w", query, err)
+	}
+	defer rows.Close()
+
+	result := []catalogueColumn{}
+	for rows.Next() {
+		var c catalogueColumn
+		err = rows.Scan(&c.schema, &c.table, &c.column, &c.dataType)
+		if err != nil {
+			return nil, fmt.Errorf("could not read column: %w", err)
+		}
+		result = append(result, c)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read columns: %w", err)
+	}
+	return result, nil
+}
+
+
+func splitTables(tables []dbTable) ([]string, []string) {
+	schemas := make([]string, len(tables))
+	names := make([]string, len(tables))
+	for i, t := range tables {
+		schemas[i] = t.SchemaName
+		names[i] = t.TableName
+	}
+	return schemas, names
+}
+
+
+// Samples non-null values from the referring column, and determines
+// what fraction of them are found in the referred-to column. Inferred
+// relationships can only be verified when both columns are of the same
+// type; PostgreSQL guarantees that foreign keys are comparable. Nor
+// can they be verified if the user may not read one of the tables,
+// which is listed because of a foreign key or the visibility rules:
+// this is checked first, since all the queries run in one transaction,
+// which an error would abort.
+// Relationships are then sorted with the best-verified first, though
+// declared foreign keys always come before inferred relationships.
+func verifyRelationships(dbConn queryer, tag requestTag, schema string, table string, rels []relationship) error {
+	for i := range rels {
+		rel := &rels[i]
+		if rel.Source != "foreignKey" && rel.dataType != rel.otherDataType {
+			continue
+		}
+
+		us := pgx.Identifier{schema, table}.Sanitize()
+		them := pgx.Identifier{rel.OtherSchema, rel.OtherTable}.Sanitize()
+		ourCol := pgx.Identifier{rel.Column}.Sanitize()
+		theirCol := pgx.Identifier{rel.OtherColumn}.Sanitize()
+		fromTable, fromCol, toTable, toCol := us, ourCol, them, theirCol
+		fromName, toName := rel.Column, rel.OtherColumn
+		if rel.Direction == "incoming" {
+			fromTable, fromCol, toTable, toCol = them, theirCol, us, ourCol
+			fromName, toName = rel.OtherColumn, rel.Column
+		}
+
+		var readable bool
+		check := "SELECT has_column_privilege($1, $2, 'SELECT') AND has_column_privilege($3, $4, 'SELECT')"
+		err := dbConn.QueryRow(context.Background(), tag.comment() + check, fromTable, fromName, toTable, toName).Scan(&readable)
+		if err != nil {
+			return fmt.Errorf("could not run query '%s': %w", check, err)
+		} else if !readable {
+			continue
+		}
+
+		query := fmt.Sprintf(`SELECT count(*), count(*) FILTER (WHERE EXISTS
+			    (SELECT 1 FROM %s t WHERE t.%s = s.v))
+			FROM (SELECT %s AS v FROM %s WHERE %s IS NOT NULL LIMIT %d) s`,
+			toTable, toCol, fromCol, fromTable, fromCol, relationshipSampleSize)
+		var sampled, matched int64
+		err = dbConn.QueryRow(context.Background(), tag.comment() + query).Scan(&sampled, &matched)
+		if err != nil {
+			return fmt.Errorf("could not run query '%s': %w", query, err)
+		}
+		if sampled > 0 {
+			ratio := float64(matched) / float64(sampled)
+			rel.MatchRatio = &ratio
+		}
+	}
+
+	sort.SliceStable(rels, func(i, j int) bool {
+		if rels[i].Source != rels[j].Source {
+			return rels[i].Source == "foreignKey"
+		}
+		return matchRatio(rels[i]) > matchRatio(rels[j])
+	})
+	return nil
+}
+
+
+// Unverified relationships sort after those with no matches at all
+func matchRatio(rel relationship) float64 {
+	if rel.MatchRatio == nil {
+		return -1
+	}
+	return *rel.MatchRatio
+}
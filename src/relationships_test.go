@@ -0,0 +1,171 @@
+package main
+
+import "testing"
+import "time"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func establishMockForColumnPrivileges(mock pgxmock.PgxPoolIface, fromTable string, fromColumn string, toTable string, toColumn string, readable bool) {
+	mock.ExpectQuery(`SELECT has_column_privilege\(\$1, \$2, 'SELECT'\) AND has_column_privilege\(\$3, \$4, 'SELECT'\)`).
+		WithArgs(fromTable, fromColumn, toTable, toColumn).
+		WillReturnRows(pgxmock.NewRows([]string{"readable"}).AddRow(readable))
+}
+
+
+func Test_relationshipConventions(t *testing.T) {
+	assert.Equal(t, "item", baseTableName("item"))
+	assert.Equal(t, "item", baseTableName("item__t"))
+	assert.Equal(t, "item", baseTableName("item__"))
+	assert.Equal(t, "item", baseTableName("item__t__"))
+	assert.Equal(t, []string{"item_id"}, referringColumnNames("item"))
+	assert.Equal(t, []string{"users_id", "user_id"}, referringColumnNames("users"))
+	assert.Equal(t, []string{"addresses_id", "address_id", "addresse_id"}, referringColumnNames("addresses"))
+}
+
+
+// When cached, the schema cache first checks MetaDB for updates
+func establishMockForRelationships(mock pgxmock.PgxPoolIface, cached bool) {
+	mock.ExpectQuery(`SELECT 'outgoing'`).
+		WithArgs("folio_circulation", "loan").
+		WillReturnRows(pgxmock.NewRows([]string{"direction", "column_name", "other_schema", "other_table", "other_column"}))
+	if cached {
+		establishMockForLastUpdate(mock, time.Now())
+	}
+	mock.ExpectQuery("SELECT schema_name, table_name FROM metadb.base_table").
+		WillReturnRows(pgxmock.NewRows([]string{"schema_name", "table_name"}).
+			AddRow("folio_circulation", "loan").
+			AddRow("folio_circulation", "loan__").
+			AddRow("folio_inventory", "item").
+			AddRow("folio_inventory", "item__").
+			AddRow("folio_users", "users").
+			AddRow("folio_feesfines", "accounts"))
+	establishMockForReadableTables(mock, 1, 2, 3, 4, 5, 6)
+	mock.ExpectQuery(`SELECT c.column_name`).
+		WithArgs("folio_circulation", "loan").
+		WillReturnRows(pgxmock.NewRows([]string{"column_name", "data_type", "ordinal_position", "table_schema", "table_name",
+			"is_nullable", "column_default", "comment", "is_primary_key", "indexes", "element_type", "is_json"}).
+			AddRow("id", "uuid", "1", "folio_circulation", "loan", false, nil, nil, true, []string{}, nil, false).
+			AddRow("item_id", "uuid", "2", "folio_circulation", "loan", true, nil, nil, false, []string{}, nil, false).
+			AddRow("user_id", "uuid", "3", "folio_circulation", "loan", true, nil, nil, false, []string{}, nil, false))
+	mock.ExpectQuery(`SELECT c.table_schema, c.table_name, c.column_name, c.data_type`).
+		WithArgs([]string{"folio_inventory", "folio_users"}, []string{"item", "users"},
+			[]string{"folio_inventory", "folio_users", "folio_feesfines"}, []string{"item", "users", "accounts"},
+			[]string{"loan_id"}).
+		WillReturnRows(pgxmock.NewRows([]string{"table_schema", "table_name", "column_name", "data_type"}).
+			AddRow("folio_feesfines", "accounts", "loan_id", "uuid").
+			AddRow("folio_inventory", "item", "id", "uuid").
+			AddRow("folio_users", "users", "id", "text"))
+}
+
+
+func Test_relationships(t *testing.T) {
+	t.Run("find", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		establishMockForRelationships(mock, false)
+
+		rels, err := findRelationships(nil, mock, true, nil, "folio_circulation", "loan")
+		assert.Nil(t, err)
+		assert.Equal(t, []relationship{
+			{ Source: "convention", Direction: "outgoing", Column: "item_id", OtherSchema: "folio_inventory", OtherTable: "item", OtherColumn: "id", dataType: "uuid", otherDataType: "uuid" },
+			{ Source: "convention", Direction: "outgoing", Column: "user_id", OtherSchema: "folio_users", OtherTable: "users", OtherColumn: "id", dataType: "uuid", otherDataType: "text" },
+			{ Source: "convention", Direction: "incoming", Column: "id", OtherSchema: "folio_feesfines", OtherTable: "accounts", OtherColumn: "loan_id", dataType: "uuid", otherDataType: "uuid" },
+		}, rels)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("foreign keys take precedence", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectQuery(`SELECT 'outgoing'`).
+			WithArgs("folio_circulation", "loan").
+			WillReturnRows(pgxmock.NewRows([]string{"direction", "column_name", "other_schema", "other_table", "other_column"}).
+				AddRow("outgoing", "item_id", "folio_inventory", "item", "id"))
+		mock.ExpectQuery("SELECT schema_name, table_name FROM metadb.base_table").
+			WillReturnRows(pgxmock.NewRows([]string{"schema_name", "table_name"}).
+				AddRow("folio_inventory", "item"))
+		establishMockForReadableTables(mock, 1)
+		mock.ExpectQuery(`SELECT c.column_name`).
+			WithArgs("folio_circulation", "loan").
+			WillReturnRows(pgxmock.NewRows([]string{"column_name", "data_type", "ordinal_position", "table_schema", "table_name",
+				"is_nullable", "column_default", "comment", "is_primary_key", "indexes", "element_type", "is_json"}).
+				AddRow("item_id", "uuid", "2", "folio_circulation", "loan", true, nil, nil, false, []string{}, nil, false))
+		mock.ExpectQuery(`SELECT c.table_schema, c.table_name, c.column_name, c.data_type`).
+			WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), []string{}).
+			WillReturnRows(pgxmock.NewRows([]string{"table_schema", "table_name", "column_name", "data_type"}).
+				AddRow("folio_inventory", "item", "id", "uuid"))
+
+		rels, err := findRelationships(nil, mock, true, nil, "folio_circulation", "loan")
+		assert.Nil(t, err)
+		assert.Equal(t, []relationship{
+			{ Source: "foreignKey", Direction: "outgoing", Column: "item_id", OtherSchema: "folio_inventory", OtherTable: "item", OtherColumn: "id" },
+		}, rels)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("verify", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		establishMockForRelationships(mock, true)
+		mock.ExpectBeginTx(readOnlyTx)
+		establishMockForTag(mock)
+		establishMockForColumnPrivileges(mock, `"folio_circulation"."loan"`, "item_id", `"folio_inventory"."item"`, "id", true)
+		mock.ExpectQuery(`^/\* mod-reporting tenant=dummyTenant .*FROM "folio_inventory"."item" t WHERE t."id" = s.v.*SELECT "item_id" AS v FROM "folio_circulation"."loan"`).
+			WillReturnRows(pgxmock.NewRows([]string{"count", "count"}).AddRow(int64(100), int64(100)))
+		establishMockForColumnPrivileges(mock, `"folio_feesfines"."accounts"`, "loan_id", `"folio_circulation"."loan"`, "id", true)
+		mock.ExpectQuery(`FROM "folio_circulation"."loan" t WHERE t."id" = s.v.*SELECT "loan_id" AS v FROM "folio_feesfines"."accounts"`).
+			WillReturnRows(pgxmock.NewRows([]string{"count", "count"}).AddRow(int64(10), int64(5)))
+		mock.ExpectRollback()
+
+		req := httptest.NewRequest("GET", "/ldp/db/relationships?schema=folio_circulation&table=loan&verify=true", nil)
+		w := httptest.NewRecorder()
+		ts := MakeDummyModSettingsServer()
+		defer ts.Close()
+		mrs, err := MakeConfiguredServer("../etc/silent.json", ".")
+		assert.Nil(t, err)
+		session, err := NewModReportingSession(mrs, ts.URL, "dummyTenant")
+		assert.Nil(t, err)
+		useMockDb(session, mock)
+		err = handleRelationships(w, req, session)
+		assert.Nil(t, err)
+		assert.Equal(t, `[` +
+			`{"source":"convention","direction":"outgoing","column":"item_id","otherSchema":"folio_inventory","otherTable":"item","otherColumn":"id","matchRatio":1},` +
+			`{"source":"convention","direction":"incoming","column":"id","otherSchema":"folio_feesfines","otherTable":"accounts","otherColumn":"loan_id","matchRatio":0.5},` +
+			`{"source":"convention","direction":"outgoing","column":"user_id","otherSchema":"folio_users","otherTable":"users","otherColumn":"id"}` +
+			`]`, w.Body.String())
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("verify unreadable table", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		establishMockForColumnPrivileges(mock, `"folio_circulation"."loan"`, "item_id", `"folio_inventory"."item"`, "id", false)
+		establishMockForColumnPrivileges(mock, `"folio_feesfines"."accounts"`, "loan_id", `"folio_circulation"."loan"`, "id", true)
+		mock.ExpectQuery(`FROM "folio_circulation"."loan" t WHERE t."id" = s.v`).
+			WillReturnRows(pgxmock.NewRows([]string{"count", "count"}).AddRow(int64(10), int64(5)))
+
+		rels := []relationship{
+			{ Source: "convention", Direction: "outgoing", Column: "item_id", OtherSchema: "folio_inventory", OtherTable: "item", OtherColumn: "id" },
+			{ Source: "convention", Direction: "incoming", Column: "id", OtherSchema: "folio_feesfines", OtherTable: "accounts", OtherColumn: "loan_id" },
+		}
+		err = verifyRelationships(mock, requestTag{}, "folio_circulation", "loan", rels)
+		assert.Nil(t, err)
+		assert.Equal(t, "folio_feesfines", rels[0].OtherSchema)
+		assert.Equal(t, 0.5, *rels[0].MatchRatio)
+		assert.Equal(t, "folio_inventory", rels[1].OtherSchema)
+		assert.Nil(t, rels[1].MatchRatio)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("missing table", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/ldp/db/relationships?schema=folio_circulation", nil)
+		err := handleRelationships(httptest.NewRecorder(), req, &ModReportingSession{})
+		assert.ErrorContains(t, err, "must specify both schema and table")
+	})
+}
@@ -5,6 +5,7 @@ import "io"
 import "strings"
 import "fmt"
 import "regexp"
+import "time"
 import "net/http"
 import "encoding/json"
 import "github.com/jackc/pgx/v5"
@@ -30,6 +31,14 @@ func isMetaDB(dbConn PgxIface) (bool, error) {
 type dbTable struct {
 	SchemaName string `db:"schema_name" json:"tableSchema"`
 	TableName string `db:"table_name" json:"tableName"`
+	// The remaining fields are included only when details are requested
+	Kind string `db:"-" json:"kind,omitempty"`
+	Comment *string `db:"-" json:"comment,omitempty"`
+	EstimatedRows *int64 `db:"-" json:"estimatedRows,omitempty"`
+	Size *int64 `db:"-" json:"size,omitempty"`
+	LastUpdate *time.Time `db:"-" json:"lastUpdate,omitempty"`
+	// Included only when inaccessible tables are requested
+	Accessible *bool `db:"-" json:"accessible,omitempty"`
 }
 
 type dbColumn struct {
@@ -38,24 +47,72 @@ type dbColumn struct {
 	TableSchema string `db:"table_schema" json:"tableSchema"`
 	TableName string `db:"table_name" json:"tableName"`
 	OrdinalPosition string `db:"ordinal_position" json:"ordinalPosition"`
+	IsNullable bool `db:"is_nullable" json:"isNullable"`
+	Default *string `db:"column_default" json:"default,omitempty"`
+	Comment *string `db:"comment" json:"comment,omitempty"`
+	IsPrimaryKey bool `db:"is_primary_key" json:"isPrimaryKey"`
+	Indexes []string `db:"indexes" json:"indexes"` // names of indexes that include this column
+	ElementType *string `db:"element_type" json:"elementType,omitempty"` // for arrays only
+	IsJSON bool `db:"is_json" json:"isJson"` // json or jsonb, such as MetaDB's "data" columns
 }
 
 
 func handleTables(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
-	dbConn, err := session.findDbConn(req.Header.Get("X-Okapi-Token"))
+	db, dbConn, err := session.findDbConn(req)
 	if err != nil {
 		return fmt.Errorf("could not find reporting DB: %w", err)
 	}
-	tables, err := fetchTables(dbConn, session.isMDB)
+	detail, err := parseBoolParam(req.URL.Query(), "detail")
+	if err != nil {
+		return err
+	}
+	inaccessible, err := parseBoolParam(req.URL.Query(), "inaccessible")
+	if err != nil {
+		return err
+	}
+
+	rules, err := fetchVisibilityRules(req, session)
+	if err != nil {
+		return err
+	}
+
+	var tables []dbTable
+	if inaccessible {
+		tables, err = fetchCatalogue(dbConn, db.isMDB, rules)
+		if err == nil {
+			err = markReadableTables(dbConn, tables)
+		}
+	} else {
+		tables, err = db.schemaCache.fetchTables(dbConn, db.isMDB, rules)
+	}
 	if err != nil {
 		return fmt.Errorf("could not fetch tables from reporting DB: %w", err)
 	}
 
+	if detail {
+		err = addTableDetails(dbConn, db.isMDB, tables)
+		if err != nil {
+			return fmt.Errorf("could not fetch table details from reporting DB: %w", err)
+		}
+	}
+
 	return sendJSON(w, tables, "tables")
 }
 
 
-func fetchTables(dbConn PgxIface, isMetaDB bool) ([]dbTable, error) {
+// Only tables that the database user can read are listed, so that
+// users are not offered tables that they will not be able to query
+func fetchTables(dbConn PgxIface, isMetaDB bool, rules *visibilityRules) ([]dbTable, error) {
+	tables, err := fetchCatalogue(dbConn, isMetaDB, rules)
+	if err != nil {
+		return nil, err
+	}
+	return readableTables(dbConn, tables)
+}
+
+
+// The default catalogue is modified by the visibility rules, if any
+func fetchCatalogue(dbConn PgxIface, isMetaDB bool, rules *visibilityRules) ([]dbTable, error) {
 	var query string
 	if isMetaDB {
 		query = `SELECT schema_name, table_name FROM metadb.base_table
@@ -75,7 +132,11 @@ func fetchTables(dbConn PgxIface, isMetaDB bool) ([]dbTable, error) {
 	}
 	defer rows.Close()
 
-	return pgx.CollectRows(rows, pgx.RowToStructByName[dbTable])
+	tables, err := pgx.CollectRows(rows, pgx.RowToStructByName[dbTable])
+	if err != nil || rules == nil {
+		return tables, err
+	}
+	return rules.apply(dbConn, tables)
 }
 
 
@@ -87,11 +148,20 @@ func handleColumns(w http.ResponseWriter, req *http.Request, session *ModReporti
 		return fmt.Errorf("must specify both schema and table")
 	}
 
-	dbConn, err := session.findDbConn(req.Header.Get("X-Okapi-Token"))
+	db, dbConn, err := session.findDbConn(req)
 	if err != nil {
 		return fmt.Errorf("could not find reporting DB: %w", err)
 	}
-	columns, err := fetchColumns(dbConn, schema, table)
+	rules, err := fetchVisibilityRules(req, session)
+	if err != nil {
+		return err
+	}
+	err = checkTableVisible(db.schemaCache, dbConn, db.isMDB, rules, schema, table)
+	if err != nil {
+		return err
+	}
+
+	columns, err := db.schemaCache.fetchColumns(dbConn, db.isMDB, schema, table)
 	if err != nil {
 		return fmt.Errorf("could not fetch columns from reporting DB: %w", err)
 	}
@@ -101,21 +171,32 @@ func handleColumns(w http.ResponseWriter, req *http.Request, session *ModReporti
 
 
 func fetchColumns(dbConn PgxIface, schema string, table string) ([]dbColumn, error) {
-	// This seems to work for both MetaDB and LDP Classic
-	cols := "column_name, data_type, ordinal_position, table_schema, table_name"
-	query := "SELECT " + cols + " FROM information_schema.columns " +
-		"WHERE table_schema = $1 AND table_name = $2 AND column_name != $3"
-	rows, err := dbConn.Query(context.Background(), query, schema, table, "data")
+	// This seems to work for both MetaDB and LDP Classic. The basic
+	// information comes from information_schema, which is standard,
+	// and the rest from the PostgreSQL catalogue
+	query := `SELECT c.column_name, c.data_type, c.ordinal_position, c.table_schema, c.table_name,
+		    c.is_nullable = 'YES' AS is_nullable,
+		    c.column_default,
+		    col_description(a.attrelid, a.attnum) AS comment,
+		    EXISTS (SELECT 1 FROM pg_index i
+		        WHERE i.indrelid = a.attrelid AND i.indisprimary AND a.attnum = ANY(i.indkey)) AS is_primary_key,
+		    ARRAY(SELECT ic.relname::text FROM pg_index i JOIN pg_class ic ON ic.oid = i.indexrelid
+		        WHERE i.indrelid = a.attrelid AND a.attnum = ANY(i.indkey) ORDER BY ic.relname) AS indexes,
+		    CASE WHEN t.typcategory = 'A' THEN format_type(t.typelem, NULL) END AS element_type,
+		    t.typname IN ('json', 'jsonb') AS is_json
+		FROM information_schema.columns c
+		    JOIN pg_namespace n ON n.nspname = c.table_schema
+		    JOIN pg_class r ON r.relnamespace = n.oid AND r.relname = c.table_name
+		    JOIN pg_attribute a ON a.attrelid = r.oid AND a.attname = c.column_name
+		    JOIN pg_type t ON t.oid = a.atttypid
+		WHERE c.table_schema = $1 AND c.table_name = $2
+		    AND has_column_privilege(r.oid, a.attnum, 'SELECT')
+		ORDER BY c.ordinal_position`
+	rows, err := dbConn.Query(context.Background(), query, schema, table)
 	if err != nil {
 		return nil, fmt.Errorf("could not run query '%s': %w", query, err)
 	}
 	defer rows.Close()
-	/*
-	for rows.Next() {
-		val, _ := rows.Values()
-		fmt.Printf("column 3: %T, %+v\n", val[2], val[2])
-	}
-	*/
 
 	return pgx.CollectRows(rows, pgx.RowToStructByName[dbColumn])
 }
@@ -140,6 +221,8 @@ type queryTable struct {
 	Columns []string `json:"showColumns"`
 	Order []queryOrder `json:"orderBy"`
 	Limit int `json:"limit"`
+	AsOf string `json:"asOf"` // MetaDB history tables only
+	CurrentOnly bool `json:"currentOnly"` // MetaDB history tables only
 }
 
 type jsonQuery struct {
@@ -148,7 +231,12 @@ type jsonQuery struct {
 
 
 func handleQuery(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
-	dbConn, err := session.findDbConn(req.Header.Get("X-Okapi-Token"))
+	opts, err := parseOutputOptions(req)
+	if err != nil {
+		return err
+	}
+
+	db, dbConn, err := session.findDbConn(req)
 	if err != nil {
 		return fmt.Errorf("could not find reporting DB: %w", err)
 	}
@@ -163,39 +251,113 @@ func handleQuery(w http.ResponseWriter, req *http.Request, session *ModReporting
 		return fmt.Errorf("could not deserialize JSON from body: %w", err)
 	}
 
-	sql, params, err := makeSql(query)
+	sql, params, err := makeSql(query, db.isMDB)
 	if err != nil {
 		return fmt.Errorf("could not generate SQL from JSON query: %w", err)
 	}
 
+	rules, err := fetchVisibilityRules(req, session)
+	if err != nil {
+		return err
+	}
+	qt := query.Tables[0]
+	err = checkTableVisible(db.schemaCache, dbConn, db.isMDB, rules, qt.Schema, qt.Table)
+	if err != nil {
+		return err
+	}
+	// Column names and filter keys could contain subqueries
+	err = checkSqlVisibility(db.schemaCache, dbConn, db.isMDB, rules, sql)
+	if err != nil {
+		return err
+	}
+
+	release, err := session.waitToRun(req.Context(), w, db)
+	if err != nil {
+		return fmt.Errorf("could not run query: %w", err)
+	}
+	defer release()
+
 	session.Log("sql", sql, fmt.Sprintf("%v", params))
-	rows, err := dbConn.Query(context.Background(), sql, params...)
+	tx, err := dbConn.BeginTx(context.Background(), readOnlyTx)
+	if err != nil {
+		return fmt.Errorf("could not open transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	tag := makeRequestTag(req, session)
+	err = tag.apply(tx, db)
+	if err != nil {
+		return err
+	}
+
+	var columns []resultColumn
+	if opts.Envelope {
+		columns, err = describeResult(tx, tag.comment() + sql)
+		if err != nil {
+			return fmt.Errorf("could not describe columns of query result: %w", err)
+		}
+	}
+
+	rows, err := tx.Query(context.Background(), tag.comment() + sql, params...)
 	if err != nil {
 		return fmt.Errorf("could not execute SQL from JSON query: %w", err)
 	}
 
-	result, err := collectAndFixRows(rows)
+	if opts.streaming() {
+		return streamRows(w, rows, opts, false, columns)
+	}
+
+	result, err := collectAndFixRows(rows, opts)
 	if err != nil {
 		return err
 	}
 
+	if opts.Envelope {
+		response := reportResponse{
+			Columns: columns,
+			TotalRecords: len(result),
+			Records: result,
+		}
+		return sendJSON(w, response, "query result")
+	}
+
 	return sendJSON(w, result, "query result")
 }
 
 
-func makeSql(query jsonQuery) (string, []any, error) {
+func makeSql(query jsonQuery, isMetaDB bool) (string, []any, error) {
 	if len(query.Tables) != 1 {
 		return "", nil, fmt.Errorf("query must have exactly one table")
 	}
 	qt := query.Tables[0]
 
-	sql := "SELECT " + makeColumns(qt.Columns) + ` FROM "` + qt.Schema + `"."` + qt.Table + `"`
-	filterString, params := makeCond(qt.Filters)
+	columns, err := makeColumns(qt.Columns)
+	if err != nil {
+		return "", nil, err
+	}
+	sql := "SELECT " + columns + " FROM " + pgx.Identifier{qt.Schema, qt.Table}.Sanitize()
+	filterString, params, err := makeCond(qt.Filters)
+	if err != nil {
+		return "", nil, err
+	}
+	historyCond, params, err := makeHistoryCond(qt, isMetaDB, params)
+	if err != nil {
+		return "", nil, err
+	}
+	if historyCond != "" && filterString != "" {
+		filterString += " AND " + historyCond
+	} else if historyCond != "" {
+		filterString = historyCond
+	}
 	if filterString != "" {
 		sql += " WHERE " + filterString
 	}
 	if len(qt.Order) > 0 {
-		sql += " ORDER BY " + makeOrder(qt.Order)
+		order, err := makeOrder(qt.Order)
+		if err != nil {
+			return "", nil, err
+		}
+		sql += " ORDER BY " + order
 	}
 	if qt.Limit != 0 {
 		sql += fmt.Sprintf(" LIMIT %d", qt.Limit)
@@ -205,68 +367,106 @@ func makeSql(query jsonQuery) (string, []any, error) {
 }
 
 
-func makeColumns(cols []string) string {
+// Selected JSON paths are named after the paths themselves, so that
+// each appears in the results under the key that was asked for
+func makeColumns(cols []string) (string, error) {
 	if len(cols) == 0 {
-		return "*"
+		return "*", nil
 	}
 
 	s := ""
 	for i, col := range(cols) {
-		s += col
+		key, isPath, err := parseQueryKey(col)
+		if err != nil {
+			return "", err
+		}
+		s += key
+		if isPath {
+			s += " AS " + pgx.Identifier{key}.Sanitize()
+		}
 		if i < len(cols)-1 {
 			s += ", "
 		}
 	}
 
-	return s
+	return s, nil
+}
+
+
+// The operators that filters may use, and whether each takes a value.
+// Anything else could smuggle arbitrary SQL into the query.
+var filterOperators = map[string]bool{
+	"=": true, "<>": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+	"LIKE": true, "ILIKE": true, "NOT LIKE": true, "NOT ILIKE": true,
+	"IS NULL": false, "IS NOT NULL": false,
 }
 
 
-func makeCond(filters []queryFilter) (string, []any) {
+func makeCond(filters []queryFilter) (string, []any, error) {
 	params := make([]any, 0)
 
 	s := ""
-	for i, filter := range(filters) {
+	for _, filter := range(filters) {
 		if filter.Key == "" {
 			continue
 		}
+		key, _, err := parseQueryKey(filter.Key)
+		if err != nil {
+			return "", nil, err
+		}
+		op := "="
+		if filter.Op != "" {
+			op = strings.Join(strings.Fields(strings.ToUpper(filter.Op)), " ")
+		}
+		hasValue, ok := filterOperators[op]
+		if !ok {
+			return "", nil, fmt.Errorf("unsupported filter operator '%s'", filter.Op)
+		}
 		if s != "" {
 			s += " AND "
 		}
-		s += filter.Key
-		if filter.Op == "" {
-			s += " = "
-		} else {
-			s += " " + filter.Op + " "
+		s += key + " " + op
+		if hasValue {
+			// Numbered by parameter, not by filter, since empty filters are skipped
+			params = append(params, filter.Value)
+			s += fmt.Sprintf(" $%d", len(params))
 		}
-		s += fmt.Sprintf("$%d", i+1)
-
-		params = append(params, filter.Value)
 	}
 
-	return s, params
+	return s, params, nil
 }
 
 
-func makeOrder(orders []queryOrder) string {
+func makeOrder(orders []queryOrder) (string, error) {
 	s := ""
 	for i, order := range(orders) {
-		s += order.Key
-		s += " " + order.Direction
+		key, _, err := parseQueryKey(order.Key)
+		if err != nil {
+			return "", err
+		}
+		s += key
+		direction := strings.ToLower(order.Direction)
+		if direction == "asc" || direction == "desc" {
+			s += " " + direction
+		} else if direction != "" {
+			return "", fmt.Errorf("unsupported order direction '%s'", order.Direction)
+		}
 		// Historically, ui-ldp sends "start" or "end"
 		// But we also want to support PostgreSQL's own "FIRST" and "LAST"
-		if strings.EqualFold(order.Nulls, "first") ||
-			strings.EqualFold(order.Nulls, "start") {
+		switch strings.ToLower(order.Nulls) {
+		case "first", "start":
 			s += " NULLS FIRST"
-		} else {
+		case "", "last", "end":
 			s += " NULLS LAST"
+		default:
+			return "", fmt.Errorf("unsupported nulls position '%s'", order.Nulls)
 		}
 		if i < len(orders)-1 {
 			s += ", "
 		}
 	}
 
-	return s
+	return s, nil
 }
 
 
@@ -276,13 +476,20 @@ type reportQuery struct {
 	Limit int `json:"limit"`
 }
 
+// Also used for query results when column descriptions are requested
 type reportResponse struct {
+	Columns []resultColumn `json:"columns,omitempty"`
 	TotalRecords int `json:"totalRecords"`
 	Records []map[string]any `json:"records"`
 }
 
 func handleReport(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
-	dbConn, err := session.findDbConn(req.Header.Get("X-Okapi-Token"))
+	opts, err := parseOutputOptions(req)
+	if err != nil {
+		return err
+	}
+
+	db, dbConn, err := session.findDbConn(req)
 	if err != nil {
 		return fmt.Errorf("could not find reporting DB: %w", err)
 	}
@@ -317,45 +524,99 @@ func handleReport(w http.ResponseWriter, req *http.Request, session *ModReportin
 	}
 	sql := string(bytes)
 
-	if session.isMDB && strings.HasPrefix(sql, "--ldp:function") {
+	if db.isMDB && strings.HasPrefix(sql, "--ldp:function") {
 		return fmt.Errorf("cannot run LDP Classic report in MetaDB")
-	} else if !session.isMDB && strings.HasPrefix(sql, "--metadb:function") {
+	} else if !db.isMDB && strings.HasPrefix(sql, "--metadb:function") {
 		return fmt.Errorf("cannot run MetaDB report in LDP Classic")
 	}
 
-	if !session.isMDB {
-		// LDP Classic needs this, for some reason
-		sql = "SET search_path = local, public;\n" + sql
+	rules, err := fetchVisibilityRules(req, session)
+	if err != nil {
+		return err
+	}
+	err = checkSqlVisibility(db.schemaCache, dbConn, db.isMDB, rules, sql)
+	if err != nil {
+		return fmt.Errorf("report may not be run: %w", err)
 	}
 
-	cmd, err := makeFunctionCall(sql, query.Params, query.Limit)
+	name, err := reportFunctionName(sql)
+	if err != nil {
+		return err
+	}
+	definition, err := scopeReportFunction(sql, name)
+	if err != nil {
+		return fmt.Errorf("report may not be run: %w", err)
+	}
+	cmd, err := makeFunctionCall(name, query.Params, query.Limit)
 	if err != nil {
 		return fmt.Errorf("could not construct SQL function call: %w", err)
 	}
 
+	release, err := session.waitToRun(req.Context(), w, db)
+	if err != nil {
+		return fmt.Errorf("could not run report: %w", err)
+	}
+	defer release()
+
 	tx, err := dbConn.Begin(context.Background())
 	if err != nil {
 		return fmt.Errorf("could not open transaction: %w", err)
 	}
 	defer tx.Rollback(context.Background())
 
-	_, err = tx.Exec(context.Background(), sql)
+	tag := makeRequestTag(req, session)
+	err = tag.apply(tx, db)
+	if err != nil {
+		return err
+	}
+
+	if !db.isMDB {
+		// LDP Classic needs this, for some reason
+		_, err = tx.Exec(context.Background(), "SET LOCAL search_path = local, public")
+		if err != nil {
+			return fmt.Errorf("could not set search path: %w", err)
+		}
+	}
+
+	// Defining a function, even in pg_temp, cannot be done in a
+	// read-only transaction, but a transaction can become read-only
+	// once the definition is done. The extended protocol is used so
+	// that PostgreSQL refuses more than one statement, in case the
+	// definition hides another that scopeReportFunction did not see.
+	_, err = tx.Exec(context.Background(), definition, pgx.QueryExecModeDescribeExec)
 	if err != nil {
 		return fmt.Errorf("could not register SQL function: %w", err)
 	}
+	_, err = tx.Exec(context.Background(), "SET TRANSACTION READ ONLY")
+	if err != nil {
+		return fmt.Errorf("could not make transaction read-only: %w", err)
+	}
+
+	var columns []resultColumn
+	if opts.Envelope {
+		columns, err = describeResult(tx, tag.comment() + cmd)
+		if err != nil {
+			return fmt.Errorf("could not describe columns of report result: %w", err)
+		}
+	}
 
-	rows, err := tx.Query(context.Background(), cmd)
+	rows, err := tx.Query(context.Background(), tag.comment() + cmd)
 	if err != nil {
 		return fmt.Errorf("could not execute SQL from report: %w", err)
 	}
 
-	result, err := collectAndFixRows(rows)
+	if opts.streaming() {
+		return streamRows(w, rows, opts, true, columns)
+	}
+
+	result, err := collectAndFixRows(rows, opts)
 	if err != nil {
 		return err
 	}
 
 	count := len(result) // This is redundant, but it's in the old API so we retain it here
 	response := reportResponse{
+		Columns: columns,
 		TotalRecords: count,
 		Records: result,
 	}
@@ -370,19 +631,28 @@ func validateUrl(_url string) error {
 }
 
 
-func makeFunctionCall(sql string, params map[string]string, limit int) (string, error) {
+func reportFunctionName(sql string) (string, error) {
 	re := regexp.MustCompile(`--.+:function\s+(.+)`)
 	m := re.FindStringSubmatch(sql)
 	if m == nil {
 		return "", fmt.Errorf("could not extract SQL function name")
 	}
+	return strings.TrimSpace(m[1]), nil
+}
+
 
+// The function is defined in pg_temp by scopeReportFunction, and
+// functions there are found only when named explicitly
+func makeFunctionCall(name string, params map[string]string, limit int) (string, error) {
 	s := make([]string, 0, len(params))
 	for key, val := range(params) {
-		s = append(s, fmt.Sprintf("%s => '%s'", key, val))
+		if !sqlNameRegexp.MatchString(key) {
+			return "", fmt.Errorf("bad parameter name '%s'", key)
+		}
+		s = append(s, fmt.Sprintf("%s => '%s'", key, strings.ReplaceAll(val, "'", "''")))
 	}
 
-	cmd := "SELECT * FROM " + m[1] + "(" + strings.Join(s, ", ") + ")"
+	cmd := "SELECT * FROM pg_temp." + name + "(" + strings.Join(s, ", ") + ")"
 	if limit != 0 {
 		cmd += fmt.Sprintf(" LIMIT %d", limit)
 	}
@@ -391,24 +661,23 @@ func makeFunctionCall(sql string, params map[string]string, limit int) (string,
 }
 
 
-func collectAndFixRows(rows pgx.Rows) ([]map[string]any, error) {
-	records, err := pgx.CollectRows(rows, pgx.RowToMap)
-	// fmt.Printf("rows: %+v\n", rows.FieldDescriptions())
-	if err != nil {
-		return nil, fmt.Errorf("could not collect query result data: %w", err)
-	}
+func collectAndFixRows(rows pgx.Rows, opts outputOptions) ([]map[string]any, error) {
+	defer rows.Close()
+	fields := rows.FieldDescriptions()
 
-	// Fix up types
-	for _, rec := range records {
-		for key, val := range rec {
-			switch v := val.(type) {
-			case [16]uint8:
-				// This is how pgx represents fields of type "uuid"
-				rec[key] = fmt.Sprintf("%x-%x-%x-%x-%x", v[0:4], v[4:6], v[6:8], v[8:10], v[10:16])
-			default:
-				// Nothing to do
-			}
+	records := make([]map[string]any, 0)
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return nil, fmt.Errorf("could not collect query result data: %w", err)
 		}
+		fixValues(fields, values, opts)
+		records = append(records, rowToMap(fields, values))
+	}
+
+	err := rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not collect query result data: %w", err)
 	}
 
 	return records, nil
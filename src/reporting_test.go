@@ -6,6 +6,7 @@ import "fmt"
 import "testing"
 import "encoding/json"
 import "github.com/stretchr/testify/assert"
+import "github.com/jackc/pgx/v5"
 import "github.com/pashagolub/pgxmock/v3"
 import "net/http/httptest"
 
@@ -60,6 +61,42 @@ func Test_makeSql(t *testing.T) {
 			expected: `SELECT * FROM "folio"."users" WHERE id > $1 AND user LIKE $2`,
 			expectedArgs: []string{"42", "mi%"},
 		},
+		{
+			name: "query with null conditions",
+			sendData: `{ "tables": [{ "schema": "folio", "tableName": "users",
+				"columnFilters": [
+					{ "key": "id", "op": "is  not null" },
+					{ "key": "user", "op": "not ilike", "value": "mi%" },
+					{ "key": "email", "op": "IS NULL", "value": "ignored" }
+				] }] }`,
+			expected: `SELECT * FROM "folio"."users" WHERE id IS NOT NULL AND user NOT ILIKE $1 AND email IS NULL`,
+			expectedArgs: []string{"mi%"},
+		},
+		{
+			name: "query with operator hiding SQL",
+			sendData: `{ "tables": [{ "schema": "folio", "tableName": "users",
+				"columnFilters": [
+					{ "key": "id", "op": "IN (SELECT id FROM folio_audit/**/.events) OR id =", "value": "42" }
+				] }] }`,
+			errorstr: "unsupported filter operator 'IN (SELECT id FROM folio_audit/**/.events) OR id ='",
+		},
+		{
+			name: "query with direction hiding SQL",
+			sendData: `{ "tables": [{ "schema": "folio", "tableName": "users",
+				"orderBy": [{ "key": "id", "direction": "asc, (SELECT 1 FROM folio_audit.events)" }] }] }`,
+			errorstr: "unsupported order direction 'asc, (SELECT 1 FROM folio_audit.events)'",
+		},
+		{
+			name: "query with bad nulls position",
+			sendData: `{ "tables": [{ "schema": "folio", "tableName": "users",
+				"orderBy": [{ "key": "id", "direction": "asc", "nulls": "middle" }] }] }`,
+			errorstr: "unsupported nulls position 'middle'",
+		},
+		{
+			name: "query with quote in table name",
+			sendData: `{ "tables": [{ "schema": "folio", "tableName": "users\" x" }] }`,
+			expected: `SELECT * FROM "folio"."users"" x"`,
+		},
 		{
 			name: "query with real and empty conditions",
 			sendData: `{ "tables": [{ "schema": "folio", "tableName": "users",
@@ -67,7 +104,7 @@ func Test_makeSql(t *testing.T) {
 					{},
 					{ "key": "user", "op": "LIKE", "value": "mi%" }
 				] }] }`,
-			expected: `SELECT * FROM "folio"."users" WHERE user LIKE $2`,
+			expected: `SELECT * FROM "folio"."users" WHERE user LIKE $1`,
 			expectedArgs: []string{"mi%"},
 		},
 		{
@@ -92,6 +129,32 @@ func Test_makeSql(t *testing.T) {
 			expected: `SELECT id, status_updated_date, hrid, title, source FROM "folio_inventory"."instance__t" WHERE status_updated_date >= $1 AND hrid <> $2 ORDER BY status_updated_date asc NULLS LAST, __id asc NULLS FIRST LIMIT 11`,
 			expectedArgs: []string{"2022-06-09T19:01:33.757+00:00", "in00000000005"},
 		},
+		{
+			name: "query with JSON paths",
+			sendData: `{ "tables": [{ "schema": "folio_inventory", "tableName": "item",
+				"showColumns": ["id", "data -> 'status' ->> 'name'"],
+				"columnFilters": [{ "key": "data->'status'->>'name'", "value": "Available" }],
+				"orderBy": [{ "key": "data->>'barcode'", "direction": "asc" }] }] }`,
+			expected: `SELECT id, data->'status'->>'name' AS "data->'status'->>'name'" FROM "folio_inventory"."item" WHERE data->'status'->>'name' = $1 ORDER BY data->>'barcode' asc NULLS LAST`,
+			expectedArgs: []string{"Available"},
+		},
+		{
+			name: "query with bad JSON path in columns",
+			sendData: `{ "tables": [{ "schema": "folio_inventory", "tableName": "item", "showColumns": ["data->>'status'->'name'"] }] }`,
+			errorstr: "only the last step may use ->>",
+		},
+		{
+			name: "query with bad JSON path in filter",
+			sendData: `{ "tables": [{ "schema": "folio_inventory", "tableName": "item",
+				"columnFilters": [{ "key": "data->status", "value": "x" }] }] }`,
+			errorstr: "bad JSON path 'data->status'",
+		},
+		{
+			name: "query with bad JSON path in order",
+			sendData: `{ "tables": [{ "schema": "folio_inventory", "tableName": "item",
+				"orderBy": [{ "key": "->'x'", "direction": "asc" }] }] }`,
+			errorstr: "must start with a column name",
+		},
 	}
 
 	for _, test := range tests {
@@ -100,7 +163,7 @@ func Test_makeSql(t *testing.T) {
 			var jq jsonQuery
 			err := json.Unmarshal(bytes, &jq)
 			assert.Nil(t, err)
-			sql, params, err := makeSql(jq)
+			sql, params, err := makeSql(jq, true)
 			if test.errorstr == "" {
 				assert.Nil(t, err)
 				assert.Equal(t, test.expected, sql)
@@ -144,6 +207,42 @@ func Test_reportingHandlers(t *testing.T) {
 			function: handleTables,
 			expected: `\[{"tableSchema":"folio_inventory","tableName":"records_instances"},{"tableSchema":"folio_inventory","tableName":"holdings_record"}\]`,
 		},
+		{
+			name: "retrieve list of tables with details",
+			path: "/ldp/db/tables?detail=true",
+			establishMock: func(data interface{}) error {
+				return establishMockForTableDetails(data.(pgxmock.PgxPoolIface))
+			},
+			function: handleTables,
+			expected: `\[{"tableSchema":"folio_inventory","tableName":"records_instances","kind":"table","comment":"Instance records","estimatedRows":1234567,"size":987654321,"lastUpdate":"2024-05-01T03:00:00Z"},{"tableSchema":"folio_inventory","tableName":"holdings_record","kind":"view","size":0}\]`,
+		},
+		{
+			name: "retrieve list of tables including inaccessible ones",
+			path: "/ldp/db/tables?inaccessible=true",
+			establishMock: func(data interface{}) error {
+				mock := data.(pgxmock.PgxPoolIface)
+				mock.ExpectQuery("SELECT schema_name, table_name FROM metadb.base_table").WillReturnRows(
+					pgxmock.NewRows([]string{"schema_name", "table_name"}).
+						AddRow("folio_inventory", "records_instances").
+						AddRow("folio_inventory", "holdings_record"))
+				establishMockForReadableTables(mock, 2)
+				return nil
+			},
+			function: handleTables,
+			expected: `\[{"tableSchema":"folio_inventory","tableName":"records_instances","accessible":false},{"tableSchema":"folio_inventory","tableName":"holdings_record","accessible":true}\]`,
+		},
+		{
+			name: "bad inaccessible parameter for tables",
+			path: "/ldp/db/tables?inaccessible=perhaps",
+			function: handleTables,
+			errorstr: "bad value 'perhaps' for inaccessible",
+		},
+		{
+			name: "bad detail parameter for tables",
+			path: "/ldp/db/tables?detail=maybe",
+			function: handleTables,
+			errorstr: "bad value 'maybe' for detail",
+		},
 		{
 			name: "list of columns without table",
 			path: "/ldp/db/columns?schema=folio_users",
@@ -163,7 +262,25 @@ func Test_reportingHandlers(t *testing.T) {
 				return establishMockForColumns(data.(pgxmock.PgxPoolIface))
 			},
 			function: handleColumns,
-			expected: `{"columnName":"id","data_type":"uuid","tableSchema":"folio_users","tableName":"users","ordinalPosition":"6"},{"columnName":"creation_date","data_type":"timestamp without time zone","tableSchema":"folio_users","tableName":"users","ordinalPosition":"8"}]`,
+			expected: `\[{"columnName":"id","data_type":"uuid","tableSchema":"folio_users","tableName":"users","ordinalPosition":"6","isNullable":false,"comment":"Unique identifier","isPrimaryKey":true,"indexes":\["users_pkey"\],"isJson":false},` +
+				`{"columnName":"creation_date","data_type":"timestamp without time zone","tableSchema":"folio_users","tableName":"users","ordinalPosition":"8","isNullable":true,"default":"now\(\)","isPrimaryKey":false,"indexes":\[\],"isJson":false},` +
+				`{"columnName":"tags","data_type":"ARRAY","tableSchema":"folio_users","tableName":"users","ordinalPosition":"9","isNullable":true,"isPrimaryKey":false,"indexes":\[\],"elementType":"text","isJson":false},` +
+				`{"columnName":"data","data_type":"jsonb","tableSchema":"folio_users","tableName":"users","ordinalPosition":"10","isNullable":true,"isPrimaryKey":false,"indexes":\["users_data_idx"\],"isJson":true}\]`,
+		},
+		{
+			name: "column search without term",
+			path: "/ldp/db/columns/search",
+			function: handleColumnSearch,
+			errorstr: "must specify search term q",
+		},
+		{
+			name: "column search",
+			path: "/ldp/db/columns/search?q=patron_group",
+			establishMock: func(data interface{}) error {
+				return establishMockForColumnSearch(data.(pgxmock.PgxPoolIface))
+			},
+			function: handleColumnSearch,
+			expected: `\[{"tableSchema":"folio_users","tableName":"users","columnName":"patron_group","data_type":"uuid","comment":"The patron group of the user"},{"tableSchema":"folio_derived","tableName":"loans_items","columnName":"patron_group_name","data_type":"text"}\]`,
 		},
 		{
 			name: "fail non-JSON query",
@@ -231,6 +348,50 @@ func Test_reportingHandlers(t *testing.T) {
 			function: handleQuery,
 			expected: `\[{"email":"mike@example.com","name":"mike"},{"email":"fiona@example.com","name":"fiona"}\]`,
 		},
+		{
+			name: "query with unsupported output format",
+			path: "/ldp/db/query?format=xml",
+			sendData: `{ "tables": [{ "schema": "folio", "tableName": "users" }] }`,
+			function: handleQuery,
+			errorstr: "unsupported output format 'xml'",
+		},
+		{
+			name: "streamed query as NDJSON",
+			path: "/ldp/db/query?format=ndjson",
+			sendData: `{ "tables": [{ "schema": "folio", "tableName": "users" }] }`,
+			establishMock: func(data interface{}) error {
+				return establishMockForQuery(data.(pgxmock.PgxPoolIface))
+			},
+			function: handleQuery,
+			expected: `^{"email":"mike@example.com","name":"mike"}\n{"email":"fiona@example.com","name":"fiona"}\n$`,
+		},
+		{
+			name: "query with column descriptions",
+			path: "/ldp/db/query?envelope=true",
+			sendData: `{ "tables": [{ "schema": "folio", "tableName": "users" }] }`,
+			establishMock: func(data interface{}) error {
+				return establishMockForQuery(data.(pgxmock.PgxPoolIface), true)
+			},
+			function: handleQuery,
+			expected: `^{"totalRecords":2,"records":\[{"email":"mike@example.com","name":"mike"},{"email":"fiona@example.com","name":"fiona"}\]}$`,
+		},
+		{
+			name: "streamed query with column descriptions",
+			path: "/ldp/db/query?envelope=1&format=json",
+			sendData: `{ "tables": [{ "schema": "folio", "tableName": "users" }] }`,
+			establishMock: func(data interface{}) error {
+				return establishMockForQuery(data.(pgxmock.PgxPoolIface), true)
+			},
+			function: handleQuery,
+			expected: `^{"columns":\[\],"records":\[{"email":"mike@example.com","name":"mike"},{"email":"fiona@example.com","name":"fiona"}\],"totalRecords":2}$`,
+		},
+		{
+			name: "query with bad envelope value",
+			path: "/ldp/db/query?envelope=maybe",
+			sendData: `{ "tables": [{ "schema": "folio", "tableName": "users" }] }`,
+			function: handleQuery,
+			errorstr: "bad value 'maybe' for envelope",
+		},
 		{
 			// This test doesn't really test anything except my ability to mock PGX errors
 			name: "query with an empty filter",
@@ -274,11 +435,27 @@ func Test_reportingHandlers(t *testing.T) {
 			name: "report that is not valid SQL",
 			path: "/ldp/db/reports",
 			sendData: `{ "url": "` + baseUrl + `/reports/bad.sql" }`,
-			// pgxmock can't spot the badness of the SQL, so we manually cause an error
+			function: handleReport,
+			errorstr: `bad function name 'users\nthis is bad SQL'`,
+		},
+		{
+			name: "report that does more than define its function",
+			path: "/ldp/db/reports",
+			sendData: `{ "url": "` + baseUrl + `/reports/delete.sql" }`,
+			function: handleReport,
+			errorstr: "report may only define its function 'count_loans', but contains: DELETE FROM folio_circulation.loan__t",
+		},
+		{
+			name: "report whose function cannot be registered",
+			path: "/ldp/db/reports",
+			sendData: `{ "url": "` + baseUrl + `/reports/loans.sql" }`,
+			// pgxmock can't spot any badness in the SQL, so we manually cause an error
 			establishMock: func(data interface{}) error {
 				mock := data.(pgxmock.PgxPoolIface)
 				mock.ExpectBegin()
-				mock.ExpectExec("--metadb:function users").
+				establishMockForTag(mock)
+				mock.ExpectExec("CREATE FUNCTION pg_temp.count_loans").
+					WithArgs(pgx.QueryExecModeDescribeExec).
 					WillReturnError(fmt.Errorf("bad SQL"))
 				mock.ExpectRollback()
 				return nil
@@ -286,16 +463,21 @@ func Test_reportingHandlers(t *testing.T) {
 			function: handleReport,
 			errorstr: "could not register SQL function: bad SQL",
 		},
+		{
+			name: "report with bad parameter name",
+			path: "/ldp/db/reports",
+			sendData: `{ "url": "` + baseUrl + `/reports/loans.sql", "params": { "x); DROP TABLE users; --": "1" } }`,
+			function: handleReport,
+			errorstr: "bad parameter name",
+		},
 		{
 			name: "simple report",
 			path: "/ldp/db/reports",
 			sendData: `{ "url": "` + baseUrl + `/reports/loans.sql" }`,
 			establishMock: func(data interface{}) error {
 				mock := data.(pgxmock.PgxPoolIface)
-				mock.ExpectBegin()
-				mock.ExpectExec("--metadb:function count_loans").
-					WillReturnResult(pgxmock.NewResult("CREATE FUNCTION", 1))
-				mock.ExpectQuery(`SELECT \* FROM count_loans`).
+				establishMockForReportFunction(mock)
+				mock.ExpectQuery(`SELECT \* FROM pg_temp\.count_loans`).
 					WillReturnRows(pgxmock.NewRows([]string{"id", "num"}).
 						AddRow("123", 42).
 						AddRow("456", 96))
@@ -318,6 +500,39 @@ func Test_reportingHandlers(t *testing.T) {
 			function: handleReport,
 			expected: `{"totalRecords":2,"records":\[{"id":"5a9a92ca-ba05-d72d-f84c-31921f1f7e4d","num":29},{"id":"456","num":3}\]}`,
 		},
+		{
+			name: "report with column descriptions",
+			path: "/ldp/db/reports?envelope=true",
+			sendData: `{ "url": "` + baseUrl + `/reports/loans.sql",
+				     "params": { "end_date": "2023-03-18T00:00:00.000Z" },
+				     "limit": 100
+				   }`,
+			establishMock: func(data interface{}) error {
+				mock := data.(pgxmock.PgxPoolIface)
+				establishMockForReportFunction(mock)
+				establishMockForDescribeResult(mock, `SELECT \* FROM pg_temp\.count_loans`)
+				mock.ExpectQuery(`SELECT \* FROM pg_temp\.count_loans`).
+					WillReturnRows(pgxmock.NewRows([]string{"id", "num"}).
+						AddRow("123", 42))
+				mock.ExpectRollback()
+				return nil
+			},
+			function: handleReport,
+			expected: `^{"totalRecords":1,"records":\[{"id":"123","num":42}\]}$`,
+		},
+		{
+			name: "streamed report as CSV",
+			path: "/ldp/db/reports?format=csv",
+			sendData: `{ "url": "` + baseUrl + `/reports/loans.sql",
+				     "params": { "end_date": "2023-03-18T00:00:00.000Z" },
+				     "limit": 100
+				   }`,
+			establishMock: func(data interface{}) error {
+				return establishMockForReport(data.(pgxmock.PgxPoolIface))
+			},
+			function: handleReport,
+			expected: `^id,num\n5a9a92ca-ba05-d72d-f84c-31921f1f7e4d,29\n456,3\n$`,
+		},
 	}
 
 	mrs, err := MakeConfiguredServer("../etc/silent.json", ".")
@@ -345,10 +560,9 @@ func Test_reportingHandlers(t *testing.T) {
 			}
 
 			if test.useBadSession {
-				session.dbConn = nil
+				useMockDb(session, nil)
 			} else {
-				session.dbConn = mock
-				session.isMDB = true // Mock expectations are as for MetaDB
+				useMockDb(session, mock)
 			}
 
 			w := httptest.NewRecorder()
@@ -0,0 +1,103 @@
+// Describe the columns of a query or report result
+package main
+
+import "context"
+import "fmt"
+import "github.com/jackc/pgx/v5"
+import "github.com/jackc/pgx/v5/pgconn"
+import "github.com/jackc/pgx/v5/pgtype"
+
+
+type resultColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Nullable *bool `json:"nullable,omitempty"` // omitted when not known
+}
+
+
+// Satisfied by both connection pools and transactions
+type queryer interface {
+	Query(context.Context, string, ...any) (pgx.Rows, error)
+	QueryRow(context.Context, string, ...any) pgx.Row
+}
+
+
+// Describes the columns that the SQL will return, without running it.
+// This must be done in the transaction that will run it, since another
+// connection may not be available (for example, if maxConns is 1), and
+// before it runs, since the transaction's connection is busy while the
+// result is being read.
+func describeResult(tx pgx.Tx, sql string) ([]resultColumn, error) {
+	sd, err := tx.Prepare(context.Background(), "", sql)
+	if err != nil {
+		return nil, fmt.Errorf("could not prepare SQL: %w", err)
+	}
+	return describeColumns(tx, sd.Fields)
+}
+
+
+// pgx gives us the type OID of each column, and the table and
+// attribute numbers of columns that come straight from a table. We
+// ask PostgreSQL to turn these into type names (including modifiers
+// such as varchar lengths) and, where possible, nullability. All
+// columns are described in a single round-trip.
+func describeColumns(dbConn queryer, fields []pgconn.FieldDescription) ([]resultColumn, error) {
+	n := len(fields)
+	if n == 0 {
+		return []resultColumn{}, nil
+	}
+	typeOids := make([]uint32, n)
+	typeMods := make([]int32, n)
+	tableOids := make([]uint32, n)
+	attNums := make([]int16, n)
+	for i, field := range fields {
+		typeOids[i] = field.DataTypeOID
+		typeMods[i] = field.TypeModifier
+		tableOids[i] = field.TableOID
+		attNums[i] = int16(field.TableAttributeNumber)
+	}
+
+	query := `SELECT format_type(f.typid, f.typmod) AS type, NOT a.attnotnull AS nullable
+		FROM unnest($1::oid[], $2::int4[], $3::oid[], $4::int2[])
+		    WITH ORDINALITY AS f(typid, typmod, relid, attnum, n)
+		    LEFT JOIN pg_attribute a ON a.attrelid = f.relid AND a.attnum = f.attnum AND f.attnum > 0
+		ORDER BY f.n`
+	rows, err := dbConn.Query(context.Background(), query, typeOids, typeMods, tableOids, attNums)
+	if err != nil {
+		return nil, fmt.Errorf("could not run query '%s': %w", query, err)
+	}
+	defer rows.Close()
+
+	columns := make([]resultColumn, 0, n)
+	for rows.Next() {
+		if len(columns) == n {
+			return nil, fmt.Errorf("too many column descriptions")
+		}
+
+		var typeName string
+		var nullable pgtype.Bool
+		err = rows.Scan(&typeName, &nullable)
+		if err != nil {
+			return nil, fmt.Errorf("could not read column description: %w", err)
+		}
+
+		column := resultColumn{
+			Name: fields[len(columns)].Name,
+			Type: typeName,
+		}
+		if nullable.Valid {
+			column.Nullable = &nullable.Bool
+		}
+		columns = append(columns, column)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read column descriptions: %w", err)
+	}
+	if len(columns) != n {
+		return nil, fmt.Errorf("expected %d column descriptions, got %d", n, len(columns))
+	}
+
+	return columns, nil
+}
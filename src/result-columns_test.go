@@ -0,0 +1,94 @@
+package main
+
+import "testing"
+import "errors"
+import "context"
+import "github.com/stretchr/testify/assert"
+import "github.com/jackc/pgx/v5/pgconn"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func Test_describeColumns(t *testing.T) {
+	fields := []pgconn.FieldDescription{
+		{ Name: "id", DataTypeOID: 2950, TableOID: 16384, TableAttributeNumber: 1, TypeModifier: -1 },
+		{ Name: "barcode", DataTypeOID: 1043, TableOID: 16384, TableAttributeNumber: 4, TypeModifier: 259 },
+		{ Name: "loan_count", DataTypeOID: 20, TypeModifier: -1 },
+	}
+
+	t.Run("successful", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectQuery(`SELECT format_type`).
+			WithArgs([]uint32{2950, 1043, 20}, []int32{-1, 259, -1}, []uint32{16384, 16384, 0}, []int16{1, 4, 0}).
+			WillReturnRows(pgxmock.NewRows([]string{"type", "nullable"}).
+				AddRow("uuid", false).
+				AddRow("character varying(255)", true).
+				AddRow("bigint", nil))
+
+		columns, err := describeColumns(mock, fields)
+		assert.Nil(t, err)
+		f, tr := false, true
+		assert.Equal(t, []resultColumn{
+			{ Name: "id", Type: "uuid", Nullable: &f },
+			{ Name: "barcode", Type: "character varying(255)", Nullable: &tr },
+			{ Name: "loan_count", Type: "bigint" },
+		}, columns)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("in the transaction that runs the query", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectBegin()
+		mock.ExpectQuery(`SELECT format_type`).
+			WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"type", "nullable"}).
+				AddRow("uuid", false).
+				AddRow("character varying(255)", true).
+				AddRow("bigint", nil))
+
+		tx, err := mock.Begin(context.Background())
+		assert.Nil(t, err)
+		columns, err := describeColumns(tx, fields)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, len(columns))
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("no columns", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		columns, err := describeColumns(mock, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, []resultColumn{}, columns)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("too few descriptions", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectQuery(`SELECT format_type`).
+			WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"type", "nullable"}).
+				AddRow("uuid", false))
+
+		_, err = describeColumns(mock, fields)
+		assert.ErrorContains(t, err, "expected 3 column descriptions, got 1")
+	})
+
+	t.Run("database error", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectQuery(`SELECT format_type`).
+			WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnError(errors.New("no catalogue"))
+
+		_, err = describeColumns(mock, fields)
+		assert.ErrorContains(t, err, "no catalogue")
+	})
+}
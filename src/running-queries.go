@@ -0,0 +1,214 @@
+// Identifying, listing and cancelling the queries that mod-reporting runs
+package main
+
+import "fmt"
+import "time"
+import "errors"
+import "regexp"
+import "context"
+import "strconv"
+import "strings"
+import "net/http"
+import "github.com/jackc/pgx/v5"
+
+
+var queryTagRegexp = regexp.MustCompile(`^/\* mod-reporting tenant=(\S*) user=(\S*) request=(\S*) \*/`)
+
+
+// Who a query is being run for
+type requestTag struct {
+	tenant string
+	user string
+	requestId string
+}
+
+type runningQuery struct {
+	Pid int32 `json:"pid"`
+	Tenant string `json:"tenant"`
+	User string `json:"user,omitempty"`
+	RequestId string `json:"requestId,omitempty"`
+	DbUser string `json:"dbUser,omitempty"`
+	State string `json:"state"`
+	StartedAt string `json:"startedAt,omitempty"`
+	ElapsedSeconds float64 `json:"elapsedSeconds"`
+	Sql string `json:"sql"`
+}
+
+
+func makeRequestTag(req *http.Request, session *ModReportingSession) requestTag {
+	tag := requestTag{
+		tenant: session.tenant,
+		requestId: req.Header.Get("X-Okapi-Request-Id"),
+	}
+	user, err := userFromToken(req.Header.Get("X-Okapi-Token"))
+	if err == nil {
+		tag.user = user.Username
+	}
+	return tag
+}
+
+
+// Nothing that could end the comment or split the value
+func tagValue(s string) string {
+	return strings.Join(strings.Fields(strings.ReplaceAll(s, "*", "_")), "_")
+}
+
+
+// Prefixed to each statement, so that it can be seen in pg_stat_activity
+func (tag requestTag) comment() string {
+	return fmt.Sprintf("/* mod-reporting tenant=%s user=%s request=%s */ ", tagValue(tag.tenant), tagValue(tag.user), tagValue(tag.requestId))
+}
+
+
+// Connections identify themselves by the application name in the
+// database settings, to which the tenant is added while running a
+// query. This is what the admin endpoints search for, so that a tenant
+// sees and cancels only its own queries.
+func tenantApplicationName(db *reportingDb, tenant string) string {
+	name := db.config.ApplicationName
+	if name == "" {
+		name = defaultApplicationName
+	}
+	return name + ":" + tenant
+}
+
+
+// Lasts only until the end of the transaction
+func (tag requestTag) apply(tx pgx.Tx, db *reportingDb) error {
+	_, err := tx.Exec(context.Background(), "SELECT set_config('application_name', $1, true)", tenantApplicationName(db, tag.tenant))
+	if err != nil {
+		return fmt.Errorf("could not set application name: %w", err)
+	}
+	return nil
+}
+
+
+// Runs f, once the concurrency limits allow, in a read-only transaction
+// tagged as the request's, so that what it does can be listed and
+// cancelled like any other query. Each statement f runs should begin
+// with tag.comment().
+func (session *ModReportingSession) runTagged(w http.ResponseWriter, req *http.Request, db *reportingDb, dbConn PgxIface, f func(tx pgx.Tx, tag requestTag) error) error {
+	release, err := session.waitToRun(req.Context(), w, db)
+	if err != nil {
+		return fmt.Errorf("could not run query: %w", err)
+	}
+	defer release()
+
+	tx, err := dbConn.BeginTx(context.Background(), readOnlyTx)
+	if err != nil {
+		return fmt.Errorf("could not open transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	tag := makeRequestTag(req, session)
+	err = tag.apply(tx, db)
+	if err != nil {
+		return err
+	}
+	return f(tx, tag)
+}
+
+
+// Lists the tenant's queries running in the reporting database, from
+// any instance of mod-reporting
+func listRunningQueries(dbConn PgxIface, applicationName string) ([]runningQuery, error) {
+	sql := `SELECT pid, usename, state, query_start, extract(epoch FROM now() - query_start)::float8, query
+		FROM pg_stat_activity
+		WHERE application_name = $1 AND state <> 'idle' AND pid <> pg_backend_pid()
+		ORDER BY query_start`
+	rows, err := dbConn.Query(context.Background(), sql, applicationName)
+	if err != nil {
+		return nil, fmt.Errorf("could not list running queries: %w", err)
+	}
+	defer rows.Close()
+
+	queries := []runningQuery{}
+	for rows.Next() {
+		var q runningQuery
+		var dbUser, state *string
+		var started *time.Time
+		var elapsed *float64
+		err = rows.Scan(&q.Pid, &dbUser, &state, &started, &elapsed, &q.Sql)
+		if err != nil {
+			return nil, fmt.Errorf("could not read running query: %w", err)
+		}
+		if dbUser != nil {
+			q.DbUser = *dbUser
+		}
+		if state != nil {
+			q.State = *state
+		}
+		if started != nil {
+			q.StartedAt = started.UTC().Format(time.RFC3339)
+		}
+		if elapsed != nil {
+			q.ElapsedSeconds = *elapsed
+		}
+		// Without pg_read_all_stats, queries run as other roles are hidden
+		match := queryTagRegexp.FindStringSubmatch(q.Sql)
+		if match != nil {
+			q.Tenant, q.User, q.RequestId = match[1], match[2], match[3]
+		}
+		queries = append(queries, q)
+	}
+	return queries, rows.Err()
+}
+
+
+// Cancels the query, or if terminate is true ends its connection, but
+// only if it belongs to the tenant
+func stopRunningQuery(dbConn PgxIface, applicationName string, pid int, terminate bool) error {
+	function, verb := "pg_cancel_backend", "cancel"
+	if terminate {
+		function, verb = "pg_terminate_backend", "terminate"
+	}
+	sql := "SELECT " + function + "(pid) FROM pg_stat_activity WHERE pid = $1 AND application_name = $2"
+
+	var ok bool
+	err := dbConn.QueryRow(context.Background(), sql, pid, applicationName).Scan(&ok)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return MakeHttpError(http.StatusNotFound, fmt.Sprintf("no query with pid %d is running for this tenant", pid))
+	} else if err != nil {
+		return fmt.Errorf("could not %s query %d: %w", verb, pid, err)
+	} else if !ok {
+		return fmt.Errorf("could not %s query %d", verb, pid)
+	}
+	return nil
+}
+
+
+func handleRunningQueries(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	db, dbConn, err := session.findLoginDbConn(req)
+	if err != nil {
+		return fmt.Errorf("could not find reporting DB: %w", err)
+	}
+
+	queries, err := listRunningQueries(dbConn, tenantApplicationName(db, session.tenant))
+	if err != nil {
+		return err
+	}
+	return sendJSON(w, queries, "running queries")
+}
+
+
+func handleStopQuery(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	s := strings.TrimPrefix(req.URL.Path, "/ldp/db/queries/")
+	pid, err := strconv.Atoi(s)
+	if err != nil {
+		return MakeHttpError(http.StatusBadRequest, fmt.Sprintf("bad query pid '%s'", s))
+	}
+	terminate := req.URL.Query().Get("terminate") == "true"
+
+	db, dbConn, err := session.findLoginDbConn(req)
+	if err != nil {
+		return fmt.Errorf("could not find reporting DB: %w", err)
+	}
+
+	err = stopRunningQuery(dbConn, tenantApplicationName(db, session.tenant), pid, terminate)
+	if err != nil {
+		return err
+	}
+	session.Log("db", fmt.Sprintf("stopped query %d for tenant '%s' (terminate=%v)", pid, session.tenant, terminate))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import "fmt"
+import "time"
+import "errors"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/jackc/pgx/v5"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func Test_requestTag(t *testing.T) {
+	session := &ModReportingSession{tenant: "diku"}
+
+	t.Run("tag from request", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/ldp/db/query", nil)
+		req.Header.Set("X-Okapi-Token", makeTestToken(`{"sub":"mike"}`))
+		req.Header.Set("X-Okapi-Request-Id", "123456/ldp")
+		tag := makeRequestTag(req, session)
+		assert.Equal(t, requestTag{tenant: "diku", user: "mike", requestId: "123456/ldp"}, tag)
+		assert.Equal(t, "/* mod-reporting tenant=diku user=mike request=123456/ldp */ ", tag.comment())
+	})
+
+	t.Run("values cannot escape the comment", func(t *testing.T) {
+		tag := requestTag{tenant: "diku", user: "evil */ DROP TABLE users; /*", requestId: ""}
+		comment := tag.comment()
+		assert.Equal(t, "/* mod-reporting tenant=diku user=evil__/_DROP_TABLE_users;_/_ request= */ ", comment)
+		match := queryTagRegexp.FindStringSubmatch(comment + "SELECT 1")
+		assert.Equal(t, []string{comment[:len(comment)-1], "diku", "evil__/_DROP_TABLE_users;_/_", ""}, match)
+	})
+
+	t.Run("application name", func(t *testing.T) {
+		assert.Equal(t, "mod-reporting:diku", tenantApplicationName(&reportingDb{}, "diku"))
+		db := &reportingDb{config: databaseConfig{ApplicationName: "reporting"}}
+		assert.Equal(t, "reporting:diku", tenantApplicationName(db, "diku"))
+	})
+}
+
+
+func Test_runningQueries(t *testing.T) {
+	listSql := `SELECT pid, usename, state, query_start, .* FROM pg_stat_activity WHERE application_name = \$1`
+
+	t.Run("list", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		started := time.Date(2024, 7, 1, 12, 0, 0, 0, time.UTC)
+		mock.ExpectQuery(listSql).WithArgs("mod-reporting:diku").
+			WillReturnRows(pgxmock.NewRows([]string{"pid", "usename", "state", "query_start", "elapsed", "query"}).
+				AddRow(int32(4711), &[]string{"folio"}[0], &[]string{"active"}[0], &started, &[]float64{12.5}[0],
+					`/* mod-reporting tenant=diku user=mike request=123456/ldp */ SELECT * FROM pg_temp.count_loans()`).
+				AddRow(int32(4712), nil, nil, nil, nil, "<insufficient privilege>"))
+
+		queries, err := listRunningQueries(mock, "mod-reporting:diku")
+		assert.Nil(t, err)
+		assert.Equal(t, []runningQuery{
+			{
+				Pid: 4711,
+				Tenant: "diku",
+				User: "mike",
+				RequestId: "123456/ldp",
+				DbUser: "folio",
+				State: "active",
+				StartedAt: "2024-07-01T12:00:00Z",
+				ElapsedSeconds: 12.5,
+				Sql: `/* mod-reporting tenant=diku user=mike request=123456/ldp */ SELECT * FROM pg_temp.count_loans()`,
+			},
+			{ Pid: 4712, Sql: "<insufficient privilege>" },
+		}, queries)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	stopTests := []struct {
+		name string
+		terminate bool
+		establishMock func(mock pgxmock.PgxPoolIface)
+		status int // of an httpError, if any
+		errorstr string
+	}{
+		{
+			name: "cancel",
+			establishMock: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery(`SELECT pg_cancel_backend\(pid\) FROM pg_stat_activity`).WithArgs(4711, "mod-reporting:diku").
+					WillReturnRows(pgxmock.NewRows([]string{"ok"}).AddRow(true))
+			},
+		},
+		{
+			name: "terminate",
+			terminate: true,
+			establishMock: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery(`SELECT pg_terminate_backend\(pid\) FROM pg_stat_activity`).WithArgs(4711, "mod-reporting:diku").
+					WillReturnRows(pgxmock.NewRows([]string{"ok"}).AddRow(true))
+			},
+		},
+		{
+			name: "not the tenant's query",
+			establishMock: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery(`SELECT pg_cancel_backend`).WithArgs(4711, "mod-reporting:diku").WillReturnError(pgx.ErrNoRows)
+			},
+			status: http.StatusNotFound,
+			errorstr: "no query with pid 4711 is running for this tenant",
+		},
+		{
+			name: "not the tenant's query, wrapped",
+			establishMock: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery(`SELECT pg_cancel_backend`).WithArgs(4711, "mod-reporting:diku").
+					WillReturnError(fmt.Errorf("in role transaction: %w", pgx.ErrNoRows))
+			},
+			status: http.StatusNotFound,
+			errorstr: "no query with pid 4711 is running for this tenant",
+		},
+		{
+			name: "not permitted",
+			establishMock: func(mock pgxmock.PgxPoolIface) {
+				mock.ExpectQuery(`SELECT pg_cancel_backend`).WithArgs(4711, "mod-reporting:diku").
+					WillReturnError(errors.New("permission denied to cancel query"))
+			},
+			errorstr: "could not cancel query 4711: permission denied",
+		},
+	}
+
+	for _, test := range stopTests {
+		t.Run(test.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			assert.Nil(t, err)
+			defer mock.Close()
+			test.establishMock(mock)
+
+			err = stopRunningQuery(mock, "mod-reporting:diku", 4711, test.terminate)
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+				var he *httpError
+				assert.Equal(t, test.status != 0, errors.As(err, &he))
+				if he != nil {
+					assert.Equal(t, test.status, he.status)
+				}
+			}
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+
+func Test_queryHandlers(t *testing.T) {
+	ts := MakeDummyModSettingsServer()
+	defer ts.Close()
+	server, err := MakeConfiguredServer("../etc/silent.json", ".")
+	assert.Nil(t, err)
+	session, err := NewModReportingSession(server, ts.URL, "diku")
+	assert.Nil(t, err)
+	mock, err := pgxmock.NewPool()
+	assert.Nil(t, err)
+	useMockDb(session, mock)
+
+	t.Run("list", func(t *testing.T) {
+		mock.ExpectQuery(`FROM pg_stat_activity`).WithArgs("mod-reporting:diku").
+			WillReturnRows(pgxmock.NewRows([]string{"pid", "usename", "state", "query_start", "elapsed", "query"}))
+		w := httptest.NewRecorder()
+		err := handleRunningQueries(w, httptest.NewRequest("GET", "/ldp/db/queries", nil), session)
+		assert.Nil(t, err)
+		assert.Equal(t, "[]", w.Body.String())
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		mock.ExpectQuery(`SELECT pg_cancel_backend`).WithArgs(4711, "mod-reporting:diku").
+			WillReturnRows(pgxmock.NewRows([]string{"ok"}).AddRow(true))
+		w := httptest.NewRecorder()
+		err := handleStopQuery(w, httptest.NewRequest("DELETE", "/ldp/db/queries/4711", nil), session)
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("bad pid", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		err := handleStopQuery(w, httptest.NewRequest("DELETE", "/ldp/db/queries/all", nil), &ModReportingSession{})
+		assert.ErrorContains(t, err, "bad query pid 'all'")
+	})
+}
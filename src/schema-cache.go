@@ -0,0 +1,198 @@
+// Per-session cache of the reporting database's tables and columns
+package main
+
+import "context"
+import "fmt"
+import "sync"
+import "time"
+import "slices"
+import "net/http"
+import "encoding/json"
+import "github.com/jackc/pgx/v5/pgtype"
+
+
+const defaultSchemaCacheTTL = 300 // seconds
+const defaultSchemaCacheCheckInterval = 10 // seconds
+
+
+// Cached lists of tables and columns are discarded together when:
+// the TTL expires; MetaDB's metadb.table_update records a change more
+// recent than any seen when they were cached; a different database
+// connection is used; or the cache is explicitly flushed.
+type schemaCache struct {
+	ttl time.Duration
+	checkInterval time.Duration
+	mutex sync.Mutex
+	generation uint64 // incremented whenever the cache is cleared
+	dbConn PgxIface // the connection the cached data came from
+	started time.Time // when the current generation began
+	checked time.Time // when metadb.table_update was last consulted
+	lastUpdate time.Time // the most recent update recorded there
+	tables map[string][]dbTable // keyed by serialized visibility rules
+	columns map[string][]dbColumn // keyed by schema and table
+}
+
+
+// Returns nil if caching is disabled. All methods can be called on a
+// nil cache, in which case they go directly to the database.
+func newSchemaCache(cfg schemaCacheConfig) *schemaCache {
+	if cfg.Disabled {
+		return nil
+	}
+
+	ttl := cfg.TTL
+	if ttl == 0 {
+		ttl = defaultSchemaCacheTTL
+	}
+	checkInterval := cfg.CheckInterval
+	if checkInterval == 0 {
+		checkInterval = defaultSchemaCacheCheckInterval
+	}
+
+	cache := schemaCache{
+		ttl: time.Duration(ttl) * time.Second,
+		checkInterval: time.Duration(checkInterval) * time.Second,
+	}
+	cache.clear()
+	return &cache
+}
+
+
+// Must be called with the mutex held
+func (cache *schemaCache) clear() {
+	cache.generation++
+	cache.started = time.Time{}
+	cache.tables = map[string][]dbTable{}
+	cache.columns = map[string][]dbColumn{}
+}
+
+
+func (cache *schemaCache) flush() {
+	if cache == nil {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.clear()
+}
+
+
+// Discards cached data if it is stale, and returns the generation to
+// which newly fetched data should belong
+func (cache *schemaCache) prepare(dbConn PgxIface, isMetaDB bool) (uint64, error) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	now := time.Now()
+	if dbConn != cache.dbConn {
+		cache.clear()
+		cache.dbConn = dbConn
+		cache.checked = time.Time{}
+		cache.lastUpdate = time.Time{}
+	} else if !cache.started.IsZero() && now.Sub(cache.started) > cache.ttl {
+		cache.clear()
+	}
+
+	if isMetaDB && now.Sub(cache.checked) >= cache.checkInterval {
+		lastUpdate, err := fetchLastUpdate(dbConn)
+		if err != nil {
+			return 0, err
+		}
+		if lastUpdate.After(cache.lastUpdate) {
+			cache.clear()
+			cache.lastUpdate = lastUpdate
+		}
+		cache.checked = now
+	}
+
+	if cache.started.IsZero() {
+		cache.started = now
+	}
+	return cache.generation, nil
+}
+
+
+func fetchLastUpdate(dbConn PgxIface) (time.Time, error) {
+	query := "SELECT max(last_update) FROM metadb.table_update"
+	var lastUpdate pgtype.Timestamptz
+	err := dbConn.QueryRow(context.Background(), query).Scan(&lastUpdate)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not run query '%s': %w", query, err)
+	}
+	return lastUpdate.Time, nil
+}
+
+
+// Callers may modify the returned list, as handleTables does when adding details
+func (cache *schemaCache) fetchTables(dbConn PgxIface, isMetaDB bool, rules *visibilityRules) ([]dbTable, error) {
+	if cache == nil {
+		return fetchTables(dbConn, isMetaDB, rules)
+	}
+
+	bytes, err := json.Marshal(rules)
+	if err != nil {
+		return nil, fmt.Errorf("could not serialize visibility rules: %w", err)
+	}
+	key := string(bytes)
+
+	generation, err := cache.prepare(dbConn, isMetaDB)
+	if err != nil {
+		return nil, err
+	}
+	cache.mutex.Lock()
+	tables, ok := cache.tables[key]
+	cache.mutex.Unlock()
+	if ok {
+		return slices.Clone(tables), nil
+	}
+
+	tables, err = fetchTables(dbConn, isMetaDB, rules)
+	if err != nil {
+		return nil, err
+	}
+	cache.mutex.Lock()
+	if cache.generation == generation {
+		cache.tables[key] = tables
+	}
+	cache.mutex.Unlock()
+	return slices.Clone(tables), nil
+}
+
+
+func (cache *schemaCache) fetchColumns(dbConn PgxIface, isMetaDB bool, schema string, table string) ([]dbColumn, error) {
+	if cache == nil {
+		return fetchColumns(dbConn, schema, table)
+	}
+
+	key := schema + "\x00" + table
+	generation, err := cache.prepare(dbConn, isMetaDB)
+	if err != nil {
+		return nil, err
+	}
+	cache.mutex.Lock()
+	columns, ok := cache.columns[key]
+	cache.mutex.Unlock()
+	if ok {
+		return slices.Clone(columns), nil
+	}
+
+	columns, err = fetchColumns(dbConn, schema, table)
+	if err != nil {
+		return nil, err
+	}
+	cache.mutex.Lock()
+	if cache.generation == generation {
+		cache.columns[key] = columns
+	}
+	cache.mutex.Unlock()
+	return slices.Clone(columns), nil
+}
+
+
+func handleSchemaCache(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error {
+	session.flushSchemaCaches()
+	session.Log("cache", "flushed schema cache for tenant", session.tenant)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import "testing"
+import "time"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+// LDP Classic, so that there are no checks of metadb.table_update
+func establishMockForClassicTables(mock pgxmock.PgxPoolIface) {
+	mock.ExpectQuery("FROM information_schema.tables WHERE table_schema IN").
+		WillReturnRows(pgxmock.NewRows([]string{"table_name", "schema_name"}).
+			AddRow("users", "public").
+			AddRow("loans", "local"))
+	establishMockForReadableTables(mock, 1, 2)
+}
+
+
+func Test_schemaCache(t *testing.T) {
+	expected := []dbTable{
+		{ SchemaName: "public", TableName: "users" },
+		{ SchemaName: "local", TableName: "loans" },
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		assert.Nil(t, newSchemaCache(schemaCacheConfig{Disabled: true}))
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		establishMockForClassicTables(mock)
+		establishMockForClassicTables(mock)
+
+		var cache *schemaCache
+		for i := 0; i < 2; i++ {
+			tables, err := cache.fetchTables(mock, false, nil)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, tables)
+		}
+		cache.flush()
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("tables and columns are cached", func(t *testing.T) {
+		cache := newSchemaCache(schemaCacheConfig{})
+		assert.Equal(t, 300 * time.Second, cache.ttl)
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		establishMockForClassicTables(mock)
+		mock.ExpectQuery("FROM information_schema.columns").
+			WithArgs("public", "users").
+			WillReturnRows(pgxmock.NewRows([]string{"column_name", "data_type", "ordinal_position", "table_schema", "table_name",
+				"is_nullable", "column_default", "comment", "is_primary_key", "indexes", "element_type", "is_json"}).
+				AddRow("id", "uuid", "1", "public", "users", false, nil, nil, true, []string{}, nil, false))
+
+		for i := 0; i < 2; i++ {
+			tables, err := cache.fetchTables(mock, false, nil)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, tables)
+			// Modifying the result must not affect the cache
+			tables[0].Kind = "table"
+
+			columns, err := cache.fetchColumns(mock, false, "public", "users")
+			assert.Nil(t, err)
+			assert.Equal(t, 1, len(columns))
+		}
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("tables are cached separately for different visibility rules", func(t *testing.T) {
+		cache := newSchemaCache(schemaCacheConfig{})
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		establishMockForClassicTables(mock)
+		mock.ExpectQuery("FROM information_schema.tables WHERE table_schema IN").
+			WillReturnRows(pgxmock.NewRows([]string{"table_name", "schema_name"}).
+				AddRow("users", "public").
+				AddRow("loans", "local"))
+		establishMockForReadableTables(mock, 1)
+
+		tables, err := cache.fetchTables(mock, false, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, tables)
+		tables, err = cache.fetchTables(mock, false, &visibilityRules{ExcludeSchemas: []string{"local"}})
+		assert.Nil(t, err)
+		assert.Equal(t, expected[:1], tables)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("flush, expiry and new connection", func(t *testing.T) {
+		cache := newSchemaCache(schemaCacheConfig{})
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		establishMockForClassicTables(mock)
+		establishMockForClassicTables(mock)
+		establishMockForClassicTables(mock)
+
+		_, err = cache.fetchTables(mock, false, nil)
+		assert.Nil(t, err)
+		cache.flush()
+		_, err = cache.fetchTables(mock, false, nil)
+		assert.Nil(t, err)
+		cache.started = time.Now().Add(-301 * time.Second)
+		_, err = cache.fetchTables(mock, false, nil)
+		assert.Nil(t, err)
+		assert.Nil(t, mock.ExpectationsWereMet())
+
+		mock2, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock2.Close()
+		establishMockForClassicTables(mock2)
+		_, err = cache.fetchTables(mock2, false, nil)
+		assert.Nil(t, err)
+		assert.Nil(t, mock2.ExpectationsWereMet())
+	})
+
+	t.Run("refreshed when MetaDB is updated", func(t *testing.T) {
+		cache := newSchemaCache(schemaCacheConfig{CheckInterval: 60})
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		lastUpdate := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+		establishMockForTables(mock)
+		establishMockForLastUpdate(mock, lastUpdate)
+		establishMockForLastUpdate(mock, lastUpdate.Add(time.Minute))
+		mock.ExpectQuery("SELECT schema_name, table_name FROM metadb.base_table").
+			WillReturnRows(pgxmock.NewRows([]string{"schema_name", "table_name"}).
+				AddRow("folio_inventory", "records_instances"))
+		establishMockForReadableTables(mock, 1)
+
+		// Within the check interval, there is no check
+		_, err = cache.fetchTables(mock, true, nil)
+		assert.Nil(t, err)
+		_, err = cache.fetchTables(mock, true, nil)
+		assert.Nil(t, err)
+		// No update since the tables were cached
+		cache.checked = time.Time{}
+		_, err = cache.fetchTables(mock, true, nil)
+		assert.Nil(t, err)
+		// An update
+		cache.checked = time.Time{}
+		tables, err := cache.fetchTables(mock, true, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(tables))
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("flush endpoint", func(t *testing.T) {
+		server, err := MakeConfiguredServer("../etc/silent.json", ".")
+		assert.Nil(t, err)
+		session, err := NewModReportingSession(server, "http://localhost:9130", "t1")
+		assert.Nil(t, err)
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		cache := useMockDb(session, mock).schemaCache
+		cache.tables["null"] = expected
+		w := httptest.NewRecorder()
+		err = handleSchemaCache(w, httptest.NewRequest("DELETE", "/ldp/db/cache", nil), session)
+		assert.Nil(t, err)
+		assert.Equal(t, 204, w.Code)
+		assert.Equal(t, 0, len(cache.tables))
+	})
+}
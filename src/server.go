@@ -1,6 +1,7 @@
 package main
 
 import "fmt"
+import "errors"
 import "net/http"
 import "time"
 import "strings"
@@ -9,13 +10,17 @@ import "github.com/MikeTaylor/catlogger"
 
 type handlerFn func(w http.ResponseWriter, req *http.Request, session *ModReportingSession) error
 
+// Time allowed for a response to be written, from when the request was read
+const serverWriteTimeout = 30 * time.Second
+
 
 type ModReportingServer struct {
 	config *config
 	logger *catlogger.Logger
 	root string
 	server http.Server
-	sessions map[string]*ModReportingSession
+	sessions *sessionRegistry
+	limits *concurrencyLimits
 }
 
 
@@ -30,10 +35,11 @@ func MakeModReportingServer(cfg *config, logger *catlogger.Logger, root string)
 		root: root,
 		server: http.Server{
 			ReadTimeout:  30 * time.Second,
-			WriteTimeout: 30 * time.Second,
+			WriteTimeout: serverWriteTimeout,
 			Handler: mux,
 		},
-		sessions: map[string]*ModReportingSession{},
+		sessions: newSessionRegistry(cfg.Sessions),
+		limits: newConcurrencyLimits(cfg.Concurrency),
 	}
 
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { handler(w, r, &server) })
@@ -55,28 +61,35 @@ func (server *ModReportingServer) launch() error {
 	cfg := server.config
 	hostspec := cfg.Listen.Host + ":" + fmt.Sprint(cfg.Listen.Port)
 	server.server.Addr = hostspec
+
+	reapInterval := cfg.Sessions.ReapInterval
+	if reapInterval == 0 {
+		reapInterval = defaultSessionReapInterval
+	}
+	done := make(chan struct{})
+	go server.sessions.reap(time.Duration(reapInterval) * time.Second, done)
+
 	server.Log("listen", "listening on", hostspec)
 	err := server.server.ListenAndServe()
 	server.Log("listen", "finished listening on", hostspec)
+	close(done)
+	server.sessions.closeAll()
 	return err
 }
 
 
-// We maintain a map of tenant:url to session
-func (server *ModReportingServer) findSession(url string, tenant string) (*ModReportingSession, error) {
+// We maintain a registry of sessions keyed by tenant:url. The caller
+// must call the returned function when it has finished with the session.
+func (server *ModReportingServer) findSession(url string, tenant string) (*ModReportingSession, func(), error) {
 	key := tenant + ":" + url
-	session := server.sessions[key]
-	if session != nil {
-		return session, nil
-	}
-
-	session, err := NewModReportingSession(server, url, tenant)
+	session, err := server.sessions.acquire(key, func() (*ModReportingSession, error) {
+		return NewModReportingSession(server, url, tenant)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("could not create session for key '%s': %w", key, err)
+		return nil, nil, fmt.Errorf("could not create session for key '%s': %w", key, err)
 	}
 
-	server.sessions[key] = session
-	return session, nil
+	return session, func() { server.sessions.release(key) }, nil
 }
 
 
@@ -90,6 +103,10 @@ func handler(w http.ResponseWriter, req *http.Request, server *ModReportingServe
 This is <a href="https://github.com/indexdata/mod-reporting">mod-reporting</a>. Try:
 <ul>
   <li><a href="/admin/health">Health check</a></li>
+  <li><a href="/admin/live">Liveness</a></li>
+  <li><a href="/admin/ready">Readiness</a></li>
+  <li><a href="/admin/status">Status of databases</a></li>
+  <li><a href="/admin/sessions">Session metrics</a></li>
   <li><a href="/htdocs/">Static area</a></li>
   <li><a href="/ldp/config">Legacy configuration WSAPI</a></li>
   <li><a href="/ldp/db/tables">List tables from reporting database</a></li>
@@ -99,6 +116,31 @@ This is <a href="https://github.com/indexdata/mod-reporting">mod-reporting</a>.
 	} else if path == "/admin/health" {
 		fmt.Fprintln(w, "Behold! I live!!")
 		return
+	} else if path == "/admin/live" {
+		handleLiveness(w)
+		return
+	} else if path == "/admin/ready" {
+		handleReadiness(w, server)
+		return
+	} else if path == "/admin/status" {
+		handleStatus(w, server)
+		return
+	} else if path == "/admin/sessions" {
+		handleSessionMetrics(w, server)
+		return
+	}
+
+	if strings.HasPrefix(path, "/ldp/db/") {
+		cw := newCompressingWriter(w, req, server.config.Compression)
+		if cw != nil {
+			defer func() {
+				err := cw.Close()
+				if err != nil {
+					server.Log("error", fmt.Sprintf("%s: could not finish compressed response: %s", req.RequestURI, err))
+				}
+			}()
+			w = cw
+		}
 	}
 
 	if path == "/ldp/config" {
@@ -109,10 +151,24 @@ This is <a href="https://github.com/indexdata/mod-reporting">mod-reporting</a>.
 		runWithErrorHandling(w, req, server, handleTables)
 	} else if path == "/ldp/db/columns" {
 		runWithErrorHandling(w, req, server, handleColumns)
+	} else if path == "/ldp/db/columns/search" {
+		runWithErrorHandling(w, req, server, handleColumnSearch)
+	} else if path == "/ldp/db/cache" && req.Method == "DELETE" {
+		runWithErrorHandling(w, req, server, handleSchemaCache)
+	} else if path == "/ldp/db/jsonpaths" {
+		runWithErrorHandling(w, req, server, handleJsonPaths)
+	} else if path == "/ldp/db/preview" {
+		runWithErrorHandling(w, req, server, handlePreview)
+	} else if path == "/ldp/db/relationships" {
+		runWithErrorHandling(w, req, server, handleRelationships)
 	} else if path == "/ldp/db/query" && req.Method == "POST" {
 		runWithErrorHandling(w, req, server, handleQuery)
 	} else if path == "/ldp/db/reports" && req.Method == "POST" {
 		runWithErrorHandling(w, req, server, handleReport)
+	} else if path == "/ldp/db/queries" && req.Method == "GET" {
+		runWithErrorHandling(w, req, server, handleRunningQueries)
+	} else if strings.HasPrefix(path, "/ldp/db/queries/") && req.Method == "DELETE" {
+		runWithErrorHandling(w, req, server, handleStopQuery)
 	} else {
 		// Unrecognized
 		w.WriteHeader(http.StatusNotFound)
@@ -124,18 +180,31 @@ This is <a href="https://github.com/indexdata/mod-reporting">mod-reporting</a>.
 func runWithErrorHandling(w http.ResponseWriter, req *http.Request, server *ModReportingServer, f handlerFn) {
 	host := req.Header.Get("X-Okapi-Url")
 	tenant := req.Header.Get("X-Okapi-Tenant")
-	session, err := server.findSession(host, tenant)
+	session, release, err := server.findSession(host, tenant)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "could not make session: %s\n", err)
 		server.Log("error", fmt.Sprintf("%s: %s", req.RequestURI, err.Error()))
 		return
 	}
+	defer release()
 
 	err = f(w, req, session)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintln(w, err.Error())
+		// A streamed response will already have reported its own error
+		var se *streamedError
+		if !errors.As(err, &se) {
+			status := http.StatusInternalServerError
+			var he *httpError
+			if errors.As(err, &he) {
+				status = he.status
+				if he.retryAfter != 0 {
+					w.Header().Set("Retry-After", fmt.Sprint(he.retryAfter))
+				}
+			}
+			w.WriteHeader(status)
+			fmt.Fprintln(w, err.Error())
+		}
 		session.Log("error", fmt.Sprintf("%s: %s", req.RequestURI, err.Error()))
 	}
 }
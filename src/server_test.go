@@ -19,7 +19,7 @@ func Test_server(t *testing.T) {
 	assert.Nil(t, err)
 	session, err := NewModReportingSession(server, ts.URL, "t1")
 	assert.Nil(t, err)
-	server.sessions[":" + ts.URL] = session
+	server.sessions.add(":" + ts.URL, session)
 
 	go func() {
 		err = server.launch()
@@ -48,6 +48,18 @@ func runTests(t *testing.T, baseUrl string, session *ModReportingSession) {
 			status: 200,
 			expected: "Behold!",
 		},
+		{
+			name: "liveness",
+			path: "admin/live",
+			status: 200,
+			expected: "OK",
+		},
+		{
+			name: "session metrics",
+			path: "admin/sessions",
+			status: 200,
+			expected: `{"live":1,"created":1,"evicted":0,"sessions":\[{"tenant":"t1","url":"` + baseUrl + `","idleSeconds":\d+,"active":0,"connected":(true|false)}\]}`,
+		},
 		{
 			name: "short bad path",
 			path: "foo",
@@ -100,7 +112,10 @@ func runTests(t *testing.T, baseUrl string, session *ModReportingSession) {
 				return establishMockForColumns(data.(pgxmock.PgxPoolIface))
 			},
 			status: 200,
-			expected: `{"columnName":"id","data_type":"uuid","tableSchema":"folio_users","tableName":"users","ordinalPosition":"6"},{"columnName":"creation_date","data_type":"timestamp without time zone","tableSchema":"folio_users","tableName":"users","ordinalPosition":"8"}]`,
+			expected: `\[{"columnName":"id","data_type":"uuid","tableSchema":"folio_users","tableName":"users","ordinalPosition":"6","isNullable":false,"comment":"Unique identifier","isPrimaryKey":true,"indexes":\["users_pkey"\],"isJson":false},` +
+				`{"columnName":"creation_date","data_type":"timestamp without time zone","tableSchema":"folio_users","tableName":"users","ordinalPosition":"8","isNullable":true,"default":"now\(\)","isPrimaryKey":false,"indexes":\[\],"isJson":false},` +
+				`{"columnName":"tags","data_type":"ARRAY","tableSchema":"folio_users","tableName":"users","ordinalPosition":"9","isNullable":true,"isPrimaryKey":false,"indexes":\[\],"elementType":"text","isJson":false},` +
+				`{"columnName":"data","data_type":"jsonb","tableSchema":"folio_users","tableName":"users","ordinalPosition":"10","isNullable":true,"isPrimaryKey":false,"indexes":\["users_data_idx"\],"isJson":true}\]`,
 		},
 		{
 			name: "reporting query",
@@ -148,8 +163,7 @@ func runTests(t *testing.T, baseUrl string, session *ModReportingSession) {
 				err = d.establishMock(mock)
 				assert.Nil(t, err)
 			}
-			session.dbConn = mock
-			session.isMDB = true // Mock expectations are as for MetaDB
+			useMockDb(session, mock)
 
 			client := http.Client{}
 			resp, err := client.Do(req)
@@ -0,0 +1,270 @@
+// Concurrency-safe registry of sessions, one per tenant and Okapi URL
+package main
+
+import "fmt"
+import "sort"
+import "sync"
+import "time"
+import "net/http"
+
+
+const defaultSessionIdleTimeout = 3600 // seconds
+const defaultSessionReapInterval = 60 // seconds
+
+
+// An entry is added before its session is created, so that concurrent
+// requests for the same key wait for a single creation rather than
+// each making their own session and database pool
+type sessionEntry struct {
+	ready chan struct{} // closed when creation has finished
+	session *ModReportingSession
+	err error
+	lastUsed time.Time
+	active int // requests currently using the session
+}
+
+type sessionRegistry struct {
+	mutex sync.Mutex
+	entries map[string]*sessionEntry
+	idleTimeout time.Duration
+	created int
+	evicted int
+}
+
+type sessionStatus struct {
+	Tenant string `json:"tenant"`
+	Url string `json:"url"`
+	IdleSeconds int `json:"idleSeconds"`
+	Active int `json:"active"`
+	Connected bool `json:"connected"`
+}
+
+type sessionMetrics struct {
+	Live int `json:"live"`
+	Created int `json:"created"`
+	Evicted int `json:"evicted"`
+	Sessions []sessionStatus `json:"sessions"`
+}
+
+
+func newSessionRegistry(cfg sessionsConfig) *sessionRegistry {
+	idleTimeout := cfg.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultSessionIdleTimeout
+	}
+	return &sessionRegistry{
+		entries: map[string]*sessionEntry{},
+		idleTimeout: time.Duration(idleTimeout) * time.Second,
+	}
+}
+
+
+// Returns the session for the key, creating it if necessary. The
+// caller must call release when it has finished using the session, so
+// that it is not evicted while in use. If creation fails, nothing is
+// registered, so that the next request tries again.
+func (registry *sessionRegistry) acquire(key string, create func() (*ModReportingSession, error)) (*ModReportingSession, error) {
+	registry.mutex.Lock()
+	entry := registry.entries[key]
+	if entry == nil {
+		entry = &sessionEntry{ready: make(chan struct{})}
+		registry.entries[key] = entry
+		entry.active++
+		registry.mutex.Unlock()
+
+		session, err := create()
+		registry.mutex.Lock()
+		entry.session, entry.err = session, err
+		entry.lastUsed = time.Now()
+		if err != nil {
+			delete(registry.entries, key)
+		} else {
+			registry.created++
+		}
+		close(entry.ready)
+		registry.mutex.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return session, nil
+	}
+
+	entry.active++
+	registry.mutex.Unlock()
+	<-entry.ready
+	if entry.err != nil {
+		// Nothing to release, as the entry has been discarded
+		return nil, entry.err
+	}
+
+	registry.mutex.Lock()
+	entry.lastUsed = time.Now()
+	registry.mutex.Unlock()
+	return entry.session, nil
+}
+
+
+func (registry *sessionRegistry) release(key string) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	entry := registry.entries[key]
+	if entry != nil {
+		entry.active--
+		entry.lastUsed = time.Now()
+	}
+}
+
+
+// Registers an existing session: used by tests
+func (registry *sessionRegistry) add(key string, session *ModReportingSession) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	entry := &sessionEntry{ready: make(chan struct{}), session: session, lastUsed: time.Now()}
+	close(entry.ready)
+	registry.entries[key] = entry
+	registry.created++
+}
+
+
+// Removes sessions that have not been used for longer than the idle
+// timeout and are not in use, closing their database pools. Returns
+// the number of sessions evicted.
+func (registry *sessionRegistry) evictIdle(now time.Time) int {
+	registry.mutex.Lock()
+	idle := []*ModReportingSession{}
+	for key, entry := range registry.entries {
+		if entry.active == 0 && entry.session != nil && now.Sub(entry.lastUsed) > registry.idleTimeout {
+			idle = append(idle, entry.session)
+			delete(registry.entries, key)
+		}
+	}
+	registry.evicted += len(idle)
+	registry.mutex.Unlock()
+
+	// Closing a pool waits for its connections to be released, so is
+	// done without holding the lock
+	for _, session := range idle {
+		session.Log("sessions", fmt.Sprintf("evicting idle session for tenant '%s' at %s", session.tenant, session.url))
+		session.closeDbConn()
+	}
+	return len(idle)
+}
+
+
+// Runs until done is closed
+func (registry *sessionRegistry) reap(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			registry.evictIdle(now)
+		}
+	}
+}
+
+
+// There may be several, if the tenant is reached through several URLs
+func (registry *sessionRegistry) tenantSessions(tenant string) []*ModReportingSession {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	sessions := []*ModReportingSession{}
+	for _, entry := range registry.entries {
+		if entry.session != nil && entry.session.tenant == tenant {
+			sessions = append(sessions, entry.session)
+		}
+	}
+	return sessions
+}
+
+
+// Closes the database connections of all the tenant's sessions, so
+// that they reconnect when next used
+func (registry *sessionRegistry) resetTenant(tenant string) int {
+	sessions := registry.tenantSessions(tenant)
+	for _, session := range sessions {
+		session.closeDbConn()
+	}
+	return len(sessions)
+}
+
+
+func (registry *sessionRegistry) closeAll() {
+	registry.mutex.Lock()
+	sessions := []*ModReportingSession{}
+	for key, entry := range registry.entries {
+		if entry.session != nil {
+			sessions = append(sessions, entry.session)
+		}
+		delete(registry.entries, key)
+	}
+	registry.mutex.Unlock()
+
+	for _, session := range sessions {
+		session.closeDbConn()
+	}
+}
+
+
+func (registry *sessionRegistry) metrics(now time.Time) sessionMetrics {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	m := sessionMetrics{
+		Created: registry.created,
+		Evicted: registry.evicted,
+		Sessions: []sessionStatus{},
+	}
+	for _, entry := range registry.entries {
+		if entry.session == nil {
+			// Still being created
+			continue
+		}
+		m.Sessions = append(m.Sessions, sessionStatus{
+			Tenant: entry.session.tenant,
+			Url: entry.session.url,
+			IdleSeconds: int(now.Sub(entry.lastUsed).Seconds()),
+			Active: entry.active,
+			Connected: entry.session.hasDbConn(),
+		})
+	}
+	m.Live = len(m.Sessions)
+	sort.Slice(m.Sessions, func(i, j int) bool {
+		a, b := m.Sessions[i], m.Sessions[j]
+		return a.Tenant < b.Tenant || (a.Tenant == b.Tenant && a.Url < b.Url)
+	})
+	return m
+}
+
+
+// Sessions that have been created, in order of tenant and URL
+func (registry *sessionRegistry) liveSessions() []*ModReportingSession {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	sessions := []*ModReportingSession{}
+	for _, entry := range registry.entries {
+		if entry.session != nil {
+			sessions = append(sessions, entry.session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		a, b := sessions[i], sessions[j]
+		return a.tenant < b.tenant || (a.tenant == b.tenant && a.url < b.url)
+	})
+	return sessions
+}
+
+
+func handleSessionMetrics(w http.ResponseWriter, server *ModReportingServer) {
+	err := sendJSON(w, server.sessions.metrics(time.Now()), "session metrics")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintln(w, err.Error())
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import "testing"
+import "fmt"
+import "sync"
+import "time"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func Test_sessionRegistry(t *testing.T) {
+	server, err := MakeConfiguredServer("../etc/silent.json", ".")
+	assert.Nil(t, err)
+
+	t.Run("single-flight creation", func(t *testing.T) {
+		registry := newSessionRegistry(sessionsConfig{})
+		var mutex sync.Mutex
+		calls := 0
+		create := func() (*ModReportingSession, error) {
+			mutex.Lock()
+			calls++
+			mutex.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			return &ModReportingSession{server: server, tenant: "t1"}, nil
+		}
+
+		var wg sync.WaitGroup
+		sessions := make([]*ModReportingSession, 10)
+		for i := range sessions {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				session, err := registry.acquire("t1:", create)
+				assert.Nil(t, err)
+				sessions[i] = session
+			}(i)
+		}
+		wg.Wait()
+
+		assert.Equal(t, 1, calls)
+		for _, session := range sessions {
+			assert.Same(t, sessions[0], session)
+		}
+		assert.Equal(t, 10, registry.entries["t1:"].active)
+		for range sessions {
+			registry.release("t1:")
+		}
+		assert.Equal(t, 0, registry.entries["t1:"].active)
+	})
+
+	t.Run("failed creation is not registered", func(t *testing.T) {
+		registry := newSessionRegistry(sessionsConfig{})
+		_, err := registry.acquire("t1:", func() (*ModReportingSession, error) {
+			return nil, fmt.Errorf("no such host")
+		})
+		assert.ErrorContains(t, err, "no such host")
+		assert.Equal(t, 0, len(registry.entries))
+
+		session, err := registry.acquire("t1:", func() (*ModReportingSession, error) {
+			return &ModReportingSession{server: server}, nil
+		})
+		assert.Nil(t, err)
+		assert.NotNil(t, session)
+	})
+
+	t.Run("idle eviction closes pools", func(t *testing.T) {
+		registry := newSessionRegistry(sessionsConfig{IdleTimeout: 60})
+		assert.Equal(t, 60 * time.Second, registry.idleTimeout)
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		mock.ExpectClose()
+		idle := &ModReportingSession{server: server, tenant: "idle", dbs: map[string]*reportingDb{}}
+		useMockDb(idle, mock)
+		busy := &ModReportingSession{server: server, tenant: "busy", dbs: map[string]*reportingDb{}}
+		registry.add("idle:", idle)
+		registry.add("busy:", busy)
+		_, err = registry.acquire("busy:", nil)
+		assert.Nil(t, err)
+
+		later := time.Now().Add(61 * time.Second)
+		assert.Equal(t, 1, registry.evictIdle(later))
+		assert.Nil(t, registry.entries["idle:"])
+		assert.False(t, idle.hasDbConn())
+		assert.Nil(t, mock.ExpectationsWereMet())
+
+		// No longer busy, but used just now
+		registry.release("busy:")
+		assert.Equal(t, 0, registry.evictIdle(time.Now()))
+		assert.Equal(t, 1, registry.evictIdle(later))
+	})
+
+	t.Run("reset tenant", func(t *testing.T) {
+		registry := newSessionRegistry(sessionsConfig{})
+		mock1, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		mock1.ExpectClose()
+		mock2, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		session1 := &ModReportingSession{server: server, tenant: "t1", dbs: map[string]*reportingDb{}}
+		useMockDb(session1, mock1)
+		session2 := &ModReportingSession{server: server, tenant: "t2", dbs: map[string]*reportingDb{}}
+		useMockDb(session2, mock2)
+		registry.add("t1:http://a", session1)
+		registry.add("t1:http://b", &ModReportingSession{server: server, tenant: "t1", dbs: map[string]*reportingDb{}})
+		registry.add("t2:http://a", session2)
+
+		assert.Equal(t, 2, registry.resetTenant("t1"))
+		assert.Nil(t, mock1.ExpectationsWereMet())
+		assert.False(t, registry.entries["t1:http://a"].session.hasDbConn())
+		assert.True(t, registry.entries["t2:http://a"].session.hasDbConn())
+		assert.Equal(t, 0, registry.resetTenant("t3"))
+	})
+
+	t.Run("metrics and shutdown", func(t *testing.T) {
+		registry := newSessionRegistry(sessionsConfig{})
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		mock.ExpectClose()
+		session := &ModReportingSession{server: server, tenant: "t1", url: "http://a", dbs: map[string]*reportingDb{}}
+		useMockDb(session, mock)
+		registry.add("t2:http://b", &ModReportingSession{server: server, tenant: "t2", url: "http://b"})
+		registry.add("t1:http://a", session)
+
+		m := registry.metrics(time.Now())
+		assert.Equal(t, 2, m.Live)
+		assert.Equal(t, 2, m.Created)
+		assert.Equal(t, 0, m.Evicted)
+		assert.Equal(t, "t1", m.Sessions[0].Tenant)
+		assert.True(t, m.Sessions[0].Connected)
+		assert.False(t, m.Sessions[1].Connected)
+
+		registry.closeAll()
+		assert.Equal(t, 0, registry.metrics(time.Now()).Live)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+}
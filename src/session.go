@@ -1,8 +1,11 @@
 package main
 
 import "context"
-import "strings"
+import "errors"
 import "fmt"
+import "sync"
+import "time"
+import "net/http"
 import "github.com/indexdata/foliogo"
 import "github.com/jackc/pgx/v5"
 import "github.com/jackc/pgx/v5/pgxpool"
@@ -11,19 +14,33 @@ import "github.com/jackc/pgx/v5/pgconn" // just for the data-type pgconn.Command
 
 type PgxIface interface {
 	Begin(context.Context) (pgx.Tx, error)
+	BeginTx(context.Context, pgx.TxOptions) (pgx.Tx, error)
 	Query(context.Context, string, ...any) (pgx.Rows, error)
 	QueryRow(context.Context, string, ...any) pgx.Row
 	Exec(context.Context, string, ...any) (pgconn.CommandTag, error)
+	Ping(context.Context) error
 	Close()
 }
 
+const defaultDbInfoCheckInterval = 60 // seconds
+
+
 type ModReportingSession struct {
 	server *ModReportingServer // back-reference
 	url string
 	tenant string
 	folioSession foliogo.Session
-	dbConn PgxIface
-	isMDB bool
+	dbMutex sync.Mutex // guards the following, but is not held while connecting
+	dbs map[string]*reportingDb // keyed by name, "" for the default
+	breakers map[string]*circuitBreaker // keyed by name, outliving connections
+	connecting map[string]*dbConnect // keyed as dbs
+	dbGeneration int // incremented whenever connections are discarded
+	settingsMutex sync.Mutex // guards the following, which are read without dbMutex
+	settingsChecked time.Time // when dbinfo was last fetched
+	settingsError error // from that fetch
+	visibilityMutex sync.Mutex // guards the following
+	visibility *visibilityRules // cached, nil if there is no setting
+	visibilityFetched time.Time // zero if not cached
 }
 
 
@@ -45,6 +62,9 @@ func NewModReportingSession(server *ModReportingServer, url string, tenant strin
 		server: server,
 		url: url,
 		tenant: tenant,
+		dbs: map[string]*reportingDb{},
+		breakers: map[string]*circuitBreaker{},
+		connecting: map[string]*dbConnect{},
 	}
 
 	if url != "" {
@@ -76,42 +96,345 @@ func (session *ModReportingSession)Log(cat string, args ...string) {
 }
 
 
-func (session *ModReportingSession)makeDbConn(token string) (PgxIface, bool, error) {
-	dbUrl, dbUser, dbPass, err := getDbInfo(session.folioSession, token)
-	if err != nil {
-		return nil, false, fmt.Errorf("cannot extract data from 'dbinfo': %w", err)
+func (session *ModReportingSession) databaseDefaults() databaseConfig {
+	if session.server == nil {
+		// Some tests make sessions without a server
+		return databaseConfig{}
 	}
-	session.Log("db", "url=" + dbUrl + ", user=" + dbUser)
+	return session.server.config.Database
+}
+
+
+// Failures to connect count against the database's circuit breaker
+func (session *ModReportingSession)makeDbConn(dbinfo settingsValue, breaker *circuitBreaker) (PgxIface, bool, error) {
+	session.Log("db", "url=" + dbinfo.Url + ", user=" + dbinfo.User)
 
-	// For historical reasons, database connection configuration is often JDBCish
-	dbUrl = strings.Replace(dbUrl, "jdbc:postgresql://", "", 1)
-	dbUrl = strings.Replace(dbUrl, "postgres://", "", 1)
-	// We may need `?sslmode=require` on the end of the URL.
-	dbConn, err := pgxpool.New(context.Background(), "postgres://" + dbUser + ":" + dbPass + "@" + dbUrl)
+	defaults := session.databaseDefaults()
+	poolConfig, err := makePoolConfig(dbinfo, defaults)
+	if err != nil {
+		return nil, false, err
+	}
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
 	if err != nil {
 		return nil, false, fmt.Errorf("cannot connect to DB: %w", err)
 	}
+	dbConn := newResilientPool(pool, mergeDatabaseConfig(defaults, dbinfo.databaseConfig), breaker)
 
-	session.Log("db", "connected to DB", dbUrl)
+	session.Log("db", "connected to DB", poolConfig.ConnConfig.Host + "/" + poolConfig.ConnConfig.Database)
 	isMDB, err := isMetaDB(dbConn)
 	if err != nil {
+		dbConn.Close()
 		return nil, false, fmt.Errorf("cannot determine whether reporting DB is MetaDB: %w", err)
 	}
 
 	session.Log("db", fmt.Sprintf("isMetaDB=%v", isMDB))
+
+	if mergeDatabaseConfig(defaults, dbinfo.databaseConfig).RequireReadOnlyRole {
+		reason, err := findWritePrivilege(dbConn)
+		if err != nil {
+			dbConn.Close()
+			return nil, false, fmt.Errorf("cannot check privileges of reporting DB user: %w", err)
+		} else if reason != "" {
+			dbConn.Close()
+			return nil, false, fmt.Errorf("reporting DB user '%s' must be read-only, but %s", dbinfo.User, reason)
+		}
+	}
+
 	return dbConn, isMDB, nil
 }
 
 
-func (session *ModReportingSession) findDbConn(token string) (PgxIface, error) {
-	if session.dbConn == nil {
-		dbConn, isMDB, err := session.makeDbConn(token)
+func (session *ModReportingSession) fetchDbInfo(token string, name string) (settingsValue, error) {
+	dbinfo, err := getNamedDbInfo(session.folioSession, token, name)
+	session.settingsMutex.Lock()
+	session.settingsChecked = time.Now()
+	session.settingsError = err
+	session.settingsMutex.Unlock()
+	if err != nil {
+		return settingsValue{}, fmt.Errorf("cannot extract data from 'dbinfo': %w", err)
+	}
+	return dbinfo, nil
+}
+
+
+// Finds the reporting database named by the request's "db" parameter,
+// or the default if there is none, connecting to it if necessary. If
+// the database's settings map users to roles, this is the connection
+// for the role of the user making the request. Concurrent requests
+// wait for a single connection to be made, rather than each making
+// its own pool. Once connected, the stored dbinfo is re-checked every
+// dbinfoCheckInterval seconds, so that changes made through other
+// instances of the module are picked up.
+func (session *ModReportingSession) findDbConn(req *http.Request) (*reportingDb, PgxIface, error) {
+	return session.lookupDb(req, session.findDbLocked)
+}
+
+
+// As findDbConn, but always as the database's login user, whatever
+// role the FOLIO user would act as
+func (session *ModReportingSession) findLoginDbConn(req *http.Request) (*reportingDb, PgxIface, error) {
+	return session.lookupDb(req, session.findBaseDbLocked)
+}
+
+
+func (session *ModReportingSession) lookupDb(req *http.Request, find func(string, string) (*reportingDb, []PgxIface, error)) (*reportingDb, PgxIface, error) {
+	token := req.Header.Get("X-Okapi-Token")
+	name := normalizeDbName(req.URL.Query().Get("db"))
+
+	var db *reportingDb
+	var stale []PgxIface
+	var err error
+	session.dbMutex.Lock()
+	for {
+		var s []PgxIface
+		db, s, err = find(token, name)
+		stale = append(stale, s...)
+		if err != errDbReset {
+			break
+		}
+		// The connection was discarded while it was being made: start again
+	}
+	session.dbMutex.Unlock()
+
+	for _, dbConn := range stale {
+		// Waits for requests still using the old pool, so done without the lock
+		dbConn.Close()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return db, db.dbConn, nil
+}
+
+
+// Returns the database, and any old connections that must be closed.
+// Like the other ...Locked functions, this is called with dbMutex held,
+// but releases it while fetching dbinfo or connecting.
+func (session *ModReportingSession) findDbLocked(token string, name string) (*reportingDb, []PgxIface, error) {
+	db, stale, err := session.findBaseDbLocked(token, name)
+	if err != nil || db.config.UserRoleTemplate == "" {
+		return db, stale, err
+	}
+
+	// Requests that do not identify a user must not fall back to the
+	// login role, whose privileges may be greater
+	user, err := userFromToken(token)
+	if err != nil {
+		return nil, stale, fmt.Errorf("cannot determine database role: %w", err)
+	}
+	role, err := makeUserRole(db.config.UserRoleTemplate, user)
+	if err != nil {
+		return nil, stale, fmt.Errorf("cannot determine database role: %w", err)
+	}
+
+	key := roleDbKey(name, role)
+	roleDb := session.dbs[key]
+	if roleDb == nil {
+		roleDb, err = session.connectOnceLocked(key, func() (*reportingDb, error) {
+			dbConn := newRoleConn(db.dbConn, role)
+			if db.config.RequireReadOnlyRole {
+				reason, err := findWritePrivilege(dbConn)
+				if err != nil {
+					return nil, fmt.Errorf("cannot check privileges of database role '%s': %w", role, err)
+				} else if reason != "" {
+					return nil, fmt.Errorf("database role '%s' must be read-only, but %s", role, reason)
+				}
+			}
+			roleDb := newReportingDb(session, name, dbConn, db.isMDB)
+			roleDb.role = role
+			roleDb.dbInfo = db.dbInfo
+			roleDb.config = db.config
+			return roleDb, nil
+		})
 		if err != nil {
-			return nil, err
+			return nil, stale, err
 		}
-		session.dbConn = dbConn
-		session.isMDB = isMDB
 	}
+	return roleDb, stale, nil
+}
+
 
-	return session.dbConn, nil
+// The connection as the database's login user
+func (session *ModReportingSession) findBaseDbLocked(token string, name string) (*reportingDb, []PgxIface, error) {
+	var stale []PgxIface
+	now := time.Now()
+	db := session.dbs[name]
+	// Connections that were not made by makeDbConn (e.g. in tests) have no check time
+	if db != nil && !db.dbInfoChecked.IsZero() && now.Sub(db.dbInfoChecked) >= session.dbInfoCheckInterval() {
+		// Other requests carry on with the existing connection meanwhile
+		db.dbInfoChecked = now
+		session.dbMutex.Unlock()
+		dbinfo, err := session.fetchDbInfo(token, name)
+		session.dbMutex.Lock()
+		if err != nil {
+			// Better to carry on with the connection we have than to fail
+			session.Log("error", "could not re-check dbinfo, keeping existing connection:", err.Error())
+		} else if session.dbs[name] != db {
+			// Replaced or discarded while we were checking
+			db = session.dbs[name]
+		} else if dbinfo != db.dbInfo {
+			session.Log("db", "dbinfo has changed: reconnecting")
+			stale = session.removeDbLocked(name)
+			db = nil
+		}
+	}
+
+	if db == nil {
+		var err error
+		db, err = session.connectOnceLocked(name, func() (*reportingDb, error) {
+			dbinfo, err := session.fetchDbInfo(token, name)
+			if err != nil {
+				return nil, err
+			}
+			config := mergeDatabaseConfig(session.databaseDefaults(), dbinfo.databaseConfig)
+			session.dbMutex.Lock()
+			breaker := session.breakers[name]
+			if breaker == nil {
+				breaker = newCircuitBreaker(name, config, func(message string) {
+					session.Log("db", message)
+				})
+				session.breakers[name] = breaker
+			}
+			session.dbMutex.Unlock()
+			dbConn, isMDB, err := session.makeDbConn(dbinfo, breaker)
+			if err != nil {
+				return nil, err
+			}
+			db := newReportingDb(session, name, dbConn, isMDB)
+			db.dbInfo = dbinfo
+			db.dbInfoChecked = time.Now()
+			db.config = config
+			return db, nil
+		})
+		if err != nil {
+			return nil, stale, err
+		}
+	}
+
+	return db, stale, nil
+}
+
+
+// A connection being made, for which other requests wait
+type dbConnect struct {
+	done chan struct{} // closed when finished
+	db *reportingDb
+	err error
+}
+
+// The connection was discarded, for example because the database
+// settings changed, while it was being made
+var errDbReset = errors.New("database connection was reset while connecting")
+
+
+// Runs connect without dbMutex, which is held on entry and again on
+// return, and stores the database it makes under key. Only one request
+// connects for each key at a time: any others wait for its result,
+// rather than each making a pool of their own.
+func (session *ModReportingSession) connectOnceLocked(key string, connect func() (*reportingDb, error)) (*reportingDb, error) {
+	if session.connecting == nil {
+		// Some tests make sessions without NewModReportingSession
+		session.connecting = map[string]*dbConnect{}
+	}
+	c := session.connecting[key]
+	if c != nil {
+		session.dbMutex.Unlock()
+		<-c.done
+		session.dbMutex.Lock()
+		return c.db, c.err
+	}
+
+	c = &dbConnect{done: make(chan struct{})}
+	session.connecting[key] = c
+	generation := session.dbGeneration
+	session.dbMutex.Unlock()
+	c.db, c.err = connect()
+	session.dbMutex.Lock()
+
+	delete(session.connecting, key)
+	if session.dbGeneration != generation {
+		// Made from settings that are no longer current, or perhaps
+		// failed because of the reset. Nothing else has used it, so it
+		// can be closed at once.
+		if c.err == nil {
+			c.db.dbConn.Close()
+		}
+		c.db, c.err = nil, errDbReset
+	} else if c.err == nil {
+		session.dbs[key] = c.db
+	}
+	close(c.done)
+	return c.db, c.err
+}
+
+
+// Removes the named database and the connections for its roles,
+// returning their connections
+func (session *ModReportingSession) removeDbLocked(name string) []PgxIface {
+	removed := []PgxIface{}
+	for key, db := range session.dbs {
+		if db.name == name {
+			db.schemaCache.flush()
+			removed = append(removed, db.dbConn)
+			delete(session.dbs, key)
+		}
+	}
+	// The database may now be a different one
+	delete(session.breakers, name)
+	session.dbGeneration++
+	return removed
+}
+
+
+func (session *ModReportingSession) dbInfoCheckInterval() time.Duration {
+	seconds := defaultDbInfoCheckInterval
+	if session.server != nil && session.server.config.Sessions.DbInfoCheckInterval != 0 {
+		seconds = session.server.config.Sessions.DbInfoCheckInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+
+// Called when the tenant's dbinfo or databases setting has been changed
+func (session *ModReportingSession) resetDbConns() {
+	if session.server == nil {
+		// Some tests make sessions without a server
+		session.closeDbConn()
+		return
+	}
+	n := session.server.sessions.resetTenant(session.tenant)
+	session.Log("db", fmt.Sprintf("database settings changed: reset %d session(s) for tenant '%s'", n, session.tenant))
+}
+
+
+func (session *ModReportingSession) hasDbConn() bool {
+	session.dbMutex.Lock()
+	defer session.dbMutex.Unlock()
+	return len(session.dbs) > 0
+}
+
+
+// Closes the connection pools, if any, and discards the cached schemas,
+// so that the next request reconnects using the current dbinfo
+func (session *ModReportingSession) closeDbConn() {
+	session.dbMutex.Lock()
+	dbs := session.dbs
+	session.dbs = map[string]*reportingDb{}
+	session.breakers = map[string]*circuitBreaker{}
+	session.dbGeneration++
+	session.dbMutex.Unlock()
+
+	for _, db := range dbs {
+		db.schemaCache.flush()
+		db.dbConn.Close()
+	}
+}
+
+
+func (session *ModReportingSession) flushSchemaCaches() {
+	session.dbMutex.Lock()
+	defer session.dbMutex.Unlock()
+	for _, db := range session.dbs {
+		db.schemaCache.flush()
+	}
 }
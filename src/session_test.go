@@ -1,8 +1,12 @@
 package main
 
 import "os"
+import "time"
+import "sync/atomic"
 import "testing"
+import "net/http/httptest"
 import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
 
 
 func Test_session(t *testing.T) {
@@ -57,6 +61,77 @@ func Test_session(t *testing.T) {
 		session.Log("x", "exercise the logging function just for code-coverage")
 	})
 
+	req := httptest.NewRequest("GET", "/ldp/db/tables", nil)
+
+	t.Run("re-check unchanged dbinfo", func(t *testing.T) {
+		session, err := NewModReportingSession(server, ts.URL, "t1")
+		assert.Nil(t, err)
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		db := useMockDb(session, mock)
+		db.dbInfo = settingsValue{Url: "dummyUrl", User: "fiona", Pass: "pw"}
+		db.dbInfoChecked = time.Now().Add(-time.Hour)
+
+		_, dbConn, err := session.findDbConn(req)
+		assert.Nil(t, err)
+		assert.Equal(t, mock, dbConn)
+		assert.WithinDuration(t, time.Now(), db.dbInfoChecked, time.Minute)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("re-check changed dbinfo", func(t *testing.T) {
+		session, err := NewModReportingSession(server, ts.URL, "t1")
+		assert.Nil(t, err)
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		mock.ExpectClose()
+		db := useMockDb(session, mock)
+		db.dbInfo = settingsValue{Url: "oldUrl", User: "fiona", Pass: "pw"}
+		db.dbInfoChecked = time.Now().Add(-time.Hour)
+
+		// The old pool is closed, and reconnecting to the dummy URL fails
+		_, _, err = session.findDbConn(req)
+		assert.ErrorContains(t, err, "cannot determine whether reporting DB is MetaDB")
+		assert.False(t, session.hasDbConn())
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("no re-check before interval", func(t *testing.T) {
+		session, err := NewModReportingSession(server, ts.URL, "t1")
+		assert.Nil(t, err)
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		db := useMockDb(session, mock)
+		db.dbInfo = settingsValue{Url: "oldUrl"}
+		checked := time.Now().Add(-time.Second)
+		db.dbInfoChecked = checked
+
+		_, dbConn, err := session.findDbConn(req)
+		assert.Nil(t, err)
+		assert.Equal(t, mock, dbConn)
+		assert.Equal(t, checked, db.dbInfoChecked)
+	})
+
+	t.Run("named databases", func(t *testing.T) {
+		session, err := NewModReportingSession(server, ts.URL, "t1")
+		assert.Nil(t, err)
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		useMockDb(session, mock)
+
+		db, dbConn, err := session.findDbConn(httptest.NewRequest("GET", "/ldp/db/tables?db=default", nil))
+		assert.Nil(t, err)
+		assert.Equal(t, mock, dbConn)
+		assert.Equal(t, "", db.name)
+
+		// Connecting to the dummy URL of the archive database fails
+		_, _, err = session.findDbConn(httptest.NewRequest("GET", "/ldp/db/tables?db=archive", nil))
+		assert.ErrorContains(t, err, "cannot determine whether reporting DB is MetaDB")
+		_, _, err = session.findDbConn(httptest.NewRequest("GET", "/ldp/db/tables?db=other", nil))
+		assert.ErrorContains(t, err, "no reporting database named 'other'")
+		assert.Equal(t, 1, len(session.dbs))
+	})
+
         // Removing this test for now, as making the is-this-MetaDB
         // check work correctly would involve a lot of work to
         // establish a pgxmock
@@ -69,3 +144,66 @@ func Test_session(t *testing.T) {
 	})
 	*/
 }
+
+
+func Test_connectOnceLocked(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	assert.Nil(t, err)
+
+	t.Run("one connection for concurrent requests", func(t *testing.T) {
+		session := &ModReportingSession{dbs: map[string]*reportingDb{}}
+		var calls atomic.Int32
+		started := make(chan struct{})
+		proceed := make(chan struct{})
+		connect := func() (*reportingDb, error) {
+			if calls.Add(1) == 1 {
+				close(started)
+			}
+			<-proceed
+			return &reportingDb{dbConn: mock}, nil
+		}
+
+		results := make(chan *reportingDb, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				session.dbMutex.Lock()
+				defer session.dbMutex.Unlock()
+				// As the callers do, since a request that comes later
+				// may find the connection already made
+				db := session.dbs[""]
+				if db == nil {
+					var err error
+					db, err = session.connectOnceLocked("", connect)
+					assert.Nil(t, err)
+				}
+				results <- db
+			}()
+		}
+
+		<-started
+		// The lock is not held while connecting
+		session.dbMutex.Lock()
+		assert.NotNil(t, session.connecting[""])
+		session.dbMutex.Unlock()
+		close(proceed)
+
+		db1, db2 := <-results, <-results
+		assert.Same(t, db1, db2)
+		assert.Equal(t, int32(1), calls.Load())
+		assert.Same(t, db1, session.dbs[""])
+		assert.Equal(t, 0, len(session.connecting))
+	})
+
+	t.Run("reset while connecting", func(t *testing.T) {
+		session := &ModReportingSession{dbs: map[string]*reportingDb{}}
+		session.dbMutex.Lock()
+		db, err := session.connectOnceLocked("", func() (*reportingDb, error) {
+			session.closeDbConn()
+			return &reportingDb{dbConn: mock}, nil
+		})
+		session.dbMutex.Unlock()
+		assert.Nil(t, db)
+		assert.Equal(t, errDbReset, err)
+		assert.Equal(t, 0, len(session.dbs))
+	})
+}
@@ -0,0 +1,418 @@
+// Streamed output of query and report results
+package main
+
+import "io"
+import "fmt"
+import "time"
+import "bufio"
+import "strconv"
+import "net/url"
+import "net/http"
+import "encoding/csv"
+import "encoding/hex"
+import "encoding/json"
+import "github.com/jackc/pgx/v5"
+import "github.com/jackc/pgx/v5/pgconn"
+
+
+// Rows are written to the client in batches of this size, and the
+// response is flushed after each batch
+const streamFlushInterval = 1000
+
+// Each write extends the server's write deadline by this much, so that
+// long streams are not cut off by the server-wide WriteTimeout
+const streamWriteTimeout = 30 * time.Second
+
+
+type outputOptions struct {
+	Format string // "" for the traditional buffered JSON response
+	Envelope bool // include column metadata in JSON responses
+	BigNumbersAsStrings bool // emit bigint and numeric values as strings
+	PostgresFormats bool // emit dates, timestamps without time zone and bytea as PostgreSQL does
+}
+
+func parseOutputOptions(req *http.Request) (outputOptions, error) {
+	v := req.URL.Query()
+	format := v.Get("format")
+	switch format {
+	case "", "json", "ndjson", "csv", "arrow", "parquet":
+		// OK
+	default:
+		return outputOptions{}, fmt.Errorf("unsupported output format '%s'", format)
+	}
+
+	envelope, err := parseBoolParam(v, "envelope")
+	if err != nil {
+		return outputOptions{}, err
+	}
+	bigNumbersAsStrings, err := parseBoolParam(v, "bigNumbersAsStrings")
+	if err != nil {
+		return outputOptions{}, err
+	}
+	postgresFormats, err := parseBoolParam(v, "postgresFormats")
+	if err != nil {
+		return outputOptions{}, err
+	}
+
+	return outputOptions{
+		Format: format,
+		Envelope: envelope,
+		BigNumbersAsStrings: bigNumbersAsStrings,
+		PostgresFormats: postgresFormats,
+	}, nil
+}
+
+
+// An absent parameter is false
+func parseBoolParam(v url.Values, name string) (bool, error) {
+	s := v.Get(name)
+	if s == "" {
+		return false, nil
+	}
+
+	val, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("bad value '%s' for %s: %w", s, name, err)
+	}
+	return val, nil
+}
+
+func (opts outputOptions) streaming() bool {
+	return opts.Format != ""
+}
+
+
+// Returned when something goes wrong after a streamed response has
+// started. By then the HTTP status has been sent, so the error has
+// already been reported in-band and in the X-Stream-Error trailer,
+// and the caller must not try to write an error response of its own
+type streamedError struct {
+	err error
+}
+
+func (e *streamedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *streamedError) Unwrap() error {
+	return e.err
+}
+
+
+// Each output format is implemented by a rowWriter. Typed writers are
+// given values as decoded by pgx; others get them after fixValues()
+type rowWriter interface {
+	contentType() string
+	typed() bool
+	begin(w io.Writer, fields []pgconn.FieldDescription) error
+	row(w io.Writer, fields []pgconn.FieldDescription, values []any) error
+	end(w io.Writer, count int) error
+	fail(w io.Writer, err error)
+}
+
+
+func makeRowWriter(format string, isReport bool, columns []resultColumn) rowWriter {
+	switch format {
+	case "ndjson":
+		return &ndjsonRowWriter{}
+	case "csv":
+		return &csvRowWriter{}
+	case "arrow":
+		return &arrowRowWriter{}
+	case "parquet":
+		return &arrowRowWriter{parquet: true}
+	default:
+		return &jsonRowWriter{wrapped: isReport || columns != nil, columns: columns}
+	}
+}
+
+
+// Iterates over the rows of a result, fixing up the types of each
+// value and writing it out in the requested format. If isReport is
+// true, or if column descriptions are provided, streamed JSON is
+// wrapped in the same structure as a reportResponse. (NDJSON and CSV
+// output do not include column descriptions.)
+func streamRows(w http.ResponseWriter, rows pgx.Rows, opts outputOptions, isReport bool, columns []resultColumn) error {
+	defer rows.Close()
+	rw := makeRowWriter(opts.Format, isReport, columns)
+	rc := http.NewResponseController(w)
+	// However long the query takes to produce its first rows
+	extendWriteDeadline(rc)
+	bw := bufio.NewWriter(&deadlineWriter{w: w, rc: rc})
+
+	w.Header().Set("Content-Type", rw.contentType())
+	if opts.Format == "parquet" {
+		// Parquet is not a streaming format, and is only useful as a file
+		w.Header().Set("Content-Disposition", `attachment; filename="result.parquet"`)
+	}
+	w.Header().Set("Trailer", "X-Stream-Error")
+	fields := rows.FieldDescriptions()
+	err := rw.begin(bw, fields)
+	if err != nil {
+		return abandonStream(w, bw, rw, fmt.Errorf("could not start streamed output: %w", err))
+	}
+
+	count := 0
+	for rows.Next() {
+		values, err := rows.Values()
+		if err != nil {
+			return abandonStream(w, bw, rw, fmt.Errorf("could not read row %d of query result: %w", count+1, err))
+		}
+		if !rw.typed() {
+			fixValues(fields, values, opts)
+		}
+		err = rw.row(bw, fields, values)
+		if err != nil {
+			return abandonStream(w, bw, rw, fmt.Errorf("could not write row %d: %w", count+1, err))
+		}
+
+		count++
+		if count % streamFlushInterval == 0 {
+			err = flushStream(rc, bw)
+			if err != nil {
+				// The client has probably gone away: nothing more we can tell it
+				return &streamedError{fmt.Errorf("could not flush streamed output: %w", err)}
+			}
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return abandonStream(w, bw, rw, fmt.Errorf("could not collect query result data: %w", err))
+	}
+
+	err = rw.end(bw, count)
+	if err != nil {
+		return &streamedError{fmt.Errorf("could not finish streamed output: %w", err)}
+	}
+
+	return bw.Flush()
+}
+
+
+func flushStream(rc *http.ResponseController, bw *bufio.Writer) error {
+	extendWriteDeadline(rc)
+	err := bw.Flush()
+	if err != nil {
+		return err
+	}
+
+	// Not all ResponseWriters support this: if they don't, we just carry on
+	_ = rc.Flush()
+	return nil
+}
+
+
+func extendWriteDeadline(rc *http.ResponseController) {
+	// Not all ResponseWriters support this: if they don't, we just carry on
+	_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+}
+
+
+// The buffered writer writes through whenever its buffer fills, not
+// only when flushed, so the deadline is extended before every write:
+// otherwise a batch of rows that took long to produce would be cut off
+type deadlineWriter struct {
+	w http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (dw *deadlineWriter) Write(p []byte) (int, error) {
+	extendWriteDeadline(dw.rc)
+	return dw.w.Write(p)
+}
+
+
+func abandonStream(w http.ResponseWriter, bw *bufio.Writer, rw rowWriter, err error) error {
+	rw.fail(bw, err)
+	_ = bw.Flush()
+	w.Header().Set("X-Stream-Error", err.Error())
+	return &streamedError{err}
+}
+
+
+func rowToMap(fields []pgconn.FieldDescription, values []any) map[string]any {
+	rec := make(map[string]any, len(values))
+	for i, val := range values {
+		rec[fields[i].Name] = val
+	}
+	return rec
+}
+
+
+// JSON: either a bare array of records or an object containing the
+// records, a count and optionally column descriptions. If the stream
+// fails, it is left unterminated and an error object is appended, so
+// that no JSON parser will mistake a truncated result for a complete
+// one.
+type jsonRowWriter struct {
+	wrapped bool
+	columns []resultColumn
+	started bool // whether a record has been written yet
+}
+
+func (rw *jsonRowWriter) contentType() string {
+	return "application/json"
+}
+
+func (rw *jsonRowWriter) typed() bool {
+	return false
+}
+
+func (rw *jsonRowWriter) begin(w io.Writer, fields []pgconn.FieldDescription) error {
+	s := "["
+	if rw.columns != nil {
+		bytes, err := json.Marshal(rw.columns)
+		if err != nil {
+			return err
+		}
+		s = `{"columns":` + string(bytes) + `,"records":[`
+	} else if rw.wrapped {
+		s = `{"records":[`
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func (rw *jsonRowWriter) row(w io.Writer, fields []pgconn.FieldDescription, values []any) error {
+	bytes, err := json.Marshal(rowToMap(fields, values))
+	if err != nil {
+		return err
+	}
+	if rw.started {
+		bytes = append([]byte(","), bytes...)
+	}
+	rw.started = true
+	_, err = w.Write(bytes)
+	return err
+}
+
+func (rw *jsonRowWriter) end(w io.Writer, count int) error {
+	s := "]"
+	if rw.wrapped {
+		s = fmt.Sprintf(`],"totalRecords":%d}`, count)
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func (rw *jsonRowWriter) fail(w io.Writer, err error) {
+	_, _ = io.WriteString(w, "\n")
+	writeErrorObject(w, err)
+}
+
+
+// NDJSON: one record per line. If the stream fails, the last line is
+// an object whose only key is "error".
+type ndjsonRowWriter struct{}
+
+func (rw *ndjsonRowWriter) contentType() string {
+	return "application/x-ndjson"
+}
+
+func (rw *ndjsonRowWriter) typed() bool {
+	return false
+}
+
+func (rw *ndjsonRowWriter) begin(w io.Writer, fields []pgconn.FieldDescription) error {
+	return nil
+}
+
+func (rw *ndjsonRowWriter) row(w io.Writer, fields []pgconn.FieldDescription, values []any) error {
+	bytes, err := json.Marshal(rowToMap(fields, values))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(bytes, '\n'))
+	return err
+}
+
+func (rw *ndjsonRowWriter) end(w io.Writer, count int) error {
+	return nil
+}
+
+func (rw *ndjsonRowWriter) fail(w io.Writer, err error) {
+	writeErrorObject(w, err)
+}
+
+
+// CSV: a header line of column names followed by one line per
+// row. If the stream fails, the last line begins "ERROR:".
+type csvRowWriter struct {
+	cw *csv.Writer
+}
+
+func (rw *csvRowWriter) contentType() string {
+	return "text/csv; charset=utf-8"
+}
+
+func (rw *csvRowWriter) typed() bool {
+	return false
+}
+
+func (rw *csvRowWriter) begin(w io.Writer, fields []pgconn.FieldDescription) error {
+	rw.cw = csv.NewWriter(w)
+	names := make([]string, len(fields))
+	for i, field := range fields {
+		names[i] = field.Name
+	}
+	return rw.write(names)
+}
+
+func (rw *csvRowWriter) row(w io.Writer, fields []pgconn.FieldDescription, values []any) error {
+	record := make([]string, len(values))
+	for i, val := range values {
+		s, err := csvValue(val)
+		if err != nil {
+			return fmt.Errorf("column '%s': %w", fields[i].Name, err)
+		}
+		record[i] = s
+	}
+	return rw.write(record)
+}
+
+func (rw *csvRowWriter) end(w io.Writer, count int) error {
+	return nil
+}
+
+func (rw *csvRowWriter) fail(w io.Writer, err error) {
+	if rw.cw != nil {
+		rw.cw.Flush()
+	}
+	fmt.Fprintf(w, "ERROR: %s\n", err.Error())
+}
+
+func (rw *csvRowWriter) write(record []string) error {
+	err := rw.cw.Write(record)
+	if err != nil {
+		return err
+	}
+	// csv.Writer has its own buffer: push each line through to ours
+	rw.cw.Flush()
+	return rw.cw.Error()
+}
+
+
+func csvValue(val any) (string, error) {
+	switch v := val.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case []byte:
+		return `\x` + hex.EncodeToString(v), nil
+	case []any, map[string]any:
+		bytes, err := json.Marshal(v)
+		return string(bytes), err
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+
+func writeErrorObject(w io.Writer, err error) {
+	bytes, _ := json.Marshal(map[string]string{"error": err.Error()})
+	fmt.Fprintf(w, "%s\n", bytes)
+}
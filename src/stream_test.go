@@ -0,0 +1,168 @@
+package main
+
+import "io"
+import "time"
+import "context"
+import "errors"
+import "testing"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func Test_streamRows(t *testing.T) {
+	id := [16]uint8{90, 154, 146, 202, 186, 5, 215, 45, 248, 76, 49, 146, 31, 31, 126, 77}
+	makeRows := func() *pgxmock.Rows {
+		return pgxmock.NewRows([]string{"id", "name", "num"}).
+			AddRow(id, "mike", 29).
+			AddRow("456", "fiona, dear", nil)
+	}
+
+	tests := []struct {
+		name string
+		format string
+		isReport bool
+		columns []resultColumn
+		rows *pgxmock.Rows
+		contentType string
+		expected string
+		errorstr string
+	}{
+		{
+			name: "JSON array",
+			format: "json",
+			rows: makeRows(),
+			contentType: "application/json",
+			expected: `[{"id":"5a9a92ca-ba05-d72d-f84c-31921f1f7e4d","name":"mike","num":29},{"id":"456","name":"fiona, dear","num":null}]`,
+		},
+		{
+			name: "JSON report",
+			format: "json",
+			isReport: true,
+			rows: makeRows(),
+			contentType: "application/json",
+			expected: `{"records":[{"id":"5a9a92ca-ba05-d72d-f84c-31921f1f7e4d","name":"mike","num":29},{"id":"456","name":"fiona, dear","num":null}],"totalRecords":2}`,
+		},
+		{
+			name: "empty JSON report",
+			format: "json",
+			isReport: true,
+			rows: pgxmock.NewRows([]string{"id"}),
+			contentType: "application/json",
+			expected: `{"records":[],"totalRecords":0}`,
+		},
+		{
+			name: "NDJSON",
+			format: "ndjson",
+			rows: makeRows(),
+			contentType: "application/x-ndjson",
+			expected: `{"id":"5a9a92ca-ba05-d72d-f84c-31921f1f7e4d","name":"mike","num":29}` + "\n" +
+				`{"id":"456","name":"fiona, dear","num":null}` + "\n",
+		},
+		{
+			name: "CSV",
+			format: "csv",
+			rows: makeRows(),
+			contentType: "text/csv; charset=utf-8",
+			expected: "id,name,num\n5a9a92ca-ba05-d72d-f84c-31921f1f7e4d,mike,29\n456,\"fiona, dear\",\n",
+		},
+		{
+			name: "JSON failing mid-stream",
+			format: "json",
+			rows: makeRows().RowError(1, errors.New("connection lost")),
+			contentType: "application/json",
+			expected: `[{"id":"5a9a92ca-ba05-d72d-f84c-31921f1f7e4d","name":"mike","num":29}` + "\n" +
+				`{"error":"could not read row 2 of query result: connection lost"}` + "\n",
+			errorstr: "connection lost",
+		},
+		{
+			name: "NDJSON failing mid-stream",
+			format: "ndjson",
+			rows: makeRows().RowError(1, errors.New("connection lost")),
+			contentType: "application/x-ndjson",
+			expected: `{"id":"5a9a92ca-ba05-d72d-f84c-31921f1f7e4d","name":"mike","num":29}` + "\n" +
+				`{"error":"could not read row 2 of query result: connection lost"}` + "\n",
+			errorstr: "connection lost",
+		},
+		{
+			name: "CSV failing mid-stream",
+			format: "csv",
+			rows: makeRows().RowError(1, errors.New("connection lost")),
+			contentType: "text/csv; charset=utf-8",
+			expected: "id,name,num\n5a9a92ca-ba05-d72d-f84c-31921f1f7e4d,mike,29\n" +
+				"ERROR: could not read row 2 of query result: connection lost\n",
+			errorstr: "connection lost",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			assert.Nil(t, err)
+			defer mock.Close()
+			mock.ExpectQuery("SELECT").WillReturnRows(test.rows)
+			rows, err := mock.Query(context.Background(), "SELECT")
+			assert.Nil(t, err)
+
+			w := httptest.NewRecorder()
+			err = streamRows(w, rows, outputOptions{Format: test.format}, test.isReport, test.columns)
+			resp := w.Result()
+			body, _ := io.ReadAll(resp.Body)
+			assert.Equal(t, test.contentType, resp.Header.Get("Content-Type"))
+			assert.Equal(t, test.expected, string(body))
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, "", resp.Trailer.Get("X-Stream-Error"))
+			} else {
+				var se *streamedError
+				assert.ErrorAs(t, err, &se)
+				assert.ErrorContains(t, err, test.errorstr)
+				assert.Contains(t, resp.Trailer.Get("X-Stream-Error"), test.errorstr)
+			}
+		})
+	}
+}
+
+
+// The deadline must be extended before rows are written, not only
+// after they have been
+func Test_streamRowsDeadline(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	assert.Nil(t, err)
+	defer mock.Close()
+	mock.ExpectQuery("SELECT").WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow("mike"))
+	rows, err := mock.Query(context.Background(), "SELECT")
+	assert.Nil(t, err)
+
+	w := &deadlineRecorder{ResponseRecorder: httptest.NewRecorder()}
+	before := time.Now()
+	err = streamRows(w, rows, outputOptions{Format: "json"}, false, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, `[{"name":"mike"}]`, w.Body.String())
+	// Once when streaming starts, and again before the rows are written
+	assert.Len(t, w.deadlines, 2)
+	for _, deadline := range w.deadlines {
+		assert.False(t, deadline.Before(before.Add(streamWriteTimeout)))
+	}
+}
+
+
+func Test_parseOutputOptions(t *testing.T) {
+	for _, format := range []string{"", "json", "ndjson", "csv", "arrow", "parquet"} {
+		req := httptest.NewRequest("GET", "/ldp/db/query?format=" + format, nil)
+		opts, err := parseOutputOptions(req)
+		assert.Nil(t, err)
+		assert.Equal(t, format, opts.Format)
+		assert.Equal(t, format != "", opts.streaming())
+	}
+
+	req := httptest.NewRequest("GET", "/ldp/db/query?format=xml", nil)
+	_, err := parseOutputOptions(req)
+	assert.ErrorContains(t, err, "unsupported output format 'xml'")
+
+	req = httptest.NewRequest("GET", "/ldp/db/query?postgresFormats=true", nil)
+	opts, err := parseOutputOptions(req)
+	assert.Nil(t, err)
+	assert.True(t, opts.PostgresFormats)
+	assert.False(t, opts.BigNumbersAsStrings)
+}
@@ -0,0 +1,76 @@
+// Details of tables in the reporting database's catalogue
+package main
+
+import "context"
+import "fmt"
+import "github.com/jackc/pgx/v5/pgtype"
+
+
+// Fills in the details of each table in place, in a single
+// round-trip. Tables that cannot be found in pg_class (which should
+// not happen) are left without details.
+func addTableDetails(dbConn PgxIface, isMetaDB bool, tables []dbTable) error {
+	schemas, names := splitTables(tables)
+
+	// reltuples is -1 for a table that has never been vacuumed or
+	// analyzed, in which case we don't know how many rows it has
+	lastUpdate := "NULL::timestamptz"
+	updateJoin := ""
+	if isMetaDB {
+		lastUpdate = "u.last_update"
+		updateJoin = "LEFT JOIN metadb.table_update u ON u.schema_name = t.schema_name AND u.table_name = t.table_name"
+	}
+	query := `SELECT t.n,
+		    CASE c.relkind WHEN 'r' THEN 'table' WHEN 'p' THEN 'table' WHEN 'v' THEN 'view'
+		        WHEN 'm' THEN 'materialized view' WHEN 'f' THEN 'foreign table' ELSE c.relkind::text END AS kind,
+		    obj_description(c.oid, 'pg_class') AS comment,
+		    CASE WHEN c.reltuples < 0 THEN NULL ELSE c.reltuples::bigint END AS estimated_rows,
+		    pg_total_relation_size(c.oid) AS size,
+		    ` + lastUpdate + ` AS last_update
+		FROM unnest($1::text[], $2::text[]) WITH ORDINALITY AS t(schema_name, table_name, n)
+		    JOIN pg_namespace ns ON ns.nspname = t.schema_name
+		    JOIN pg_class c ON c.relnamespace = ns.oid AND c.relname = t.table_name
+		    ` + updateJoin
+	rows, err := dbConn.Query(context.Background(), query, schemas, names)
+	if err != nil {
+		return fmt.Errorf("could not run query '%s': %w", query, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var n int64
+		var kind string
+		var comment pgtype.Text
+		var estimatedRows, size pgtype.Int8
+		var lastUpdate pgtype.Timestamptz
+		err = rows.Scan(&n, &kind, &comment, &estimatedRows, &size, &lastUpdate)
+		if err != nil {
+			return fmt.Errorf("could not read table details: %w", err)
+		}
+		if n < 1 || n > int64(len(tables)) {
+			return fmt.Errorf("table details for unexpected table number %d", n)
+		}
+
+		table := &tables[n-1]
+		table.Kind = kind
+		if comment.Valid {
+			table.Comment = &comment.String
+		}
+		if estimatedRows.Valid {
+			table.EstimatedRows = &estimatedRows.Int64
+		}
+		if size.Valid {
+			table.Size = &size.Int64
+		}
+		if lastUpdate.Valid {
+			t := lastUpdate.Time.UTC()
+			table.LastUpdate = &t
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return fmt.Errorf("could not read table details: %w", err)
+	}
+	return nil
+}
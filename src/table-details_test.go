@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+import "errors"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func Test_addTableDetails(t *testing.T) {
+	t.Run("LDP Classic", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectQuery(`NULL::timestamptz AS last_update`).
+			WithArgs([]string{"public", "local"}, []string{"user_users", "mine"}).
+			WillReturnRows(pgxmock.NewRows([]string{"n", "kind", "comment", "estimated_rows", "size", "last_update"}).
+				AddRow(int64(2), "materialized view", "My own", nil, int64(8192), nil))
+
+		tables := []dbTable{
+			{ SchemaName: "public", TableName: "user_users" },
+			{ SchemaName: "local", TableName: "mine" },
+		}
+		err = addTableDetails(mock, false, tables)
+		assert.Nil(t, err)
+		assert.Equal(t, "", tables[0].Kind)
+		assert.Nil(t, tables[0].Size)
+		assert.Equal(t, "materialized view", tables[1].Kind)
+		assert.Equal(t, "My own", *tables[1].Comment)
+		assert.Nil(t, tables[1].EstimatedRows)
+		assert.Equal(t, int64(8192), *tables[1].Size)
+		assert.Nil(t, tables[1].LastUpdate)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("MetaDB", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectQuery(`LEFT JOIN metadb.table_update`).
+			WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"n", "kind", "comment", "estimated_rows", "size", "last_update"}))
+
+		err = addTableDetails(mock, true, []dbTable{})
+		assert.Nil(t, err)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("unexpected table number", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectQuery(`SELECT t.n`).
+			WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnRows(pgxmock.NewRows([]string{"n", "kind", "comment", "estimated_rows", "size", "last_update"}).
+				AddRow(int64(3), "table", nil, nil, nil, nil))
+
+		err = addTableDetails(mock, true, []dbTable{{ SchemaName: "s", TableName: "t" }})
+		assert.ErrorContains(t, err, "unexpected table number 3")
+	})
+
+	t.Run("database error", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectQuery(`SELECT t.n`).
+			WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg()).
+			WillReturnError(errors.New("permission denied for table table_update"))
+
+		err = addTableDetails(mock, true, []dbTable{{ SchemaName: "s", TableName: "t" }})
+		assert.ErrorContains(t, err, "permission denied")
+	})
+}
@@ -2,9 +2,12 @@ package main
 
 import "errors"
 import "fmt"
+import "time"
 import "net/http"
 import "net/http/httptest"
 import "github.com/pashagolub/pgxmock/v3"
+import "github.com/jackc/pgx/v5"
+import "github.com/jackc/pgx/v5/pgtype"
 
 
 // Various parts of this structure are used by different files' tests
@@ -84,6 +87,25 @@ func MakeDummyModSettingsServer() *httptest.Server {
 			    }
 			  }
 			`))
+		} else if req.URL.Path == "/settings/entries" &&
+			req.URL.RawQuery == `query=scope=="ui-ldp.admin"+and+key=="databases"` {
+			// String-encoded, as when written through /ldp/config
+			_, _ = w.Write([]byte(`
+			  {
+			    "items": [
+			      {
+				"id": "75c12fcb-ba6c-463f-a5fc-cb0587b7d43d",
+				"scope": "ui-ldp.admin",
+				"key": "databases",
+				"value": "[{\"name\":\"archive\",\"url\":\"archiveUrl\",\"user\":\"alice\",\"pass\":\"pw2\",\"maxConns\":2}]"
+			      }
+			    ],
+			    "resultInfo": {
+			      "totalRecords": 1,
+			      "diagnostics": []
+			    }
+			  }
+			`))
 		} else if req.URL.Path == "/settings/entries" &&
 			req.URL.RawQuery == `query=scope=="ui-ldp.admin"+and+key=="bad"` {
 			_, _ = w.Write([]byte("some bit of text"))
@@ -104,6 +126,15 @@ func MakeDummyModSettingsServer() *httptest.Server {
 			_, _ = w.Write([]byte(`this is a bad report`))
 		} else if req.URL.Path == "/reports/bad.sql" {
 			_, _ = w.Write([]byte(`--metadb:function users\nthis is bad SQL`))
+		} else if req.URL.Path == "/reports/delete.sql" {
+			_, _ = w.Write([]byte(`--metadb:function count_loans
+
+DELETE FROM folio_circulation.loan__t;
+
+CREATE FUNCTION count_loans() RETURNS bigint
+AS $$ SELECT count(*) FROM folio_circulation.loan__t $$
+LANGUAGE SQL;
+`))
 		} else if req.URL.Path == "/reports/loans.sql" {
 			_, _ = w.Write([]byte(`--metadb:function count_loans
 
@@ -137,44 +168,143 @@ PARALLEL SAFE;
 }
 
 
+// Makes the mock the session's default reporting database, with
+// expectations as for MetaDB; or, if it is nil, removes it
+func useMockDb(session *ModReportingSession, mock PgxIface) *reportingDb {
+	session.dbMutex.Lock()
+	defer session.dbMutex.Unlock()
+	if mock == nil {
+		delete(session.dbs, "")
+		return nil
+	}
+	db := newReportingDb(session, "", mock, true)
+	session.dbs[""] = db
+	return db
+}
+
+
 // Functions to establish pgxmock expectations, used by multiple tests
+func establishMockForLastUpdate(mock pgxmock.PgxPoolIface, lastUpdate time.Time) {
+	mock.ExpectQuery(`SELECT max\(last_update\) FROM metadb.table_update`).
+		WillReturnRows(pgxmock.NewRows([]string{"max"}).AddRow(pgtype.Timestamptz{Time: lastUpdate, Valid: true}))
+}
+
+// As used by handlers, which go via the schema cache
 func establishMockForTables(mock pgxmock.PgxPoolIface) error {
+	establishMockForLastUpdate(mock, time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC))
 	mock.ExpectQuery("SELECT schema_name, table_name FROM metadb.base_table").WillReturnRows(
 		pgxmock.NewRows([]string{"schema_name", "table_name"}).
 			AddRow("folio_inventory", "records_instances").
 			AddRow("folio_inventory", "holdings_record"))
+	establishMockForReadableTables(mock, 1, 2)
+	return nil
+}
+
+// Takes the ordinal numbers of the tables that are readable
+func establishMockForReadableTables(mock pgxmock.PgxPoolIface, readable ...int64) {
+	rows := pgxmock.NewRows([]string{"n"})
+	for _, n := range readable {
+		rows.AddRow(n)
+	}
+	mock.ExpectQuery(`has_table_privilege`).
+		WithArgs(pgxmock.AnyArg(), pgxmock.AnyArg()).
+		WillReturnRows(rows)
+}
+
+func establishMockForTableDetails(mock pgxmock.PgxPoolIface) error {
+	_ = establishMockForTables(mock)
+	lastUpdate := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	mock.ExpectQuery(`SELECT t.n`).
+		WithArgs([]string{"folio_inventory", "folio_inventory"}, []string{"records_instances", "holdings_record"}).
+		WillReturnRows(pgxmock.NewRows([]string{"n", "kind", "comment", "estimated_rows", "size", "last_update"}).
+			AddRow(int64(1), "table", "Instance records", int64(1234567), int64(987654321), lastUpdate).
+			AddRow(int64(2), "view", nil, nil, int64(0), nil))
 	return nil
 }
 
 func establishMockForColumns(mock pgxmock.PgxPoolIface) error {
+	// pgxmock can only scan into pointer fields from values of the same type
+	comment, defaultValue, elementType := "Unique identifier", "now()", "text"
+	establishMockForLastUpdate(mock, time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC))
 	mock.ExpectQuery(`SELECT`).
-		WithArgs("folio_users", "users", "data").
-		WillReturnRows(pgxmock.NewRows([]string{"column_name", "data_type", "ordinal_position", "table_schema", "table_name"}).
-			AddRow("id", "uuid", "6", "folio_users", "users").
-			AddRow("creation_date", "timestamp without time zone", "8", "folio_users", "users"))
+		WithArgs("folio_users", "users").
+		WillReturnRows(pgxmock.NewRows([]string{"column_name", "data_type", "ordinal_position", "table_schema", "table_name",
+			"is_nullable", "column_default", "comment", "is_primary_key", "indexes", "element_type", "is_json"}).
+			AddRow("id", "uuid", "6", "folio_users", "users",
+				false, nil, &comment, true, []string{"users_pkey"}, nil, false).
+			AddRow("creation_date", "timestamp without time zone", "8", "folio_users", "users",
+				true, &defaultValue, nil, false, []string{}, nil, false).
+			AddRow("tags", "ARRAY", "9", "folio_users", "users",
+				true, nil, nil, false, []string{}, &elementType, false).
+			AddRow("data", "jsonb", "10", "folio_users", "users",
+				true, nil, nil, false, []string{"users_data_idx"}, nil, true))
+	return nil
+}
+
+func establishMockForColumnSearch(mock pgxmock.PgxPoolIface) error {
+	_ = establishMockForTables(mock)
+	comment := "The patron group of the user"
+	mock.ExpectQuery(`SELECT c.table_schema, c.table_name, c.column_name`).
+		WithArgs([]string{"folio_inventory", "folio_inventory"}, []string{"records_instances", "holdings_record"},
+			"patron_group", []string{}, 100).
+		WillReturnRows(pgxmock.NewRows([]string{"table_schema", "table_name", "column_name", "data_type", "comment"}).
+			AddRow("folio_users", "users", "patron_group", "uuid", &comment).
+			AddRow("folio_derived", "loans_items", "patron_group_name", "text", nil))
 	return nil
 }
 
-func establishMockForQuery(mock pgxmock.PgxPoolIface) error {
+// If describe is true, the query's columns are described before it runs
+func establishMockForQuery(mock pgxmock.PgxPoolIface, describe ...bool) error {
+	mock.ExpectBeginTx(readOnlyTx)
+	establishMockForTag(mock)
+	if len(describe) > 0 && describe[0] {
+		establishMockForDescribeResult(mock, `SELECT \* FROM "folio"."users"`)
+	}
 	mock.ExpectQuery(`SELECT \* FROM "folio"."users"`).
 		WillReturnRows(pgxmock.NewRows([]string{"name", "email"}).
 			AddRow("mike", "mike@example.com").
 			AddRow("fiona", "fiona@example.com"))
+	mock.ExpectRollback()
 	return nil
 }
 
+// pgxmock's prepared statements have no field descriptions, so there
+// are no columns to describe: see Test_describeColumns for that
+func establishMockForDescribeResult(mock pgxmock.PgxPoolIface, sql string) {
+	mock.ExpectPrepare("", sql)
+}
+
 func establishMockForEmptyFilterQuery(mock pgxmock.PgxPoolIface) error {
+	mock.ExpectBeginTx(readOnlyTx)
+	establishMockForTag(mock)
 	mock.ExpectQuery(`SELECT \* FROM "folio"."users"`).
 		WillReturnError(errors.New(`ERROR: syntax error at or near "=" (SQLSTATE 42601)`))
+	mock.ExpectRollback()
 	return nil
 }
 
-func establishMockForReport(mock pgxmock.PgxPoolIface) error {
+// Setting the application name to identify the tenant's queries
+func establishMockForTag(mock pgxmock.PgxPoolIface) {
+	mock.ExpectExec(`SELECT set_config\('application_name', \$1, true\)`).
+		WithArgs(pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("SELECT", 1))
+}
+
+// Registration of the report's function, before it is called
+func establishMockForReportFunction(mock pgxmock.PgxPoolIface) {
 	mock.ExpectBegin()
-	mock.ExpectExec("--metadb:function count_loans").
+	establishMockForTag(mock)
+	mock.ExpectExec(`^CREATE FUNCTION pg_temp\.count_loans\(`).
+		WithArgs(pgx.QueryExecModeDescribeExec).
 		WillReturnResult(pgxmock.NewResult("CREATE FUNCTION", 1))
+	mock.ExpectExec("SET TRANSACTION READ ONLY").
+		WillReturnResult(pgxmock.NewResult("SET", 0))
+}
+
+func establishMockForReport(mock pgxmock.PgxPoolIface) error {
+	establishMockForReportFunction(mock)
 	id := [16]uint8{90, 154, 146, 202, 186, 5, 215, 45, 248, 76, 49, 146, 31, 31, 126, 77}
-	mock.ExpectQuery(`SELECT \* FROM count_loans\(end_date => '2023-03-18T00:00:00.000Z'\)`).
+	mock.ExpectQuery(`SELECT \* FROM pg_temp\.count_loans\(end_date => '2023-03-18T00:00:00.000Z'\)`).
 		WillReturnRows(pgxmock.NewRows([]string{"id", "num"}).
 			AddRow(id, 29).
 			AddRow("456", 3))
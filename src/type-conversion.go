@@ -0,0 +1,412 @@
+// Convert values returned by pgx into well-defined JSON-friendly forms
+package main
+
+import "fmt"
+import "math"
+import "net"
+import "strings"
+import "strconv"
+import "time"
+import "net/netip"
+import "encoding/hex"
+import "encoding/json"
+import "github.com/jackc/pgx/v5/pgconn"
+import "github.com/jackc/pgx/v5/pgtype"
+
+
+// A valueConverter is given a non-null value as decoded by pgx from a
+// column of the PostgreSQL type whose OID is specified
+type valueConverter func(val any, oid uint32, opts outputOptions) any
+
+// Used only to look up element types of arrays and ranges
+var pgTypeMap = pgtype.NewMap()
+
+// Populated in init(), since some converters call fixValue recursively
+var typeConverters map[uint32]valueConverter
+
+
+func init() {
+	typeConverters = map[uint32]valueConverter{
+		pgtype.Int8OID: convertBigint,
+		pgtype.NumericOID: convertNumeric,
+		pgtype.Float4OID: convertFloat,
+		pgtype.Float8OID: convertFloat,
+		pgtype.UUIDOID: convertUUID,
+		pgtype.DateOID: convertDate,
+		pgtype.TimestampOID: convertTimestamp,
+		pgtype.TimestamptzOID: convertTimestamptz,
+		pgtype.TimeOID: convertTime,
+		pgtype.IntervalOID: convertInterval,
+		pgtype.InetOID: convertInet,
+		pgtype.CIDROID: convertInet,
+		pgtype.MacaddrOID: convertStringer,
+		pgtype.ByteaOID: convertBytea,
+		pgtype.BitOID: convertBits,
+		pgtype.VarbitOID: convertBits,
+		pgtype.QCharOID: convertQChar,
+	}
+}
+
+
+// Fixes all the values of a row in place
+func fixValues(fields []pgconn.FieldDescription, values []any, opts outputOptions) {
+	for i, val := range values {
+		values[i] = fixValue(val, fields[i].DataTypeOID, opts)
+	}
+}
+
+
+func fixValue(val any, oid uint32, opts outputOptions) any {
+	if val == nil {
+		return nil
+	}
+
+	if oid == 0 {
+		// We don't know the PostgreSQL type, so guess from the Go type
+		if v, ok := val.([]any); ok {
+			return convertArray(v, 0, opts)
+		}
+		oid = guessOid(val)
+	}
+
+	conv := typeConverters[oid]
+	if conv != nil {
+		return conv(val, oid, opts)
+	}
+
+	// Arrays and ranges of all types are handled generically
+	typ, ok := pgTypeMap.TypeForOID(oid)
+	if ok {
+		switch codec := typ.Codec.(type) {
+		case *pgtype.ArrayCodec:
+			return convertArray(val, codec.ElementType.OID, opts)
+		case *pgtype.RangeCodec:
+			return convertRange(val, codec.ElementType.OID, opts)
+		case *pgtype.MultirangeCodec:
+			return convertMultirange(val, codec.ElementType.OID, opts)
+		}
+	}
+
+	// Everything else (text, booleans, smaller integers, JSON, etc.) is fine as it is
+	return val
+}
+
+
+func guessOid(val any) uint32 {
+	switch val.(type) {
+	case [16]uint8:
+		// This is how pgx represents fields of type "uuid"
+		return pgtype.UUIDOID
+	case int64:
+		return pgtype.Int8OID
+	case float32, float64:
+		return pgtype.Float8OID
+	case pgtype.Numeric:
+		return pgtype.NumericOID
+	case pgtype.Interval:
+		return pgtype.IntervalOID
+	case pgtype.Time:
+		return pgtype.TimeOID
+	case time.Time:
+		return pgtype.TimestamptzOID
+	case netip.Prefix:
+		return pgtype.InetOID
+	default:
+		return 0
+	}
+}
+
+
+func convertBigint(val any, oid uint32, opts outputOptions) any {
+	n, ok := val.(int64)
+	if ok && opts.BigNumbersAsStrings {
+		return strconv.FormatInt(n, 10)
+	}
+	return val
+}
+
+
+func convertNumeric(val any, oid uint32, opts outputOptions) any {
+	n, ok := val.(pgtype.Numeric)
+	if !ok {
+		return val
+	}
+
+	v, err := n.Value()
+	s, ok := v.(string)
+	if err != nil || !ok {
+		return nil
+	} else if n.NaN || n.InfinityModifier != pgtype.Finite || opts.BigNumbersAsStrings {
+		return s
+	}
+	// A json.Number is emitted as-is, so no precision is lost in the JSON text
+	return json.Number(s)
+}
+
+
+func convertFloat(val any, oid uint32, opts outputOptions) any {
+	var f float64
+	switch v := val.(type) {
+	case float32:
+		f = float64(v)
+	case float64:
+		f = v
+	default:
+		return val
+	}
+
+	// JSON has no representation for these, so use PostgreSQL's
+	if math.IsNaN(f) {
+		return "NaN"
+	} else if math.IsInf(f, 1) {
+		return "Infinity"
+	} else if math.IsInf(f, -1) {
+		return "-Infinity"
+	}
+	return val
+}
+
+
+func convertUUID(val any, oid uint32, opts outputOptions) any {
+	v, ok := val.([16]uint8)
+	if !ok {
+		return val
+	}
+	return fmt.Sprintf("%x-%x-%x-%x-%x", v[0:4], v[4:6], v[6:8], v[8:10], v[10:16])
+}
+
+
+// By default, dates and timestamps without time zone are left as they
+// have always been rendered, as midnight or the time in UTC. Only with
+// PostgresFormats are they rendered as PostgreSQL does.
+func convertDate(val any, oid uint32, opts outputOptions) any {
+	if !opts.PostgresFormats {
+		return convertTimeValue(val, nil)
+	}
+	return convertTimeValue(val, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+}
+
+
+// A timestamp without time zone is not really UTC
+func convertTimestamp(val any, oid uint32, opts outputOptions) any {
+	if !opts.PostgresFormats {
+		return convertTimeValue(val, nil)
+	}
+	return convertTimeValue(val, func(t time.Time) string {
+		return t.Format("2006-01-02T15:04:05.999999")
+	})
+}
+
+
+func convertTimestamptz(val any, oid uint32, opts outputOptions) any {
+	return convertTimeValue(val, func(t time.Time) string {
+		return t.UTC().Format(time.RFC3339Nano)
+	})
+}
+
+
+// If format is nil, times are left for encoding/json to render
+func convertTimeValue(val any, format func(time.Time) string) any {
+	switch v := val.(type) {
+	case time.Time:
+		if format == nil {
+			return val
+		}
+		return format(v)
+	case pgtype.InfinityModifier:
+		// pgx returns this for the special values 'infinity' and '-infinity'
+		if v == pgtype.Infinity {
+			return "infinity"
+		}
+		return "-infinity"
+	default:
+		return val
+	}
+}
+
+
+func convertTime(val any, oid uint32, opts outputOptions) any {
+	v, ok := val.(pgtype.Time)
+	if !ok {
+		return val
+	}
+
+	us := v.Microseconds
+	s := fmt.Sprintf("%02d:%02d:%02d", us / 3600000000, us / 60000000 % 60, us / 1000000 % 60)
+	return s + formatFraction(us % 1000000)
+}
+
+
+// Rendered in ISO 8601 format, as by PostgreSQL's "iso_8601" interval style
+func convertInterval(val any, oid uint32, opts outputOptions) any {
+	v, ok := val.(pgtype.Interval)
+	if !ok {
+		return val
+	}
+
+	s := "P"
+	if years := v.Months / 12; years != 0 {
+		s += fmt.Sprintf("%dY", years)
+	}
+	if months := v.Months % 12; months != 0 {
+		s += fmt.Sprintf("%dM", months)
+	}
+	if v.Days != 0 {
+		s += fmt.Sprintf("%dD", v.Days)
+	}
+
+	us := v.Microseconds
+	if us != 0 {
+		s += "T"
+		if hours := us / 3600000000; hours != 0 {
+			s += fmt.Sprintf("%dH", hours)
+		}
+		if minutes := us / 60000000 % 60; minutes != 0 {
+			s += fmt.Sprintf("%dM", minutes)
+		}
+		if us % 60000000 != 0 {
+			sign := ""
+			if us < 0 {
+				sign = "-"
+				us = -us
+			}
+			s += fmt.Sprintf("%s%d%sS", sign, us / 1000000 % 60, formatFraction(us % 1000000))
+		}
+	}
+
+	if s == "P" {
+		return "PT0S"
+	}
+	return s
+}
+
+
+// Returns a decimal fraction of a second, without trailing zeros
+func formatFraction(us int64) string {
+	if us == 0 {
+		return ""
+	}
+	return strings.TrimRight(fmt.Sprintf(".%06d", us), "0")
+}
+
+
+// An inet that is a single host is rendered without the netmask, as
+// PostgreSQL itself does; a cidr always includes it
+func convertInet(val any, oid uint32, opts outputOptions) any {
+	v, ok := val.(netip.Prefix)
+	if !ok {
+		return val
+	}
+
+	if oid == pgtype.InetOID && v.Bits() == v.Addr().BitLen() {
+		return v.Addr().String()
+	}
+	return v.String()
+}
+
+
+func convertStringer(val any, oid uint32, opts outputOptions) any {
+	switch v := val.(type) {
+	case net.HardwareAddr:
+		return v.String()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return val
+	}
+}
+
+
+// Hex format, as used by PostgreSQL, rather than the base64 that
+// encoding/json has always rendered by default
+func convertBytea(val any, oid uint32, opts outputOptions) any {
+	v, ok := val.([]byte)
+	if !ok || !opts.PostgresFormats {
+		return val
+	}
+	return `\x` + hex.EncodeToString(v)
+}
+
+
+func convertBits(val any, oid uint32, opts outputOptions) any {
+	v, ok := val.(pgtype.Bits)
+	if !ok {
+		return val
+	}
+
+	var sb strings.Builder
+	for i := int32(0); i < v.Len; i++ {
+		if v.Bytes[i / 8] & (128 >> (i % 8)) != 0 {
+			sb.WriteByte('1')
+		} else {
+			sb.WriteByte('0')
+		}
+	}
+	return sb.String()
+}
+
+
+func convertQChar(val any, oid uint32, opts outputOptions) any {
+	v, ok := val.(rune)
+	if !ok {
+		return val
+	}
+	return string(v)
+}
+
+
+// Multi-dimensional arrays come back from pgx as nested slices
+func convertArray(val any, elementOid uint32, opts outputOptions) any {
+	v, ok := val.([]any)
+	if !ok {
+		return val
+	}
+
+	result := make([]any, len(v))
+	for i, elem := range v {
+		if nested, ok := elem.([]any); ok {
+			result[i] = convertArray(nested, elementOid, opts)
+		} else {
+			result[i] = fixValue(elem, elementOid, opts)
+		}
+	}
+	return result
+}
+
+
+// A range is rendered as an object with "lower" and "upper" bounds,
+// each of which is null if unbounded, and booleans indicating whether
+// each bound is inclusive. An empty range is {"empty":true}.
+func convertRange(val any, elementOid uint32, opts outputOptions) any {
+	v, ok := val.(pgtype.Range[any])
+	if !ok {
+		return val
+	}
+
+	if v.LowerType == pgtype.Empty {
+		return map[string]any{"empty": true}
+	}
+
+	return map[string]any{
+		"lower": fixValue(v.Lower, elementOid, opts),
+		"upper": fixValue(v.Upper, elementOid, opts),
+		"lowerInclusive": v.LowerType == pgtype.Inclusive,
+		"upperInclusive": v.UpperType == pgtype.Inclusive,
+	}
+}
+
+
+func convertMultirange(val any, rangeOid uint32, opts outputOptions) any {
+	v, ok := val.(pgtype.Multirange[pgtype.Range[any]])
+	if !ok {
+		return val
+	}
+
+	result := make([]any, len(v))
+	for i, r := range v {
+		result[i] = fixValue(r, rangeOid, opts)
+	}
+	return result
+}
@@ -0,0 +1,99 @@
+package main
+
+import "math"
+import "net"
+import "time"
+import "testing"
+import "math/big"
+import "net/netip"
+import "encoding/json"
+import "github.com/stretchr/testify/assert"
+import "github.com/jackc/pgx/v5/pgtype"
+
+
+func Test_fixValue(t *testing.T) {
+	id := [16]uint8{90, 154, 146, 202, 186, 5, 215, 45, 248, 76, 49, 146, 31, 31, 126, 77}
+	idString := "5a9a92ca-ba05-d72d-f84c-31921f1f7e4d"
+	ts := time.Date(2023, 3, 18, 14, 30, 15, 250000000, time.UTC)
+	local := time.FixedZone("CET", 3600)
+
+	tests := []struct {
+		name string
+		oid uint32
+		value any
+		bigNumbersAsStrings bool
+		postgresFormats bool
+		expected any
+	}{
+		{ name: "null", oid: pgtype.TextOID, value: nil, expected: nil },
+		{ name: "text", oid: pgtype.TextOID, value: "water", expected: "water" },
+		{ name: "boolean", oid: pgtype.BoolOID, value: true, expected: true },
+		{ name: "integer", oid: pgtype.Int4OID, value: int32(42), expected: int32(42) },
+		{ name: "bigint", oid: pgtype.Int8OID, value: int64(9007199254740993), expected: int64(9007199254740993) },
+		{ name: "bigint as string", oid: pgtype.Int8OID, value: int64(9007199254740993), bigNumbersAsStrings: true, expected: "9007199254740993" },
+		{ name: "numeric", oid: pgtype.NumericOID, value: pgtype.Numeric{Int: big.NewInt(123456), Exp: -2, Valid: true}, expected: json.Number("1234.56") },
+		{ name: "numeric as string", oid: pgtype.NumericOID, value: pgtype.Numeric{Int: big.NewInt(123456), Exp: -2, Valid: true}, bigNumbersAsStrings: true, expected: "1234.56" },
+		{ name: "numeric NaN", oid: pgtype.NumericOID, value: pgtype.Numeric{NaN: true, Valid: true}, expected: "NaN" },
+		{ name: "float NaN", oid: pgtype.Float8OID, value: math.NaN(), expected: "NaN" },
+		{ name: "float infinity", oid: pgtype.Float4OID, value: float32(math.Inf(-1)), expected: "-Infinity" },
+		{ name: "float", oid: pgtype.Float8OID, value: 2.5, expected: 2.5 },
+		{ name: "uuid", oid: pgtype.UUIDOID, value: id, expected: idString },
+		{ name: "uuid array", oid: pgtype.UUIDArrayOID, value: []any{id, nil, id}, expected: []any{idString, nil, idString} },
+		{ name: "2-dimensional uuid array", oid: pgtype.UUIDArrayOID, value: []any{[]any{id}, []any{id}}, expected: []any{[]any{idString}, []any{idString}} },
+		{ name: "date", oid: pgtype.DateOID, value: ts, expected: ts },
+		{ name: "date in PostgreSQL format", oid: pgtype.DateOID, value: ts, postgresFormats: true, expected: "2023-03-18" },
+		{ name: "infinite date", oid: pgtype.DateOID, value: pgtype.Infinity, expected: "infinity" },
+		{ name: "timestamp", oid: pgtype.TimestampOID, value: ts, expected: ts },
+		{ name: "timestamp in PostgreSQL format", oid: pgtype.TimestampOID, value: ts, postgresFormats: true, expected: "2023-03-18T14:30:15.25" },
+		{ name: "timestamp with time zone", oid: pgtype.TimestamptzOID, value: ts.In(local), expected: "2023-03-18T14:30:15.25Z" },
+		{ name: "negative infinite timestamp", oid: pgtype.TimestamptzOID, value: pgtype.NegativeInfinity, expected: "-infinity" },
+		{ name: "time", oid: pgtype.TimeOID, value: pgtype.Time{Microseconds: 52215000500, Valid: true}, expected: "14:30:15.0005" },
+		{ name: "interval", oid: pgtype.IntervalOID, value: pgtype.Interval{Months: 14, Days: 3, Microseconds: 3723500000, Valid: true}, expected: "P1Y2M3DT1H2M3.5S" },
+		{ name: "negative interval", oid: pgtype.IntervalOID, value: pgtype.Interval{Microseconds: -90000000, Valid: true}, expected: "PT-1M-30S" },
+		{ name: "zero interval", oid: pgtype.IntervalOID, value: pgtype.Interval{Valid: true}, expected: "PT0S" },
+		{ name: "inet host", oid: pgtype.InetOID, value: netip.MustParsePrefix("192.168.0.1/32"), expected: "192.168.0.1" },
+		{ name: "inet network", oid: pgtype.InetOID, value: netip.MustParsePrefix("192.168.0.1/24"), expected: "192.168.0.1/24" },
+		{ name: "cidr", oid: pgtype.CIDROID, value: netip.MustParsePrefix("10.0.0.0/32"), expected: "10.0.0.0/32" },
+		{ name: "macaddr", oid: pgtype.MacaddrOID, value: net.HardwareAddr{8, 0, 43, 1, 2, 3}, expected: "08:00:2b:01:02:03" },
+		{ name: "bytea", oid: pgtype.ByteaOID, value: []byte{0xde, 0xad, 0xbe, 0xef}, expected: []byte{0xde, 0xad, 0xbe, 0xef} },
+		{ name: "bytea in PostgreSQL format", oid: pgtype.ByteaOID, value: []byte{0xde, 0xad, 0xbe, 0xef}, postgresFormats: true, expected: `\xdeadbeef` },
+		{ name: "bit string", oid: pgtype.VarbitOID, value: pgtype.Bits{Bytes: []byte{0xa0}, Len: 3, Valid: true}, expected: "101" },
+		{ name: "char", oid: pgtype.QCharOID, value: rune('r'), expected: "r" },
+		{
+			name: "jsonb",
+			oid: pgtype.JSONBOID,
+			value: map[string]any{"status": map[string]any{"name": "Available"}},
+			expected: map[string]any{"status": map[string]any{"name": "Available"}},
+		},
+		{
+			name: "int4range",
+			oid: pgtype.Int4rangeOID,
+			value: pgtype.Range[any]{Lower: int32(1), Upper: int32(10), LowerType: pgtype.Inclusive, UpperType: pgtype.Exclusive, Valid: true},
+			expected: map[string]any{"lower": int32(1), "upper": int32(10), "lowerInclusive": true, "upperInclusive": false},
+		},
+		{
+			name: "unbounded daterange",
+			oid: pgtype.DaterangeOID,
+			value: pgtype.Range[any]{Lower: ts, LowerType: pgtype.Inclusive, UpperType: pgtype.Unbounded, Valid: true},
+			postgresFormats: true,
+			expected: map[string]any{"lower": "2023-03-18", "upper": nil, "lowerInclusive": true, "upperInclusive": false},
+		},
+		{
+			name: "empty range",
+			oid: pgtype.NumrangeOID,
+			value: pgtype.Range[any]{LowerType: pgtype.Empty, UpperType: pgtype.Empty, Valid: true},
+			expected: map[string]any{"empty": true},
+		},
+		{ name: "unknown type: uuid", value: id, expected: idString },
+		{ name: "unknown type: int", value: 29, expected: 29 },
+		{ name: "unknown type: array", value: []any{id, "x"}, expected: []any{idString, "x"} },
+		{ name: "unknown type: numeric", value: pgtype.Numeric{Int: big.NewInt(5), Exp: 0, Valid: true}, expected: json.Number("5") },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := outputOptions{BigNumbersAsStrings: test.bigNumbersAsStrings, PostgresFormats: test.postgresFormats}
+			assert.Equal(t, test.expected, fixValue(test.value, test.oid, opts))
+		})
+	}
+}
@@ -0,0 +1,190 @@
+// Mapping FOLIO users to database roles
+package main
+
+import "fmt"
+import "strings"
+import "context"
+import "encoding/json"
+import "encoding/base64"
+import "github.com/jackc/pgx/v5"
+import "github.com/jackc/pgx/v5/pgconn"
+
+
+const maxRoleNameLength = 63 // PostgreSQL's NAMEDATALEN - 1
+
+
+type folioUser struct {
+	Username string
+	UserId string
+}
+
+// Claims in the access tokens issued by Okapi ("sub" is the username)
+// and Keycloak ("sub" is Keycloak's own ID)
+type tokenClaims struct {
+	Sub string `json:"sub"`
+	PreferredUsername string `json:"preferred_username"`
+	UserId string `json:"user_id"`
+}
+
+
+// The token has already been validated by Okapi or the gateway before
+// the request reaches us, so we need only read its claims
+func userFromToken(token string) (folioUser, error) {
+	if token == "" {
+		return folioUser{}, fmt.Errorf("no token to identify FOLIO user")
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return folioUser{}, fmt.Errorf("token is not a JWT")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return folioUser{}, fmt.Errorf("could not decode token payload: %w", err)
+	}
+
+	var claims tokenClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return folioUser{}, fmt.Errorf("could not deserialize token payload: %w", err)
+	}
+
+	user := folioUser{Username: claims.PreferredUsername, UserId: claims.UserId}
+	if user.Username == "" {
+		user.Username = claims.Sub
+	}
+	if user.Username == "" {
+		return folioUser{}, fmt.Errorf("token does not identify a FOLIO user")
+	}
+	return user, nil
+}
+
+
+// The template may contain {username} and {userId}, which are replaced
+// by the user's FOLIO username and UUID
+func makeUserRole(template string, user folioUser) (string, error) {
+	if strings.Contains(template, "{userId}") && user.UserId == "" {
+		return "", fmt.Errorf("token does not include the ID of FOLIO user '%s'", user.Username)
+	}
+
+	role := strings.NewReplacer("{username}", user.Username, "{userId}", user.UserId).Replace(template)
+	if len(role) > maxRoleNameLength {
+		// PostgreSQL would silently truncate it, perhaps to another role's name
+		return "", fmt.Errorf("database role name '%s' for FOLIO user '%s' is too long", role, user.Username)
+	}
+	return role, nil
+}
+
+
+// Runs everything as the role, over the login user's pool. Each
+// operation is a transaction that begins with SET LOCAL ROLE, so that
+// the role lasts only until the transaction ends: no connection is
+// returned to the pool still acting as it, and SQL that changes the
+// role cannot affect later requests. This also means that FOLIO users
+// do not each need a pool of their own.
+type roleConn struct {
+	pool PgxIface
+	role string
+	sql string
+}
+
+
+func newRoleConn(pool PgxIface, role string) *roleConn {
+	return &roleConn{
+		pool: pool,
+		role: role,
+		sql: "SET LOCAL ROLE " + pgx.Identifier{role}.Sanitize(),
+	}
+}
+
+
+func (rc *roleConn) Begin(ctx context.Context) (pgx.Tx, error) {
+	return rc.BeginTx(ctx, pgx.TxOptions{})
+}
+
+
+func (rc *roleConn) BeginTx(ctx context.Context, options pgx.TxOptions) (pgx.Tx, error) {
+	tx, err := rc.pool.BeginTx(ctx, options)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, rc.sql)
+	if err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, fmt.Errorf("could not set database role '%s': %w", rc.role, err)
+	}
+	return tx, nil
+}
+
+
+// The transaction ends when the rows are closed
+func (rc *roleConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	tx, err := rc.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, err
+	}
+	return &roleRows{Rows: rows, tx: tx}, nil
+}
+
+
+func (rc *roleConn) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return &roleRow{rc: rc, ctx: ctx, sql: sql, args: args}
+}
+
+
+func (rc *roleConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	tx, err := rc.Begin(ctx)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	tag, err := tx.Exec(ctx, sql, args...)
+	if err != nil {
+		_ = tx.Rollback(ctx)
+		return pgconn.CommandTag{}, err
+	}
+	return tag, tx.Commit(ctx)
+}
+
+
+func (rc *roleConn) Ping(ctx context.Context) error {
+	return rc.pool.Ping(ctx)
+}
+
+
+// The pool belongs to the login user's connection, which closes it
+func (rc *roleConn) Close() {
+}
+
+
+type roleRows struct {
+	pgx.Rows
+	tx pgx.Tx
+}
+
+func (rr *roleRows) Close() {
+	rr.Rows.Close()
+	// Nothing was changed, so there is nothing to commit
+	_ = rr.tx.Rollback(context.Background())
+}
+
+
+type roleRow struct {
+	rc *roleConn
+	ctx context.Context
+	sql string
+	args []any
+}
+
+func (row *roleRow) Scan(dest ...any) error {
+	tx, err := row.rc.BeginTx(row.ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(row.ctx)
+	return tx.QueryRow(row.ctx, row.sql, row.args...).Scan(dest...)
+}
@@ -0,0 +1,189 @@
+package main
+
+import "errors"
+import "regexp"
+import "context"
+import "testing"
+import "encoding/base64"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/jackc/pgx/v5"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func makeTestToken(payload string) string {
+	return "eyJhbGciOiJIUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2lnbmF0dXJl"
+}
+
+
+func Test_userFromToken(t *testing.T) {
+	tests := []struct {
+		name string
+		token string
+		username string
+		userId string
+		errorstr string
+	}{
+		{
+			name: "Okapi token",
+			token: makeTestToken(`{"sub":"mike","user_id":"a23eac4b-955e-451c-b4ff-6ec2f5e63e23","tenant":"diku"}`),
+			username: "mike",
+			userId: "a23eac4b-955e-451c-b4ff-6ec2f5e63e23",
+		},
+		{
+			name: "Keycloak token",
+			token: makeTestToken(`{"sub":"0e4ed2c5-0c3d-4c6e-8f0e-5a1c3c9d3b7a","preferred_username":"mike","user_id":"a23eac4b-955e-451c-b4ff-6ec2f5e63e23"}`),
+			username: "mike",
+			userId: "a23eac4b-955e-451c-b4ff-6ec2f5e63e23",
+		},
+		{ name: "no token", token: "", errorstr: "no token to identify FOLIO user" },
+		{ name: "not a JWT", token: "abc.def", errorstr: "token is not a JWT" },
+		{ name: "bad encoding", token: "abc.!!!.def", errorstr: "could not decode token payload" },
+		{ name: "bad JSON", token: makeTestToken(`{"sub":`), errorstr: "could not deserialize token payload" },
+		{ name: "no user", token: makeTestToken(`{"tenant":"diku"}`), errorstr: "token does not identify a FOLIO user" },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user, err := userFromToken(test.token)
+			if test.errorstr != "" {
+				assert.ErrorContains(t, err, test.errorstr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.username, user.Username)
+			assert.Equal(t, test.userId, user.UserId)
+		})
+	}
+}
+
+
+func Test_makeUserRole(t *testing.T) {
+	user := folioUser{Username: "mike", UserId: "a23eac4b-955e-451c-b4ff-6ec2f5e63e23"}
+
+	tests := []struct {
+		name string
+		template string
+		user folioUser
+		expected string
+		errorstr string
+	}{
+		{ name: "username", template: "folio_{username}", user: user, expected: "folio_mike" },
+		{ name: "user ID", template: "u_{userId}", user: user, expected: "u_a23eac4b-955e-451c-b4ff-6ec2f5e63e23" },
+		{ name: "constant", template: "reporting", user: user, expected: "reporting" },
+		{ name: "missing user ID", template: "u_{userId}", user: folioUser{Username: "mike"}, errorstr: "token does not include the ID of FOLIO user 'mike'" },
+		{ name: "too long", template: "folio_reporting_user_{userId}_{username}_{username}", user: user, errorstr: "is too long" },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			role, err := makeUserRole(test.template, test.user)
+			if test.errorstr != "" {
+				assert.ErrorContains(t, err, test.errorstr)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, role)
+		})
+	}
+}
+
+
+func Test_findDbConnForUser(t *testing.T) {
+	ts := MakeDummyModSettingsServer()
+	defer ts.Close()
+
+	server, err := MakeConfiguredServer("../etc/silent.json", ".")
+	assert.Nil(t, err)
+
+	session, err := NewModReportingSession(server, ts.URL, "t1")
+	assert.Nil(t, err)
+	baseMock, err := pgxmock.NewPool()
+	assert.Nil(t, err)
+	base := useMockDb(session, baseMock)
+	base.config.UserRoleTemplate = "folio_{username}"
+
+	roleMock, err := pgxmock.NewPool()
+	assert.Nil(t, err)
+	roleDb := newReportingDb(session, "", roleMock, true)
+	roleDb.role = "folio_mike"
+	session.dbs[roleDbKey("", "folio_mike")] = roleDb
+
+	t.Run("connection for the user's role", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/ldp/db/tables", nil)
+		req.Header.Set("X-Okapi-Token", makeTestToken(`{"sub":"mike"}`))
+		db, dbConn, err := session.findDbConn(req)
+		assert.Nil(t, err)
+		assert.Equal(t, roleMock, dbConn)
+		assert.Equal(t, "folio_mike", db.role)
+	})
+
+	t.Run("a new role shares the login user's pool", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/ldp/db/tables", nil)
+		req.Header.Set("X-Okapi-Token", makeTestToken(`{"sub":"fiona"}`))
+		db, dbConn, err := session.findDbConn(req)
+		assert.Nil(t, err)
+		assert.Equal(t, "folio_fiona", db.role)
+		rc, ok := dbConn.(*roleConn)
+		assert.True(t, ok)
+		assert.Equal(t, base.dbConn, rc.pool)
+	})
+
+	t.Run("no fallback to the login role", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/ldp/db/tables", nil)
+		_, _, err := session.findDbConn(req)
+		assert.ErrorContains(t, err, "cannot determine database role: no token to identify FOLIO user")
+	})
+
+	t.Run("removing the database removes its roles", func(t *testing.T) {
+		session.dbMutex.Lock()
+		stale := session.removeDbLocked("")
+		session.dbMutex.Unlock()
+		assert.Equal(t, 3, len(stale))
+		assert.Equal(t, 0, len(session.dbs))
+	})
+}
+
+
+func Test_roleConn(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	assert.Nil(t, err)
+	defer mock.Close()
+	rc := newRoleConn(mock, "folio_mike")
+	ctx := context.Background()
+	setRole := regexp.QuoteMeta(`SET LOCAL ROLE "folio_mike"`)
+
+	t.Run("query in a transaction of its own", func(t *testing.T) {
+		mock.ExpectBeginTx(pgx.TxOptions{AccessMode: pgx.ReadOnly})
+		mock.ExpectExec(setRole).WillReturnResult(pgxmock.NewResult("SET", 0))
+		mock.ExpectQuery("SELECT name").WillReturnRows(pgxmock.NewRows([]string{"name"}).AddRow("mike"))
+		mock.ExpectRollback()
+		rows, err := rc.Query(ctx, "SELECT name FROM users")
+		assert.Nil(t, err)
+		names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"mike"}, names)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("single row", func(t *testing.T) {
+		mock.ExpectBeginTx(pgx.TxOptions{AccessMode: pgx.ReadOnly})
+		mock.ExpectExec(setRole).WillReturnResult(pgxmock.NewResult("SET", 0))
+		mock.ExpectQuery("SELECT count").WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(42))
+		mock.ExpectRollback()
+		var count int
+		err := rc.QueryRow(ctx, "SELECT count(*) FROM users").Scan(&count)
+		assert.Nil(t, err)
+		assert.Equal(t, 42, count)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("role cannot be set", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectExec(setRole).WillReturnError(errors.New(`permission denied to set role "folio_mike"`))
+		mock.ExpectRollback()
+		_, err := rc.Begin(ctx)
+		assert.ErrorContains(t, err, `could not set database role 'folio_mike': permission denied`)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+}
@@ -0,0 +1,345 @@
+// Control which schemas and tables are visible to users
+package main
+
+import "context"
+import "fmt"
+import "path"
+import "time"
+import "regexp"
+import "strings"
+import "net/http"
+import "encoding/json"
+
+
+// Stored in mod-settings, with scope "ui-ldp.admin" and key
+// "visibility". Each list contains glob patterns as understood by
+// path.Match: schema patterns are matched against schema names, and
+// table patterns against "schema.table".
+type visibilityRules struct {
+	IncludeSchemas []string `json:"includeSchemas"`
+	ExcludeSchemas []string `json:"excludeSchemas"`
+	IncludeTables []string `json:"includeTables"`
+	ExcludeTables []string `json:"excludeTables"`
+}
+
+
+const defaultVisibilityCheckInterval = 60 // seconds
+
+
+// Returns nil if there is no visibility setting, in which case the
+// default catalogue is visible and no checks are made. Since nearly
+// every request needs the rules, they are cached for each session:
+// the cache is discarded when the setting is changed through this
+// instance of the module, and otherwise lasts visibilityCheckInterval
+// seconds, so that changes made through other instances are picked up.
+// Concurrent requests wait for a single fetch.
+func fetchVisibilityRules(req *http.Request, session *ModReportingSession) (*visibilityRules, error) {
+	session.visibilityMutex.Lock()
+	defer session.visibilityMutex.Unlock()
+
+	if !session.visibilityFetched.IsZero() && time.Since(session.visibilityFetched) < session.visibilityCheckInterval() {
+		return session.visibility, nil
+	}
+
+	// Failures are not cached, so that the next request tries again
+	rules, err := readVisibilityRules(req, session)
+	if err != nil {
+		return nil, err
+	}
+	session.visibility = rules
+	session.visibilityFetched = time.Now()
+	return rules, nil
+}
+
+
+func (session *ModReportingSession) visibilityCheckInterval() time.Duration {
+	seconds := defaultVisibilityCheckInterval
+	if session.server != nil && session.server.config.Sessions.VisibilityCheckInterval != 0 {
+		seconds = session.server.config.Sessions.VisibilityCheckInterval
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+
+func (session *ModReportingSession) forgetVisibilityRules() {
+	session.visibilityMutex.Lock()
+	defer session.visibilityMutex.Unlock()
+	session.visibility = nil
+	session.visibilityFetched = time.Time{}
+}
+
+
+// Called when the tenant's visibility setting has been changed
+func (session *ModReportingSession) resetVisibilityRules() {
+	if session.server == nil {
+		// Some tests make sessions without a server
+		session.forgetVisibilityRules()
+		return
+	}
+	for _, s := range session.server.sessions.tenantSessions(session.tenant) {
+		s.forgetVisibilityRules()
+	}
+}
+
+
+func readVisibilityRules(req *http.Request, session *ModReportingSession) (*visibilityRules, error) {
+	bytes, err := fetchWithToken0(req, session.folioSession, `settings/entries?query=scope=="ui-ldp.admin"+and+key=="visibility"`)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch 'visibility' from settings: %w", err)
+	}
+
+	var r settingsResponseGeneral
+	err = json.Unmarshal(bytes, &r)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize 'visibility' setting: %w", err)
+	}
+	if len(r.Items) == 0 {
+		return nil, nil
+	}
+
+	// The value may be a JSON object, or a string containing one: see issue #60
+	var valueBytes []byte
+	if s, ok := r.Items[0].Value.(string); ok {
+		valueBytes = []byte(s)
+	} else {
+		valueBytes, err = json.Marshal(r.Items[0].Value)
+		if err != nil {
+			return nil, fmt.Errorf("could not serialize 'visibility' value: %w", err)
+		}
+	}
+
+	var rules visibilityRules
+	err = json.Unmarshal(valueBytes, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode 'visibility' value: %w", err)
+	}
+
+	err = rules.validate()
+	if err != nil {
+		return nil, fmt.Errorf("bad 'visibility' setting: %w", err)
+	}
+	return &rules, nil
+}
+
+
+func (rules *visibilityRules) validate() error {
+	for _, list := range [][]string{rules.IncludeSchemas, rules.ExcludeSchemas, rules.IncludeTables, rules.ExcludeTables} {
+		for _, pattern := range list {
+			_, err := path.Match(pattern, "")
+			if err != nil {
+				return fmt.Errorf("bad pattern '%s': %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+
+func matchesAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		// Patterns have already been validated
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+
+func (rules *visibilityRules) hasIncludes() bool {
+	return len(rules.IncludeSchemas) > 0 || len(rules.IncludeTables) > 0
+}
+
+
+// Whether a table is explicitly included, in addition to the default catalogue
+func (rules *visibilityRules) included(schema string, table string) bool {
+	return matchesAny(rules.IncludeSchemas, schema) || matchesAny(rules.IncludeTables, schema + "." + table)
+}
+
+
+// Exclusions take precedence over everything else
+func (rules *visibilityRules) excluded(schema string, table string) bool {
+	return matchesAny(rules.ExcludeSchemas, schema) || matchesAny(rules.ExcludeTables, schema + "." + table)
+}
+
+
+// Adds explicitly included tables to the default catalogue and
+// removes excluded tables, preserving order
+func (rules *visibilityRules) apply(dbConn PgxIface, tables []dbTable) ([]dbTable, error) {
+	if rules.hasIncludes() {
+		all, err := fetchAllTables(dbConn)
+		if err != nil {
+			return nil, err
+		}
+		listed := map[string]bool{}
+		for _, t := range tables {
+			listed[t.SchemaName + "." + t.TableName] = true
+		}
+		for _, t := range all {
+			if !listed[t.SchemaName + "." + t.TableName] && rules.included(t.SchemaName, t.TableName) {
+				tables = append(tables, t)
+			}
+		}
+	}
+
+	visible := make([]dbTable, 0, len(tables))
+	for _, t := range tables {
+		if !rules.excluded(t.SchemaName, t.TableName) {
+			visible = append(visible, t)
+		}
+	}
+	return visible, nil
+}
+
+
+// All tables and views outside PostgreSQL's own schemas
+func fetchAllTables(dbConn PgxIface) ([]dbTable, error) {
+	query := `SELECT table_schema AS schema_name, table_name FROM information_schema.tables
+		WHERE table_schema NOT IN ('pg_catalog', 'information_schema') AND table_schema NOT LIKE 'pg\_%'
+		ORDER BY table_schema, table_name`
+	rows, err := dbConn.Query(context.Background(), query)
+	if err != nil {
+		return nil, fmt.Errorf("could not run query '%s': %w", query, err)
+	}
+	defer rows.Close()
+
+	tables := []dbTable{}
+	for rows.Next() {
+		var t dbTable
+		err = rows.Scan(&t.SchemaName, &t.TableName)
+		if err != nil {
+			return nil, fmt.Errorf("could not read table name: %w", err)
+		}
+		tables = append(tables, t)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read table names: %w", err)
+	}
+	return tables, nil
+}
+
+
+func containsTable(tables []dbTable, schema string, table string) bool {
+	for _, t := range tables {
+		if t.SchemaName == schema && t.TableName == table {
+			return true
+		}
+	}
+	return false
+}
+
+
+// A visible table is one that would be listed by /ldp/db/tables
+func checkTableVisible(cache *schemaCache, dbConn PgxIface, isMetaDB bool, rules *visibilityRules, schema string, table string) error {
+	if rules == nil {
+		return nil
+	}
+
+	tables, err := cache.fetchTables(dbConn, isMetaDB, rules)
+	if err != nil {
+		return fmt.Errorf("could not fetch tables from reporting DB: %w", err)
+	}
+	if !containsTable(tables, schema, table) {
+		return fmt.Errorf("table %s.%s is not available", schema, table)
+	}
+	return nil
+}
+
+
+// Matches schema-qualified names such as folio_users.users and
+// "folio_users"."users", but not function calls such as public.f(x)
+var qualifiedNameRegexp = regexp.MustCompile(`("(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)\s*\.\s*("(?:[^"]|"")+"|[A-Za-z_][A-Za-z0-9_$]*)(\s*\()?`)
+
+// Identifiers with Unicode escapes, such as U&"d\0061ta", which we
+// cannot compare with table names
+var unicodeIdentifierRegexp = regexp.MustCompile(`(?i)\bU&"`)
+
+
+func unquoteIdentifier(s string) string {
+	if strings.HasPrefix(s, `"`) {
+		return strings.ReplaceAll(s[1:len(s)-1], `""`, `"`)
+	}
+	return strings.ToLower(s)
+}
+
+
+// This is necessarily a best-effort check, since we do not parse the
+// SQL. It finds every schema-qualified name whose schema exists in the
+// database, and rejects the SQL if any of them is not a visible table.
+// Unqualified names, which are resolved using the search path, are not
+// checked, and nor are names built while the SQL runs, such as those
+// passed to query_to_xml.
+func checkSqlVisibility(cache *schemaCache, dbConn PgxIface, isMetaDB bool, rules *visibilityRules, sql string) error {
+	if rules == nil {
+		return nil
+	}
+
+	if unicodeIdentifierRegexp.MatchString(sql) {
+		return fmt.Errorf("identifiers with Unicode escapes may not be used")
+	}
+	// Without comments, which could otherwise separate the parts of a name
+	statements, err := splitStatements(sql)
+	if err != nil {
+		return fmt.Errorf("could not parse SQL: %w", err)
+	}
+	sql = strings.Join(statements, ";\n")
+
+	type qualifiedName struct { schema, table string }
+	names := []qualifiedName{}
+	for _, m := range qualifiedNameRegexp.FindAllStringSubmatch(sql, -1) {
+		if m[3] == "" {
+			names = append(names, qualifiedName{unquoteIdentifier(m[1]), unquoteIdentifier(m[2])})
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	schemas, err := fetchSchemaNames(dbConn)
+	if err != nil {
+		return err
+	}
+
+	tables, err := cache.fetchTables(dbConn, isMetaDB, rules)
+	if err != nil {
+		return fmt.Errorf("could not fetch tables from reporting DB: %w", err)
+	}
+	for _, name := range names {
+		// PostgreSQL's own catalogues contain no data
+		if name.schema == "pg_catalog" || name.schema == "information_schema" {
+			continue
+		}
+		if schemas[name.schema] && !containsTable(tables, name.schema, name.table) {
+			return fmt.Errorf("table %s.%s is not available", name.schema, name.table)
+		}
+	}
+	return nil
+}
+
+
+func fetchSchemaNames(dbConn PgxIface) (map[string]bool, error) {
+	query := "SELECT nspname FROM pg_namespace"
+	rows, err := dbConn.Query(context.Background(), query)
+	if err != nil {
+		return nil, fmt.Errorf("could not run query '%s': %w", query, err)
+	}
+	defer rows.Close()
+
+	schemas := map[string]bool{}
+	for rows.Next() {
+		var schema string
+		err = rows.Scan(&schema)
+		if err != nil {
+			return nil, fmt.Errorf("could not read schema name: %w", err)
+		}
+		schemas[schema] = true
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("could not read schema names: %w", err)
+	}
+	return schemas, nil
+}
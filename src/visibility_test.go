@@ -0,0 +1,264 @@
+package main
+
+import "time"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "github.com/stretchr/testify/assert"
+import "github.com/pashagolub/pgxmock/v3"
+
+
+func Test_fetchVisibilityRules(t *testing.T) {
+	tests := []struct {
+		name string
+		items string
+		expected *visibilityRules
+		errorstr string
+	}{
+		{
+			name: "no setting",
+			items: ``,
+			expected: nil,
+		},
+		{
+			name: "object value",
+			items: `{ "key": "visibility", "value": { "includeSchemas": ["local_*"], "excludeTables": ["*.*__"] } }`,
+			expected: &visibilityRules{IncludeSchemas: []string{"local_*"}, ExcludeTables: []string{"*.*__"}},
+		},
+		{
+			name: "string value",
+			items: `{ "key": "visibility", "value": "{ \"excludeSchemas\": [\"folio_audit\"] }" }`,
+			expected: &visibilityRules{ExcludeSchemas: []string{"folio_audit"}},
+		},
+		{
+			name: "bad pattern",
+			items: `{ "key": "visibility", "value": { "includeTables": ["public.[x"] } }`,
+			errorstr: "bad pattern 'public.[x'",
+		},
+		{
+			name: "bad value",
+			items: `{ "key": "visibility", "value": { "includeTables": "public.x" } }`,
+			errorstr: "could not decode 'visibility' value",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				_, _ = w.Write([]byte(`{ "items": [` + test.items + `] }`))
+			}))
+			defer ts.Close()
+			session, err := NewModReportingSession(nil, ts.URL, "dummyTenant")
+			assert.Nil(t, err)
+
+			req := httptest.NewRequest("GET", "/ldp/db/tables", nil)
+			rules, err := fetchVisibilityRules(req, session)
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+				assert.Equal(t, test.expected, rules)
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+			}
+		})
+	}
+}
+
+
+func Test_fetchVisibilityRulesCached(t *testing.T) {
+	fetches := 0
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fetches++
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte(`{ "items": [{ "key": "visibility", "value": { "excludeSchemas": ["folio_audit"] } }] }`))
+	}))
+	defer ts.Close()
+	session, err := NewModReportingSession(nil, ts.URL, "dummyTenant")
+	assert.Nil(t, err)
+	req := httptest.NewRequest("GET", "/ldp/db/tables", nil)
+	expected := &visibilityRules{ExcludeSchemas: []string{"folio_audit"}}
+
+	t.Run("fetched once", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			rules, err := fetchVisibilityRules(req, session)
+			assert.Nil(t, err)
+			assert.Equal(t, expected, rules)
+		}
+		assert.Equal(t, 1, fetches)
+	})
+
+	t.Run("fetched again when the setting changes", func(t *testing.T) {
+		session.resetVisibilityRules()
+		_, err := fetchVisibilityRules(req, session)
+		assert.Nil(t, err)
+		assert.Equal(t, 2, fetches)
+	})
+
+	t.Run("fetched again when stale", func(t *testing.T) {
+		session.visibilityMutex.Lock()
+		session.visibilityFetched = time.Now().Add(-session.visibilityCheckInterval())
+		session.visibilityMutex.Unlock()
+		_, err := fetchVisibilityRules(req, session)
+		assert.Nil(t, err)
+		assert.Equal(t, 3, fetches)
+	})
+
+	t.Run("failures are not cached", func(t *testing.T) {
+		session.resetVisibilityRules()
+		fail = true
+		_, err := fetchVisibilityRules(req, session)
+		assert.ErrorContains(t, err, "could not fetch 'visibility' from settings")
+		fail = false
+		rules, err := fetchVisibilityRules(req, session)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, rules)
+		assert.Equal(t, 5, fetches)
+	})
+}
+
+func establishMockForVisibleTables(mock pgxmock.PgxPoolIface) {
+	mock.ExpectQuery("SELECT schema_name, table_name FROM metadb.base_table").
+		WillReturnRows(pgxmock.NewRows([]string{"schema_name", "table_name"}).
+			AddRow("folio_users", "users").
+			AddRow("folio_users", "users__").
+			AddRow("folio_audit", "events"))
+	mock.ExpectQuery("SELECT table_schema AS schema_name, table_name FROM information_schema.tables").
+		WillReturnRows(pgxmock.NewRows([]string{"schema_name", "table_name"}).
+			AddRow("folio_users", "users").
+			AddRow("local_mike", "loans").
+			AddRow("local_mike", "loans__").
+			AddRow("public", "secret"))
+	establishMockForReadableTables(mock, 1, 2)
+}
+
+
+func Test_visibility(t *testing.T) {
+	rules := &visibilityRules{
+		IncludeSchemas: []string{"local_*"},
+		ExcludeSchemas: []string{"folio_audit"},
+		ExcludeTables: []string{"*.*__"},
+	}
+
+	t.Run("fetch tables", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		establishMockForVisibleTables(mock)
+
+		tables, err := fetchTables(mock, true, rules)
+		assert.Nil(t, err)
+		assert.Equal(t, []dbTable{
+			{ SchemaName: "folio_users", TableName: "users" },
+			{ SchemaName: "local_mike", TableName: "loans" },
+		}, tables)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("no includes", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		mock.ExpectQuery("SELECT schema_name, table_name FROM metadb.base_table").
+			WillReturnRows(pgxmock.NewRows([]string{"schema_name", "table_name"}).
+				AddRow("folio_inventory", "records_instances").
+				AddRow("folio_inventory", "holdings_record"))
+		establishMockForReadableTables(mock, 1)
+
+		tables, err := fetchTables(mock, true, &visibilityRules{ExcludeTables: []string{"*.holdings_*"}})
+		assert.Nil(t, err)
+		assert.Equal(t, []dbTable{{ SchemaName: "folio_inventory", TableName: "records_instances" }}, tables)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	})
+
+	t.Run("check table", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		establishMockForVisibleTables(mock)
+		establishMockForVisibleTables(mock)
+
+		assert.Nil(t, checkTableVisible(nil, mock, true, rules, "local_mike", "loans"))
+		err = checkTableVisible(nil, mock, true, rules, "folio_audit", "events")
+		assert.ErrorContains(t, err, "table folio_audit.events is not available")
+		assert.Nil(t, checkTableVisible(nil, mock, true, nil, "folio_audit", "events"))
+	})
+
+	tests := []struct {
+		name string
+		sql string
+		errorstr string
+	}{
+		{
+			name: "visible tables",
+			sql: `SELECT u.id, l.x FROM folio_users.users u JOIN "local_mike"."loans" l ON l.user_id = u.id`,
+		},
+		{
+			name: "hidden table",
+			sql: `SELECT * FROM folio_users.users WHERE id IN (SELECT user_id FROM folio_audit . events)`,
+			errorstr: "table folio_audit.events is not available",
+		},
+		{
+			name: "hidden table in other case",
+			sql: `SELECT * FROM Public.Secret`,
+			errorstr: "table public.secret is not available",
+		},
+		{
+			name: "quoted history table",
+			sql: `SELECT * FROM "folio_users"."users__"`,
+			errorstr: "table folio_users.users__ is not available",
+		},
+		{
+			name: "hidden table behind comment",
+			sql: `SELECT * FROM folio_audit/* x */.events`,
+			errorstr: "table folio_audit.events is not available",
+		},
+		{
+			name: "hidden table behind line comment",
+			sql: "SELECT * FROM folio_audit -- x\n.events",
+			errorstr: "table folio_audit.events is not available",
+		},
+		{
+			name: "Unicode escapes",
+			sql: `SELECT * FROM U&"folio_\0061udit".events`,
+			errorstr: "identifiers with Unicode escapes may not be used",
+		},
+		{
+			name: "unterminated comment",
+			sql: `SELECT * FROM folio_audit/* .events`,
+			errorstr: "could not parse SQL: unterminated comment",
+		},
+		{
+			name: "functions and catalogues",
+			sql: `SELECT public.secret(x) FROM pg_catalog.pg_class`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock, err := pgxmock.NewPool()
+			assert.Nil(t, err)
+			defer mock.Close()
+			mock.ExpectQuery("SELECT nspname FROM pg_namespace").
+				WillReturnRows(pgxmock.NewRows([]string{"nspname"}).
+					AddRow("folio_users").AddRow("folio_audit").AddRow("local_mike").AddRow("public").AddRow("pg_catalog"))
+			establishMockForVisibleTables(mock)
+
+			err = checkSqlVisibility(nil, mock, true, rules, test.sql)
+			if test.errorstr == "" {
+				assert.Nil(t, err)
+			} else {
+				assert.ErrorContains(t, err, test.errorstr)
+			}
+		})
+	}
+
+	t.Run("no schema-qualified names", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		assert.Nil(t, err)
+		defer mock.Close()
+		assert.Nil(t, checkSqlVisibility(nil, mock, true, rules, "SELECT id FROM users"))
+	})
+}